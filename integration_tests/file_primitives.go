@@ -57,7 +57,8 @@ func file_primitives() {
 
 	// Read back an object immediately to force a read from the
 	// serialization that is cached while writing
-	x,_ := f3.Object(f3.WriteObject(pdf.NewNumeric(3.14)).ObjectNumber(f3))
+	written,_ := f3.WriteObject(pdf.NewNumeric(3.14))
+	x,_ := f3.Object(written.ObjectNumber(f3))
 	logger.WriteString("Object: ")
 	x.Serialize(logger, f3)
 	logger.WriteString("\n")
@@ -10,10 +10,10 @@ import (
 func make_file() {
 	f,_,_ := pdf.OpenFile(OutputDirectory + "/test-file.pdf", os.O_RDWR|os.O_CREATE)
 	o1 := pdf.NewIndirect()
-	indirect1 := f.WriteObject(o1)
+	indirect1,_ := f.WriteObject(o1)
 	o1.Write(pdf.NewNumeric(3.14))
 
-	indirect2 := f.WriteObject(pdf.NewNumeric(2.718))
+	indirect2,_ := f.WriteObject(pdf.NewNumeric(2.718))
 
 	f.WriteObject(pdf.NewName("foo"))
 
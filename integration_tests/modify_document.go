@@ -24,7 +24,7 @@ func modify_document() {
 
 	backgroundStream := pdf.NewStreamFactory().New()
 	backgroundStream.Write([]byte("q 0.9 g 0.9 G 0 768 612 24 re b Q"))
-	id := doc.WriteObject(backgroundStream)
+	id,_ := doc.WriteObject(backgroundStream)
 
 	oldPage.PrependContents(id)
 	oldPage.Rewrite()
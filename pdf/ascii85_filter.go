@@ -0,0 +1,88 @@
+package pdf
+
+import (
+	"bytes"
+	"encoding/ascii85"
+	"io")
+
+
+type Ascii85Filter struct {
+}
+
+const ( ascii85DecoderName = "ASCII85Decode" )
+
+func init () {
+	RegisterFilterFactoryFactory(ascii85DecoderName,
+		func(ProtectedDictionary) StreamFilterFactory { return new(Ascii85Filter) })
+}
+
+func (filter *Ascii85Filter) Name() string {
+	return ascii85DecoderName
+}
+
+func (filter *Ascii85Filter) NewEncoder(writer io.WriteCloser) io.WriteCloser {
+	return &Ascii85Writer{ascii85.NewEncoder(writer),writer}
+}
+
+func (filter *Ascii85Filter) NewDecoder(reader io.Reader) io.Reader {
+	return &Ascii85Reader{ascii85.NewDecoder(&ascii85Source{reader,false})}
+}
+
+func (filter *Ascii85Filter) DecodeParms(file... File) Object {
+	return NewNull()
+}
+
+type Ascii85Writer struct {
+	io.WriteCloser
+	underlyingWriter io.WriteCloser
+}
+
+// Close() flushes the final partial group and writes the "~>"
+// end-of-data marker.
+func (aw *Ascii85Writer) Close() error {
+	if err := aw.WriteCloser.Close(); err != nil {
+		return err
+	}
+	if _,err := aw.underlyingWriter.Write([]byte("~>")); err != nil {
+		return err
+	}
+	return aw.underlyingWriter.Close()
+}
+
+type Ascii85Reader struct {
+	io.Reader
+}
+
+// ascii85Source passes the encoded data to the ascii85 decoder up to
+// the "~>" end-of-data marker, which the decoder doesn't recognize.
+// An optional "<~" prefix is also removed.
+type ascii85Source struct {
+	reader io.Reader
+	started bool
+}
+
+func (s *ascii85Source) Read(buffer []byte) (n int, err error) {
+	if s.reader == nil {
+		return 0, io.EOF
+	}
+	n,err = s.reader.Read(buffer)
+	if !s.started && n > 0 {
+		if data := bytes.TrimLeft(buffer[:n], " \t\r\n\f\x00"); len(data) > 0 {
+			s.started = true
+			if bytes.HasPrefix(data, []byte("<~")) {
+				data = data[2:]
+			}
+			n = copy(buffer, data)
+		} else {
+			n = 0
+		}
+	}
+	if i := bytes.IndexByte(buffer[:n], '~'); i >= 0 {
+		n = i
+		s.reader = nil
+		if err == nil {
+			err = io.EOF
+		}
+	}
+	return n,err
+}
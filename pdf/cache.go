@@ -0,0 +1,164 @@
+package pdf
+
+import (
+	"container/list"
+)
+
+// defaultObjectCacheSize is the approximate number of bytes of parsed
+// objects retained by a file unless SetObjectCacheSize() is called.
+const defaultObjectCacheSize = 4 << 20
+
+// objectOverhead is the size charged for each object in addition to
+// the contents of its strings, names, and streams.
+const objectOverhead = 16
+
+// objectCache is a least-recently-used cache of the objects parsed by
+// file.Object().  Entries are keyed by object number and remember the
+// generation they were parsed for.  The cache holds private copies of
+// the objects.  Callers always receive a copy (or a protected view),
+// so they can't alter a cached object.  The total estimated size of
+// the cached objects (see objectSize()) is kept within size bytes.
+type objectCache struct {
+	size int
+	used int
+	entries map[uint32]*list.Element
+	order *list.List
+}
+
+type objectCacheEntry struct {
+	objectNumber ObjectNumber
+	object Object
+	size int
+}
+
+func newObjectCache(size int) *objectCache {
+	return &objectCache{
+		size: size,
+		entries: make(map[uint32]*list.Element, 64),
+		order: list.New()}
+}
+
+// objectSize() estimates the memory held by object: the lengths of
+// its strings, names, and stream contents held in memory, plus
+// objectOverhead for each object.  The contents of streams that
+// remain in the file aren't counted.
+func objectSize(object Object) int {
+	size := objectOverhead
+	switch o := object.(type) {
+	case *stream:
+		size += o.buffer.Len() + objectSize(o.dictionary)
+	case *dictionary:
+		for key,value := range o.dictionary {
+			size += len(key) + objectSize(value)
+		}
+	case *array:
+		for i:=0; i<o.Size(); i++ {
+			size += objectSize(o.At(i))
+		}
+	case *stringImpl:
+		size += len(o.value)
+	case *name:
+		size += len(o.name)
+	}
+	return size
+}
+
+// get() returns the cached object with the passed number or nil if
+// it's not in the cache.
+func (c *objectCache) get(o ObjectNumber) Object {
+	element,ok := c.entries[o.number]
+	if !ok {
+		return nil
+	}
+	entry := element.Value.(*objectCacheEntry)
+	if entry.objectNumber != o {
+		return nil
+	}
+	c.order.MoveToFront(element)
+	return entry.object
+}
+
+// put() adds object to the cache, discarding the least recently used
+// objects if the cache is full.  An object larger than the cache
+// isn't cached.
+func (c *objectCache) put(o ObjectNumber, object Object) {
+	size := objectSize(object)
+	c.invalidate(o.number)
+	if size > c.size {
+		return
+	}
+	c.entries[o.number] = c.order.PushFront(&objectCacheEntry{o, object, size})
+	c.used += size
+	c.evict()
+}
+
+// evict() discards the least recently used objects until the cache is
+// within its size.
+func (c *objectCache) evict() {
+	for c.used > c.size && c.order.Len() > 0 {
+		c.remove(c.order.Back())
+	}
+}
+
+// invalidate() removes the object with the passed number, which is
+// being rewritten or deleted.
+func (c *objectCache) invalidate(number uint32) {
+	if element,ok := c.entries[number]; ok {
+		c.remove(element)
+	}
+}
+
+func (c *objectCache) remove(element *list.Element) {
+	entry := element.Value.(*objectCacheEntry)
+	delete(c.entries, entry.objectNumber.number)
+	c.used -= entry.size
+	c.order.Remove(element)
+}
+
+// resize() changes the capacity of the cache, discarding the least
+// recently used objects if necessary.
+func (c *objectCache) resize(size int) {
+	c.size = size
+	c.evict()
+}
+
+// SetObjectCacheSize() sets the approximate number of bytes of parsed
+// objects that the file retains so that reading them again, for
+// example while walking the page tree, doesn't require parsing them
+// again.  The size of an object is estimated from its strings, names,
+// and the stream contents it holds in memory.  Streams read from a
+// file usually leave their contents in the file, so they're cheap to
+// cache, while a large stream read from an object waiting to be
+// written may displace many other objects or not be cached at all.  A
+// size of 0 disables the cache.  The cache is invalidated as objects
+// are rewritten or deleted.
+func (f *file) SetObjectCacheSize(size int) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.cache.resize(size)
+}
+
+// ProtectedObject() is like Object() but returns a protected view of
+// the cached object rather than a copy, which avoids copying large
+// objects that the caller only reads.
+func (f *file) ProtectedObject(o ObjectNumber) (Object, error) {
+	f.lock.Lock()
+	cached := f.cache.get(o)
+	f.lock.Unlock()
+	if cached != nil {
+		return cached.Protect(), nil
+	}
+	object,err := f.Object(o)
+	if err != nil {
+		return nil, err
+	}
+	return object.Protect(), nil
+}
+
+// SetObjectCacheSize() sets the approximate number of bytes of parsed
+// objects retained by the document's file.  See file.SetObjectCacheSize().
+func (d *Document) SetObjectCacheSize(size int) {
+	if f,ok := d.file.(*file); ok {
+		f.SetObjectCacheSize(size)
+	}
+}
@@ -0,0 +1,39 @@
+package pdf
+
+import (
+	"testing"
+)
+
+func TestObjectCacheEviction(t *testing.T) {
+	largeStream := func(size int) Object {
+		return NewStreamFromContents(NewDictionary(), make([]byte, size), nil)
+	}
+	// Room for three streams and their dictionaries.
+	c := newObjectCache(3 << 20 + 1024)
+	for i:=uint32(1); i<=4; i++ {
+		c.put(ObjectNumber{i, 0}, largeStream(1 << 20))
+	}
+	if c.used > c.size {
+		t.Errorf("Cache holds %d bytes; expected at most %d", c.used, c.size)
+	}
+	if c.get(ObjectNumber{1, 0}) != nil {
+		t.Errorf("Least recently used stream wasn't evicted")
+	}
+	for i:=uint32(2); i<=4; i++ {
+		if c.get(ObjectNumber{i, 0}) == nil {
+			t.Errorf("Stream %d was evicted", i)
+		}
+	}
+
+	// A stream larger than the cache isn't cached and doesn't
+	// displace the cached objects.
+	c.put(ObjectNumber{5, 0}, largeStream(4 << 20))
+	if c.get(ObjectNumber{5, 0}) != nil || len(c.entries) != 3 {
+		t.Errorf("Stream larger than the cache was cached")
+	}
+
+	c.resize(1 << 20)
+	if len(c.entries) != 0 || c.used != 0 {
+		t.Errorf("Resized cache holds %d objects (%d bytes); expected none", len(c.entries), c.used)
+	}
+}
@@ -0,0 +1,457 @@
+package pdf
+
+import (
+	"bufio"
+	"errors"
+	"io")
+
+// CCITTFaxFilter decodes Group 3 (one- and two-dimensional) and Group
+// 4 fax data to rows of one bit per pixel.  The encoder copies data
+// that is already encoded with the parameters passed to
+// NewCCITTFaxFilter().
+type CCITTFaxFilter struct {
+	k int
+	endOfLine bool
+	encodedByteAlign bool
+	columns int
+	rows int
+	endOfBlock bool
+	blackIs1 bool
+	decodeParms ProtectedDictionary
+}
+
+func init () {
+	RegisterFilterFactoryFactory(ccittFaxDecoderName,
+		func(d ProtectedDictionary) StreamFilterFactory { return NewCCITTFaxFilter(d) })
+}
+
+// NewCCITTFaxFilter() constructs a CCITTFaxFilter from DecodeParms,
+// which may be nil.
+func NewCCITTFaxFilter(d ProtectedDictionary) *CCITTFaxFilter {
+	filter := &CCITTFaxFilter{columns: 1728, endOfBlock: true, decodeParms: d}
+	if d != nil {
+		if v,ok := d.GetInt("K"); ok {
+			filter.k = v
+		}
+		if v,ok := d.GetInt("Columns"); ok && v > 0 {
+			filter.columns = v
+		}
+		if v,ok := d.GetInt("Rows"); ok && v > 0 {
+			filter.rows = v
+		}
+		if v,ok := d.GetBoolean("EndOfLine"); ok {
+			filter.endOfLine = v
+		}
+		if v,ok := d.GetBoolean("EncodedByteAlign"); ok {
+			filter.encodedByteAlign = v
+		}
+		if v,ok := d.GetBoolean("EndOfBlock"); ok {
+			filter.endOfBlock = v
+		}
+		if v,ok := d.GetBoolean("BlackIs1"); ok {
+			filter.blackIs1 = v
+		}
+	}
+	return filter
+}
+
+func (filter *CCITTFaxFilter) Name() string {
+	return ccittFaxDecoderName
+}
+
+func (filter *CCITTFaxFilter) NewEncoder(writer io.WriteCloser) io.WriteCloser {
+	return writer
+}
+
+func (filter *CCITTFaxFilter) NewDecoder(reader io.Reader) io.Reader {
+	byteReader,ok := reader.(io.ByteReader)
+	if !ok {
+		byteReader = bufio.NewReader(reader)
+	}
+	return &CCITTFaxReader{
+		filter: filter,
+		bits: bitReader{reader: byteReader},
+		reference: []int{filter.columns, filter.columns}}
+}
+
+func (filter *CCITTFaxFilter) DecodeParms(file... File) Object {
+	if filter.decodeParms == nil {
+		return NewNull()
+	}
+	return filter.decodeParms.Unprotect()
+}
+
+// bitReader reads bits most significant first.
+type bitReader struct {
+	reader io.ByteReader
+	bits uint64
+	// n is the number of unread bits in bits.
+	n uint
+}
+
+// peek() returns the next n (at most 32) bits.  Past the end of the
+// input, zero bits are returned and ok is false.
+func (r *bitReader) peek(n uint) (bits uint32, ok bool) {
+	for r.n < n {
+		b,err := r.reader.ReadByte()
+		if err != nil {
+			return uint32(r.bits << (64 - r.n) >> (64 - n)), false
+		}
+		r.bits = r.bits<<8 | uint64(b)
+		r.n += 8
+	}
+	return uint32(r.bits >> (r.n - n) & (1<<n - 1)), true
+}
+
+func (r *bitReader) skip(n uint) {
+	if n > r.n {
+		n = r.n
+	}
+	r.n -= n
+}
+
+func (r *bitReader) read(n uint) (uint32, bool) {
+	bits,ok := r.peek(n)
+	if ok {
+		r.skip(n)
+	}
+	return bits,ok
+}
+
+// align() skips to the next byte boundary.
+func (r *bitReader) align() {
+	r.n -= r.n % 8
+}
+
+// faxCode is a node in a tree for decoding prefix codes.  Leaves have
+// a value; other nodes have children.
+type faxCode struct {
+	children [2]*faxCode
+	value int
+	leaf bool
+}
+
+// add() adds a code to the tree.  It panics if the code conflicts
+// with one already added, which would be an error in the tables.
+func (node *faxCode) add(code string, value int) {
+	for _,c := range code {
+		i := c - '0'
+		if node.children[i] == nil {
+			node.children[i] = new(faxCode)
+		}
+		node = node.children[i]
+		if node.leaf {
+			panic(errors.New(`Fax code is not a prefix code: ` + code))
+		}
+	}
+	if node.children[0] != nil || node.children[1] != nil {
+		panic(errors.New(`Fax code is not a prefix code: ` + code))
+	}
+	node.value = value
+	node.leaf = true
+}
+
+// decode() reads a code and returns its value or ok=false if the
+// input ends or doesn't contain a valid code.
+func (node *faxCode) decode(r *bitReader) (value int, ok bool) {
+	for !node.leaf {
+		bit,ok := r.read(1)
+		if !ok || node.children[bit] == nil {
+			return 0, false
+		}
+		node = node.children[bit]
+	}
+	return node.value, true
+}
+
+// Two-dimensional coding modes.
+const (
+	faxPass = iota
+	faxHorizontal
+	faxVertical0
+	faxVerticalR1
+	faxVerticalR2
+	faxVerticalR3
+	faxVerticalL1
+	faxVerticalL2
+	faxVerticalL3 )
+
+var (
+	faxWhiteCodes = new(faxCode)
+	faxBlackCodes = new(faxCode)
+	faxModeCodes = new(faxCode) )
+
+// faxEOL is the 12-bit end-of-line code 000000000001.
+const faxEOL = 1
+
+func init () {
+	whiteTerminating := []string{
+		"00110101", "000111", "0111", "1000", "1011", "1100", "1110", "1111",
+		"10011", "10100", "00111", "01000", "001000", "000011", "110100", "110101",
+		"101010", "101011", "0100111", "0001100", "0001000", "0010111", "0000011", "0000100",
+		"0101000", "0101011", "0010011", "0100100", "0011000", "00000010", "00000011", "00011010",
+		"00011011", "00010010", "00010011", "00010100", "00010101", "00010110", "00010111", "00101000",
+		"00101001", "00101010", "00101011", "00101100", "00101101", "00000100", "00000101", "00001010",
+		"00001011", "01010010", "01010011", "01010100", "01010101", "00100100", "00100101", "01011000",
+		"01011001", "01011010", "01011011", "01001010", "01001011", "00110010", "00110011", "00110100"}
+	whiteMakeup := []string{
+		"11011", "10010", "010111", "0110111", "00110110", "00110111", "01100100", "01100101",
+		"01101000", "01100111", "011001100", "011001101", "011010010", "011010011", "011010100", "011010101",
+		"011010110", "011010111", "011011000", "011011001", "011011010", "011011011", "010011000", "010011001",
+		"010011010", "011000", "010011011"}
+	blackTerminating := []string{
+		"0000110111", "010", "11", "10", "011", "0011", "0010", "00011",
+		"000101", "000100", "0000100", "0000101", "0000111", "00000100", "00000111", "000011000",
+		"0000010111", "0000011000", "0000001000", "00001100111", "00001101000", "00001101100", "00000110111", "00000101000",
+		"00000010111", "00000011000", "000011001010", "000011001011", "000011001100", "000011001101", "000001101000", "000001101001",
+		"000001101010", "000001101011", "000011010010", "000011010011", "000011010100", "000011010101", "000011010110", "000011010111",
+		"000001101100", "000001101101", "000011011010", "000011011011", "000001010100", "000001010101", "000001010110", "000001010111",
+		"000001100100", "000001100101", "000001010010", "000001010011", "000000100100", "000000110111", "000000111000", "000000100111",
+		"000000101000", "000001011000", "000001011001", "000000101011", "000000101100", "000001011010", "000001100110", "000001100111"}
+	blackMakeup := []string{
+		"0000001111", "000011001000", "000011001001", "000001011011", "000000110011", "000000110100", "000000110101", "0000001101100",
+		"0000001101101", "0000001001010", "0000001001011", "0000001001100", "0000001001101", "0000001110010", "0000001110011", "0000001110100",
+		"0000001110101", "0000001110110", "0000001110111", "0000001010010", "0000001010011", "0000001010100", "0000001010101", "0000001011010",
+		"0000001011011", "0000001100100", "0000001100101"}
+	extendedMakeup := []string{
+		"00000001000", "00000001100", "00000001101", "000000010010", "000000010011", "000000010100", "000000010101",
+		"000000010110", "000000010111", "000000011100", "000000011101", "000000011110", "000000011111"}
+
+	for run,code := range whiteTerminating {
+		faxWhiteCodes.add(code, run)
+	}
+	for run,code := range blackTerminating {
+		faxBlackCodes.add(code, run)
+	}
+	for i,code := range whiteMakeup {
+		faxWhiteCodes.add(code, 64*(i+1))
+	}
+	for i,code := range blackMakeup {
+		faxBlackCodes.add(code, 64*(i+1))
+	}
+	for i,code := range extendedMakeup {
+		faxWhiteCodes.add(code, 1792 + 64*i)
+		faxBlackCodes.add(code, 1792 + 64*i)
+	}
+
+	for mode,code := range []string{"0001", "001", "1", "011", "000011", "0000011", "010", "000010", "0000010"} {
+		faxModeCodes.add(code, mode)
+	}
+}
+
+var invalidFaxCode = errors.New(`Invalid CCITTFaxDecode data`)
+
+// CCITTFaxReader decodes fax data one row at a time.  Rows are
+// represented by their changing elements: the positions at which the
+// color changes, starting with a change from white to black.
+type CCITTFaxReader struct {
+	filter *CCITTFaxFilter
+	bits bitReader
+	reference []int
+	row int
+	unread []byte
+	err error
+}
+
+func (r *CCITTFaxReader) Read(buffer []byte) (n int, err error) {
+	for n < len(buffer) {
+		if len(r.unread) == 0 {
+			if r.err != nil {
+				return n,r.err
+			}
+			r.readRow()
+			continue
+		}
+		m := copy(buffer[n:], r.unread)
+		r.unread = r.unread[m:]
+		n += m
+	}
+	return n,nil
+}
+
+// readRow() decodes the next row into unread or sets err.
+func (r *CCITTFaxReader) readRow() {
+	f := r.filter
+	if f.rows > 0 && r.row >= f.rows {
+		r.err = io.EOF
+		return
+	}
+	if f.encodedByteAlign && (f.k < 0 || !f.endOfLine) {
+		r.bits.align()
+	}
+
+	// Skip fill bits and EOLs.  Two or more EOLs in a row mark
+	// the end of the data (EOFB for Group 4, RTC for Group 3).
+	eols := 0
+	for {
+		code,ok := r.bits.peek(12)
+		if !ok && code == 0 {
+			r.err = io.EOF
+			return
+		}
+		if code == faxEOL {
+			r.bits.skip(12)
+			eols += 1
+			// With K > 0, a tag bit follows each EOL,
+			// including those in RTC.
+			if f.k > 0 {
+				if next,_ := r.bits.peek(13); next == 1<<12 | faxEOL {
+					r.bits.skip(1)
+				}
+			}
+		} else if code == 0 {
+			r.bits.skip(1)
+		} else {
+			break
+		}
+	}
+	if eols >= 2 && f.endOfBlock {
+		r.err = io.EOF
+		return
+	}
+
+	twoDimensional := f.k < 0
+	if f.k > 0 {
+		tag,_ := r.bits.read(1)
+		twoDimensional = tag == 0
+	}
+
+	var (
+		changes []int
+		err error )
+	if twoDimensional {
+		changes,err = r.decode2D()
+	} else {
+		changes,err = r.decode1D()
+	}
+	if err != nil {
+		r.err = err
+		return
+	}
+
+	r.row += 1
+	r.reference = append(changes, f.columns, f.columns)
+	r.unread = r.pack(changes)
+}
+
+// runLength() reads makeup codes and a terminating code.
+func (r *CCITTFaxReader) runLength(codes *faxCode) (int, error) {
+	total := 0
+	for {
+		run,ok := codes.decode(&r.bits)
+		if !ok {
+			return 0, invalidFaxCode
+		}
+		total += run
+		if run < 64 {
+			return total, nil
+		}
+	}
+}
+
+func faxCodes(black bool) *faxCode {
+	if black {
+		return faxBlackCodes
+	}
+	return faxWhiteCodes
+}
+
+func (r *CCITTFaxReader) decode1D() ([]int, error) {
+	columns := r.filter.columns
+	changes := make([]int, 0, 16)
+	black := false
+	for position:=0; position < columns; black = !black {
+		run,err := r.runLength(faxCodes(black))
+		if err != nil {
+			return nil, err
+		}
+		position += run
+		if position > columns {
+			position = columns
+		}
+		if position < columns {
+			changes = append(changes, position)
+		}
+	}
+	return changes, nil
+}
+
+func (r *CCITTFaxReader) decode2D() ([]int, error) {
+	columns := r.filter.columns
+	reference := r.reference
+	changes := make([]int, 0, len(reference))
+	a0 := -1
+	black := false
+	for a0 < columns {
+		// b1 is the first changing element on the reference
+		// line to the right of a0 and of opposite color to a0.
+		// Even indices are changes to black.
+		i := 0
+		for i < len(reference)-2 && (reference[i] <= a0 || (i%2 == 1) != black) {
+			i += 1
+		}
+		b1,b2 := reference[i],reference[i+1]
+
+		mode,ok := faxModeCodes.decode(&r.bits)
+		if !ok {
+			return nil, invalidFaxCode
+		}
+		switch mode {
+		case faxPass:
+			a0 = b2
+			continue
+		case faxHorizontal:
+			start := a0
+			if start < 0 {
+				start = 0
+			}
+			run1,err := r.runLength(faxCodes(black))
+			if err != nil {
+				return nil, err
+			}
+			run2,err := r.runLength(faxCodes(!black))
+			if err != nil {
+				return nil, err
+			}
+			changes = append(changes, start+run1, start+run1+run2)
+			a0 = start+run1+run2
+		default:
+			a1 := b1 + [...]int{0, 1, 2, 3, -1, -2, -3}[mode-faxVertical0]
+			if a1 < 0 || a1 < a0 {
+				return nil, invalidFaxCode
+			}
+			changes = append(changes, a1)
+			a0 = a1
+			black = !black
+		}
+	}
+
+	// Drop changes at or past the end of the row.
+	for len(changes) > 0 && changes[len(changes)-1] >= columns {
+		changes = changes[:len(changes)-1]
+	}
+	return changes, nil
+}
+
+// pack() converts changing elements to a row of one bit per pixel.
+func (r *CCITTFaxReader) pack(changes []int) []byte {
+	columns := r.filter.columns
+	row := make([]byte, (columns+7)/8)
+	// Bits are 1 for white unless BlackIs1.
+	set := func(start, end int) {
+		for x:=start; x<end && x<columns; x++ {
+			row[x/8] |= 0x80 >> uint(x%8)
+		}
+	}
+	previous := 0
+	for i,change := range changes {
+		if (i%2 == 0) != r.filter.blackIs1 {
+			set(previous, change)
+		}
+		previous = change
+	}
+	if (len(changes)%2 == 0) != r.filter.blackIs1 {
+		set(previous, columns)
+	}
+	return row
+}
@@ -0,0 +1,174 @@
+package pdf
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"math/big"
+	"sort"
+)
+
+// The CMS (RFC 5652) structures required for detached PDF signatures.
+// Only the subset of CMS used by PAdES is implemented: a single
+// signer, SHA-256 digests, RSA or ECDSA keys, and signed attributes.
+
+var (
+	oidData                 = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidSignedData           = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidSHA256               = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidRSAEncryption        = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}
+	oidECDSAWithSHA256      = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+	oidContentType          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 3}
+	oidMessageDigest        = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+	oidSigningCertificateV2 = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 16, 2, 47}
+)
+
+type cmsContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"optional,explicit,tag:0"`
+}
+
+type cmsEncapsulatedContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+}
+
+type cmsSignedData struct {
+	Version          int
+	DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+	EncapContentInfo cmsEncapsulatedContentInfo
+	Certificates     asn1.RawValue   `asn1:"optional,tag:0"`
+	SignerInfos      []cmsSignerInfo `asn1:"set"`
+}
+
+type cmsIssuerAndSerialNumber struct {
+	Issuer       asn1.RawValue
+	SerialNumber *big.Int
+}
+
+type cmsSignerInfo struct {
+	Version            int
+	SID                cmsIssuerAndSerialNumber
+	DigestAlgorithm    pkix.AlgorithmIdentifier
+	SignedAttributes   asn1.RawValue `asn1:"optional,tag:0"`
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          []byte
+}
+
+type cmsAttribute struct {
+	Type   asn1.ObjectIdentifier
+	Values []asn1.RawValue `asn1:"set"`
+}
+
+type essCertIDv2 struct {
+	CertHash []byte
+}
+
+type signingCertificateV2 struct {
+	Certs []essCertIDv2
+}
+
+// newCMSSignature() returns a DER encoded CMS ContentInfo containing
+// a detached SignedData for content having the passed SHA-256 digest.
+// The first certificate in chain must be the signer's certificate.
+func newCMSSignature(digest []byte, signer crypto.Signer, chain []*x509.Certificate) ([]byte, error) {
+	if len(chain) == 0 {
+		return nil, errors.New(`A signing certificate is required`)
+	}
+	certificate := chain[0]
+
+	var signatureAlgorithm pkix.AlgorithmIdentifier
+	switch signer.Public().(type) {
+	case *rsa.PublicKey:
+		signatureAlgorithm = pkix.AlgorithmIdentifier{Algorithm: oidRSAEncryption, Parameters: asn1.NullRawValue}
+	case *ecdsa.PublicKey:
+		signatureAlgorithm = pkix.AlgorithmIdentifier{Algorithm: oidECDSAWithSHA256}
+	default:
+		return nil, errors.New(`Unsupported signing key type`)
+	}
+
+	certificateHash := sha256.Sum256(certificate.Raw)
+	attributes, err := marshalAttributes(
+		cmsAttributeValue(oidContentType, oidData),
+		cmsAttributeValue(oidMessageDigest, digest),
+		cmsAttributeValue(oidSigningCertificateV2,
+			signingCertificateV2{[]essCertIDv2{{certificateHash[:]}}}))
+	if err != nil {
+		return nil, err
+	}
+
+	// The signature is computed over the DER encoding of the
+	// attributes as a SET OF, not over the implicitly tagged
+	// encoding stored in the SignerInfo.
+	attributeSet, err := asn1.Marshal(asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true, Bytes: attributes})
+	if err != nil {
+		return nil, err
+	}
+	attributeDigest := sha256.Sum256(attributeSet)
+	signature, err := signer.Sign(rand.Reader, attributeDigest[:], crypto.SHA256)
+	if err != nil {
+		return nil, err
+	}
+
+	var certificates []byte
+	for _, c := range chain {
+		certificates = append(certificates, c.Raw...)
+	}
+
+	sha256Algorithm := pkix.AlgorithmIdentifier{Algorithm: oidSHA256}
+	signedData, err := asn1.Marshal(cmsSignedData{
+		Version:          1,
+		DigestAlgorithms: []pkix.AlgorithmIdentifier{sha256Algorithm},
+		EncapContentInfo: cmsEncapsulatedContentInfo{oidData},
+		Certificates:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: certificates},
+		SignerInfos: []cmsSignerInfo{{
+			Version:            1,
+			SID:                cmsIssuerAndSerialNumber{asn1.RawValue{FullBytes: certificate.RawIssuer}, certificate.SerialNumber},
+			DigestAlgorithm:    sha256Algorithm,
+			SignedAttributes:   asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: attributes},
+			SignatureAlgorithm: signatureAlgorithm,
+			Signature:          signature}}})
+	if err != nil {
+		return nil, err
+	}
+
+	return asn1.Marshal(cmsContentInfo{
+		ContentType: oidSignedData,
+		Content:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: signedData}})
+}
+
+type attributeOrError struct {
+	attribute []byte
+	err       error
+}
+
+func cmsAttributeValue(oid asn1.ObjectIdentifier, value interface{}) attributeOrError {
+	encodedValue, err := asn1.Marshal(value)
+	if err != nil {
+		return attributeOrError{nil, err}
+	}
+	attribute, err := asn1.Marshal(cmsAttribute{oid, []asn1.RawValue{{FullBytes: encodedValue}}})
+	return attributeOrError{attribute, err}
+}
+
+// marshalAttributes() returns the concatenated encodings of the
+// attributes sorted as DER requires for a SET OF.
+func marshalAttributes(attributes ...attributeOrError) ([]byte, error) {
+	encodings := make([][]byte, 0, len(attributes))
+	for _, a := range attributes {
+		if a.err != nil {
+			return nil, a.err
+		}
+		encodings = append(encodings, a.attribute)
+	}
+	sort.Slice(encodings, func(i, j int) bool {
+		return bytes.Compare(encodings[i], encodings[j]) < 0
+	})
+	return bytes.Join(encodings, nil), nil
+}
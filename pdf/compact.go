@@ -0,0 +1,82 @@
+package pdf
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// SaveAs() writes a compacted copy of the file to filename.  Only the
+// objects reachable from the trailer's /Root and /Info entries are
+// copied, so free objects, objects replaced by incremental updates,
+// and objects no longer referenced are dropped.  Objects are
+// renumbered densely in the order they are encountered and the new
+// file has a single xref section.  The trailer /ID, if any, is
+// preserved.  The receiver is not modified and remains open.
+func (f *file) SaveAs(filename string) (err error) {
+	destination,_,err := OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if x := recover(); x != nil {
+			if err,_ = x.(error); err == nil {
+				err = fmt.Errorf("%v", x)
+			}
+			destination.Close()
+			os.Remove(filename)
+		}
+	} ()
+
+	for _,key := range []string{"Root", "Info"} {
+		if reference,ok := f.trailerDictionary.Get(key).(Indirect); ok {
+			// Binding the reference to the destination copies
+			// the object and, recursively, every object it
+			// references.
+			reference.ObjectNumber(destination)
+			destination.trailerDictionary.Add(key, reference)
+		}
+	}
+	if destination.trailerDictionary.Get("Root") == nil {
+		panic(errors.New(`File has no document catalog`))
+	}
+	if id := f.trailerDictionary.Get("ID"); id != nil {
+		destination.trailerDictionary.Add("ID", id.Clone())
+	}
+
+	return destination.Close()
+}
+
+// CompactFile() writes a compacted copy of the PDF file named by
+// source to destination as described for SaveAs().  The copy is
+// written to a temporary file that replaces destination only when it
+// is complete, so destination may name the source.
+func CompactFile(source, destination string) error {
+	info,err := os.Stat(source)
+	if err != nil {
+		return err
+	}
+	f,_,err := OpenFile(source, os.O_RDONLY)
+	if err != nil {
+		return err
+	}
+
+	temporary,err := ioutil.TempFile(filepath.Dir(destination), ".pdfig-")
+	if err != nil {
+		f.Close()
+		return err
+	}
+	temporary.Close()
+	os.Chmod(temporary.Name(), info.Mode().Perm())
+
+	err = f.SaveAs(temporary.Name())
+	f.Close()
+	if err != nil {
+		os.Remove(temporary.Name())
+		return err
+	}
+	return os.Rename(temporary.Name(), destination)
+}
@@ -0,0 +1,202 @@
+package pdf
+
+import (
+	"fmt"
+	"io")
+
+const (
+	cryptDecoderName = "Crypt"
+	// IdentityCryptFilter is the crypt filter that leaves data
+	// unchanged.
+	IdentityCryptFilter = "Identity" )
+
+func init () {
+	RegisterFilterFactoryFactory(cryptDecoderName,
+		func(d ProtectedDictionary) StreamFilterFactory { return &CryptFilter{cryptFilterName(d)} })
+}
+
+// CryptFilter implements the Crypt stream filter, which selects the
+// crypt filter of the document's security handler (an entry in the
+// /CF dictionary of the encryption dictionary) that encrypts a stream
+// in place of the default (/StmF).  PDF requires it to be the first
+// filter of a stream.  Only the Identity crypt filter, which leaves
+// data unchanged, can be encoded or decoded.  Any other crypt filter
+// requires the document's security handler to derive the encryption
+// key, and this library doesn't implement security handlers, so
+// streams using other crypt filters can be read only with
+// Stream.RawReader() and can't be written.
+type CryptFilter struct {
+	name string
+}
+
+// NewCryptFilter() returns a Crypt filter using the named crypt
+// filter.  An empty name means IdentityCryptFilter.  It returns an
+// error for any other crypt filter because encryption isn't
+// implemented (see CryptFilter).
+func NewCryptFilter(name string) (*CryptFilter, error) {
+	if name == "" {
+		name = IdentityCryptFilter
+	}
+	if name != IdentityCryptFilter {
+		return nil, fmt.Errorf(`Crypt filter %s requires a security handler, which isn't implemented`, name)
+	}
+	return &CryptFilter{name}, nil
+}
+
+// cryptFilterName() returns the /Name entry of a Crypt filter's
+// DecodeParms, which may be nil.
+func cryptFilterName(d ProtectedDictionary) string {
+	if d != nil {
+		if name,ok := d.GetName("Name"); ok {
+			return name
+		}
+	}
+	return IdentityCryptFilter
+}
+
+func (filter *CryptFilter) Name() string {
+	return cryptDecoderName
+}
+
+// CryptFilterName() returns the name of the crypt filter to use.
+func (filter *CryptFilter) CryptFilterName() string {
+	return filter.name
+}
+
+// NewEncoder() returns writer for the Identity crypt filter.  It
+// panics for any other crypt filter (obtained from FilterFactory())
+// rather than write data in clear under a crypt filter's name.
+func (filter *CryptFilter) NewEncoder(writer io.WriteCloser) io.WriteCloser {
+	if filter.name != IdentityCryptFilter {
+		panic(fmt.Errorf(`Crypt filter %s requires a security handler, which isn't implemented`, filter.name))
+	}
+	return writer
+}
+
+// NewDecoder() returns reader for the Identity crypt filter.  For any
+// other crypt filter it returns nil because decryption isn't
+// implemented (see CryptFilter).
+func (filter *CryptFilter) NewDecoder(reader io.Reader) io.Reader {
+	if filter.name != IdentityCryptFilter {
+		return nil
+	}
+	return reader
+}
+
+func (filter *CryptFilter) DecodeParms(file... File) Object {
+	return NewNull()
+}
+
+// CryptFilters describes the crypt filters of an encryption
+// dictionary (PDF 1.5 and later), which determine how strings,
+// streams, and embedded files are encrypted.
+type CryptFilters struct {
+	// Filters maps the names in /CF to the crypt filter
+	// dictionaries.
+	Filters map[string]ProtectedDictionary
+	// StreamFilter, StringFilter, and EmbeddedFileFilter are the
+	// names of the default crypt filters for streams (/StmF),
+	// strings (/StrF), and embedded files (/EFF).
+	StreamFilter, StringFilter, EmbeddedFileFilter string
+	// EncryptMetadata is false if metadata streams are left in
+	// clear.
+	EncryptMetadata bool
+}
+
+// NewCryptFilters() reads the crypt filters of an encryption
+// dictionary.  Encryption dictionaries without crypt filters (/V less
+// than 4) encrypt everything with the standard method, which is
+// called "StdCF" here.
+func NewCryptFilters(encrypt ProtectedDictionary) *CryptFilters {
+	cf := &CryptFilters{
+		Filters: make(map[string]ProtectedDictionary),
+		StreamFilter: IdentityCryptFilter,
+		StringFilter: IdentityCryptFilter,
+		EncryptMetadata: true}
+	if v,_ := encrypt.GetInt("V"); v < 4 {
+		cf.StreamFilter,cf.StringFilter,cf.EmbeddedFileFilter = "StdCF","StdCF","StdCF"
+		return cf
+	}
+	if filters := encrypt.GetDictionary("CF"); filters != nil {
+		for _,key := range filters.Keys() {
+			if d := filters.GetDictionary(key); d != nil {
+				cf.Filters[key] = d
+			}
+		}
+	}
+	if name,ok := encrypt.GetName("StmF"); ok {
+		cf.StreamFilter = name
+	}
+	if name,ok := encrypt.GetName("StrF"); ok {
+		cf.StringFilter = name
+	}
+	cf.EmbeddedFileFilter = cf.StreamFilter
+	if name,ok := encrypt.GetName("EFF"); ok {
+		cf.EmbeddedFileFilter = name
+	}
+	if b,ok := encrypt.GetBoolean("EncryptMetadata"); ok {
+		cf.EncryptMetadata = b
+	}
+	return cf
+}
+
+// StreamCryptFilter() returns the name of the crypt filter that
+// applies to a stream: the one named by its Crypt filter, if any,
+// IdentityCryptFilter for a metadata stream that isn't encrypted,
+// the embedded file filter for an embedded file, and otherwise the
+// stream filter.
+func (cf *CryptFilters) StreamCryptFilter(s ProtectedStream) string {
+	d := s.Dictionary()
+	if filters := d.GetArray("Filter"); filters != nil && filters.Size() > 0 {
+		if name,ok := filters.At(0).Dereference().(Name); ok && name.String() == cryptDecoderName {
+			var parms ProtectedDictionary
+			if decodeParms := d.GetArray("DecodeParms"); decodeParms != nil && decodeParms.Size() > 0 {
+				parms,_ = decodeParms.At(0).Dereference().(ProtectedDictionary)
+			}
+			return cryptFilterName(parms)
+		}
+	} else if name,_ := d.GetName("Filter"); name == cryptDecoderName {
+		return cryptFilterName(d.GetDictionary("DecodeParms"))
+	}
+	switch t,_ := d.GetName("Type"); t {
+	case "Metadata":
+		if !cf.EncryptMetadata {
+			return IdentityCryptFilter
+		}
+	case "EmbeddedFile":
+		return cf.EmbeddedFileFilter
+	}
+	return cf.StreamFilter
+}
+
+// Method() returns the /CFM (crypt filter method) of the named crypt
+// filter: "None", "V2" (RC4), "AESV2", or "AESV3".  It is "None" for
+// IdentityCryptFilter and "V2" for "StdCF" of an encryption dictionary
+// without crypt filters.
+func (cf *CryptFilters) Method(name string) string {
+	if name == IdentityCryptFilter {
+		return "None"
+	}
+	d,ok := cf.Filters[name]
+	if !ok {
+		if name == "StdCF" {
+			return "V2"
+		}
+		return "None"
+	}
+	if method,ok := d.GetName("CFM"); ok {
+		return method
+	}
+	return "None"
+}
+
+// CryptFilters() returns the crypt filters of the document's
+// encryption dictionary or nil if the document isn't encrypted.
+// This library doesn't decrypt documents; the crypt filters tell a
+// client which streams are in clear (see StreamCryptFilter()).
+func (d *Document) CryptFilters() *CryptFilters {
+	if encrypt := d.file.Trailer().GetDictionary("Encrypt"); encrypt != nil {
+		return NewCryptFilters(encrypt)
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package pdf
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// formatDate() returns the PDF date string representation (e.g.,
+// "D:20140325161703-05'00'") of t.
+func formatDate(t time.Time) string {
+	_,offset := t.Zone()
+	sign := byte('+')
+	if offset < 0 {
+		sign = '-'
+		offset = -offset
+	}
+	if offset == 0 {
+		return t.Format("D:20060102150405") + "Z"
+	}
+	return fmt.Sprintf("%s%c%02d'%02d'", t.Format("D:20060102150405"), sign, offset/3600, (offset/60)%60)
+}
+
+// parseDate() parses a PDF date string of the form
+// "D:YYYYMMDDHHmmSSOHH'mm'".  Everything after the year is optional
+// and the time zone is UTC if it is omitted.  The apostrophes are
+// optional too, since some writers omit them.
+func parseDate(s string) (time.Time, error) {
+	invalid := fmt.Errorf(`Invalid date string "%s"`, s)
+	s = strings.TrimPrefix(s, "D:")
+
+	// Year, month, day, hour, minute, and second, with their
+	// default values.
+	fields := [6]int{0, 1, 1, 0, 0, 0}
+	widths := [6]int{4, 2, 2, 2, 2, 2}
+	for i,width := range widths {
+		if len(s) == 0 || s[0] < '0' || s[0] > '9' {
+			if i == 0 {
+				return time.Time{}, invalid
+			}
+			break
+		}
+		if len(s) < width {
+			return time.Time{}, invalid
+		}
+		v,err := strconv.Atoi(s[:width])
+		if err != nil {
+			return time.Time{}, invalid
+		}
+		fields[i] = v
+		s = s[width:]
+	}
+
+	location := time.UTC
+	if len(s) > 0 {
+		sign := 1
+		switch s[0] {
+		case 'Z':
+		case '+':
+		case '-':
+			sign = -1
+		default:
+			return time.Time{}, invalid
+		}
+		zone := strings.Replace(s[1:], "'", "", -1)
+		offset := 0
+		for i:=0; i<2 && len(zone) >= 2; i++ {
+			v,err := strconv.Atoi(zone[:2])
+			if err != nil {
+				return time.Time{}, invalid
+			}
+			offset = offset*60 + v
+			zone = zone[2:]
+			if i == 0 && len(zone) < 2 {
+				offset *= 60
+			}
+		}
+		if len(zone) != 0 {
+			return time.Time{}, invalid
+		}
+		if offset != 0 {
+			location = time.FixedZone("", sign*offset*60)
+		}
+	}
+	return time.Date(fields[0], time.Month(fields[1]), fields[2], fields[3], fields[4], fields[5], 0, location), nil
+}
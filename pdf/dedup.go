@@ -0,0 +1,260 @@
+package pdf
+
+import (
+	"crypto/sha256"
+)
+
+// DeduplicationStatistics summarizes the duplicates detected by a
+// file with deduplication enabled.
+type DeduplicationStatistics struct {
+	// Objects is the number of objects that were not written
+	// because an identical object had already been written.
+	Objects int
+
+	// BytesSaved is the total size of the serializations of those
+	// objects, not counting their "obj" headers and xref entries.
+	BytesSaved int64
+}
+
+// deduplicator maps the SHA-256 hash of each object serialization
+// written to a file to the object's number so that a later object
+// with a byte-identical serialization can refer to the earlier
+// object instead of being written again.
+type deduplicator struct {
+	numbers map[[sha256.Size]byte]ObjectNumber
+	hashes map[uint32][sha256.Size]byte
+	// shared contains the numbers of the objects to which other
+	// Indirects have been rebound.  They're never overwritten.
+	shared map[uint32]bool
+	statistics DeduplicationStatistics
+}
+
+func newDeduplicator() *deduplicator {
+	return &deduplicator{
+		numbers: make(map[[sha256.Size]byte]ObjectNumber, 64),
+		hashes: make(map[uint32][sha256.Size]byte, 64),
+		shared: make(map[uint32]bool)}
+}
+
+// digest identifies the complete serialization of an object,
+// including any deferred stream bodies, and gives its size.
+type digest struct {
+	hash [sha256.Size]byte
+	size int64
+}
+
+// objectDigest() returns the digest of an object's serialization with
+// its deferred bodies inserted, or nil if deduplication is disabled
+// or a body can be read only once (see NewStreamFromReader()).  Bodies
+// left in the file a stream was read from are read to compute the
+// digest, so streams copied from other files are deduplicated
+// without holding them in memory.
+func (f *file) objectDigest(serialization []byte, bodies []deferredBody) *digest {
+	f.lock.Lock()
+	enabled := f.deduplicator != nil
+	f.lock.Unlock()
+	if !enabled {
+		return nil
+	}
+	d := &digest{size: int64(len(serialization))}
+	for _,body := range bodies {
+		if _,ok := body.source.(*fileRange); !ok {
+			return nil
+		}
+		d.size += body.source.size()
+	}
+	h := sha256.New()
+	if writeWithBodies(h, serialization, bodies) != nil {
+		return nil
+	}
+	copy(d.hash[:], h.Sum(nil))
+	return d
+}
+
+func (d *deduplicator) find(hash [sha256.Size]byte) (ObjectNumber, bool) {
+	o,ok := d.numbers[hash]
+	return o,ok
+}
+
+func (d *deduplicator) record(o ObjectNumber, hash [sha256.Size]byte) {
+	d.forget(o.number)
+	if _,exists := d.numbers[hash]; !exists {
+		d.numbers[hash] = o
+		d.hashes[o.number] = hash
+	}
+}
+
+// forget() removes the object with the passed number, which is about
+// to be overwritten or freed.
+func (d *deduplicator) forget(number uint32) {
+	if hash,ok := d.hashes[number]; ok {
+		delete(d.numbers, hash)
+		delete(d.hashes, number)
+	}
+}
+
+// SetDeduplication() enables or disables deduplication of objects
+// subsequently written with Indirect.Write(), File.WriteObject() or
+// Document.WriteObject().  When enabled, an object whose serialization
+// is byte-identical to that of an object already written during this
+// session is not written.  Instead, the new Indirect is rebound to the
+// existing object and the reserved object number is released.  Objects
+// whose Indirect has already been serialized (forward references) are
+// always written because the reserved number may already be in use.
+// An object that other Indirects were rebound to is never overwritten.
+// Rewriting it with Indirect.Write() or WriteObjectAt() writes the new
+// object at a new number and rebinds the writing Indirect (or, for
+// WriteObjectAt(), the Indirect that owns the number) to it, so
+// references to that Indirect serialized before the rewrite continue
+// to refer to the original object.  Streams are compared after
+// encoding, so identical streams are only detected when they were
+// encoded with the same filters.  Streams left in the file they were
+// read from are compared without being loaded into memory, but
+// streams constructed by NewStreamFromReader() can be read only once
+// and are never deduplicated.
+func (f *file) SetDeduplication(enable bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	switch {
+	case enable && f.deduplicator == nil:
+		f.deduplicator = newDeduplicator()
+	case !enable:
+		f.deduplicator = nil
+	}
+}
+
+// DeduplicationStatistics() returns the duplicates detected since
+// deduplication was last enabled.
+func (f *file) DeduplicationStatistics() DeduplicationStatistics {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.deduplicator == nil {
+		return DeduplicationStatistics{}
+	}
+	return f.deduplicator.statistics
+}
+
+// writeObjectOrDuplicate() writes object at objectNumber for the
+// Indirect i unless canDeduplicate is true, deduplication is enabled,
+// objectNumber was reserved but has never been written, and an
+// identical object already exists.  In that case the reserved number
+// is freed and the existing object number is returned.
+func (f *file) writeObjectOrDuplicate(i Indirect, objectNumber ObjectNumber, object Object, canDeduplicate bool) ObjectNumber {
+	f.inspect(objectNumber, object)
+	serialization,bodies := f.serialize(object)
+	return f.writeSerialization(i, objectNumber, serialization, bodies, canDeduplicate && !hasIdentity(object))
+}
+
+// findDuplicate() looks for an existing object identical to the one
+// about to be written at objectNumber.  If one is found, the reserved
+// number is freed and the existing object number is returned.  The
+// caller must hold f.lock.
+func (f *file) findDuplicate(objectNumber ObjectNumber, entry *xrefEntry, d *digest) (ObjectNumber, bool) {
+	if f.deduplicator == nil || entry.inUse || entry.serialization != nil {
+		return objectNumber, false
+	}
+	existing,ok := f.deduplicator.find(d.hash)
+	if !ok || existing == objectNumber {
+		return objectNumber, false
+	}
+	f.freeReservedObjectNumber(objectNumber)
+	f.deduplicator.shared[existing.number] = true
+	f.deduplicator.statistics.Objects += 1
+	f.deduplicator.statistics.BytesSaved += d.size
+	return existing, true
+}
+
+// distinctTypes lists the dictionary types whose instances must be
+// distinct objects even when they are identical.  A page, for
+// example, may appear only once in the page tree.
+var distinctTypes = map[string]bool{
+	"Catalog": true,
+	"Pages": true,
+	"Page": true,
+	"Annot": true,
+	"Sig": true}
+
+// hasIdentity() returns true if object is a dictionary of one of the
+// distinctTypes.
+func hasIdentity(object Object) bool {
+	if d,ok := object.(interface{ GetName(string) (string,bool) }); ok {
+		t,_ := d.GetName("Type")
+		return distinctTypes[t]
+	}
+	return false
+}
+
+// copyOnWrite() is called when the object at objectNumber, to which
+// other Indirects were rebound, is about to be rewritten by rewriter.
+// Those Indirects must continue to refer to the original object, so a
+// new number is reserved and rewriter is rebound to it.  If rewriter
+// is nil, the Indirect that owns objectNumber, if any, is rebound.
+// The caller must hold f.lock.
+func (f *file) copyOnWrite(rewriter Indirect, objectNumber ObjectNumber, entry *xrefEntry) (ObjectNumber, *xrefEntry) {
+	if rewriter == nil {
+		rewriter = entry.indirect
+	}
+	if entry.indirect == rewriter {
+		// Later references to objectNumber read from the file
+		// are to the original object.
+		entry.indirect = nil
+	}
+	newNumber := f.reserveObjectNumber(rewriter)
+	if i,ok := rewriter.(*indirect); ok {
+		i.lock.Lock()
+		i.fileBindings[f] = newNumber
+		i.lock.Unlock()
+	}
+	return newNumber, f.checkedEntry(newNumber)
+}
+
+// freeReservedObjectNumber() returns a number obtained from
+// ReserveObjectNumber() that was never written to the free list.  The
+// generation isn't incremented since no object ever used it.  The
+// caller must hold f.lock.
+func (f *file) freeReservedObjectNumber(objectNumber ObjectNumber) {
+	entry := (*f.xref.At(uint(objectNumber.number))).(*xrefEntry)
+	entry.indirect = nil
+	f.cache.invalidate(objectNumber.number)
+	freeHead := (*f.xref.At(0)).(*xrefEntry)
+	entry.clear(freeHead.byteOffset)
+	freeHead.clear(uint64(objectNumber.number))
+}
+
+// serialize() returns the serialization of object and the stream
+// bodies to be copied into it when it's written.
+func (f *file) serialize(object Object) ([]byte, []deferredBody) {
+	buffer := new(serializationBuffer)
+	object.Serialize(buffer, f)
+	return buffer.Bytes(), buffer.bodies
+}
+
+// writeObjectAt() writes object to f at objectNumber for the Indirect
+// i and returns the number written.  If f supports deduplication, the
+// object may instead be found to duplicate an existing object (when
+// canDeduplicate is true), or be written at a new number (when other
+// objects were deduplicated to objectNumber).
+func writeObjectAt(f File, i Indirect, objectNumber ObjectNumber, object Object, canDeduplicate bool) (ObjectNumber, error) {
+	if pf,ok := f.(*file); ok {
+		written := pf.writeObjectOrDuplicate(i, objectNumber, object, canDeduplicate)
+		return written, pf.Err()
+	}
+	return objectNumber, f.WriteObjectAt(objectNumber, object)
+}
+
+// SetDeduplication() enables or disables deduplication of the objects
+// written to the document.  See file.SetDeduplication().
+func (d *Document) SetDeduplication(enable bool) {
+	if f,ok := d.file.(*file); ok {
+		f.SetDeduplication(enable)
+	}
+}
+
+// DeduplicationStatistics() returns the duplicates detected in the
+// objects written to the document.
+func (d *Document) DeduplicationStatistics() DeduplicationStatistics {
+	if f,ok := d.file.(*file); ok {
+		return f.DeduplicationStatistics()
+	}
+	return DeduplicationStatistics{}
+}
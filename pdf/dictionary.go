@@ -1,5 +1,7 @@
 package pdf
 
+import "sort"
+
 // Implements the pdf.Object interface
 
 type ProtectedDictionary interface {
@@ -277,15 +279,17 @@ func (d *dictionary) Remove(key string) {
 
 func (d *dictionary) Serialize(w Writer, file ...File) {
 	w.WriteString("<<")
-	haveAny := false
-	for key, value := range d.dictionary {
-		if haveAny {
+	// Keys are written in sorted order so that equal dictionaries
+	// always have identical serializations.
+	keys := d.Keys()
+	sort.Strings(keys)
+	for i, key := range keys {
+		if i != 0 {
 			w.WriteByte(' ')
 		}
 		NewName(key).Serialize(w, file...)
 		w.WriteByte(' ')
-		value.Serialize(w, file...)
-		haveAny = true
+		d.dictionary[key].Serialize(w, file...)
 	}
 	w.WriteString(">>")
 }
@@ -355,7 +359,10 @@ func (pd protectedDictionary) Serialize(w Writer, file... File) {
 }
 
 func (pd protectedDictionary) Get(key string) Object {
-	return pd.d.Get(key).Protect()
+	if o := pd.d.Get(key); o != nil {
+		return o.Protect()
+	}
+	return nil
 }
 
 func (pd protectedDictionary) GetArray(key string) ProtectedArray {
@@ -1,8 +1,12 @@
 package pdf
 
 import ("bufio"
+	"bytes"
+	"context"
 	"fmt"
-	"os")
+	"os"
+	"sync"
+	"time")
 
 type Document struct {
 	file File
@@ -37,6 +41,15 @@ type Document struct {
 	// currentPage is nil until NextPage() is called.
 	currentPage *Page
 
+	// concurrentPages holds the pages returned by
+	// NewConcurrentPage() so that Close() can finish any that
+	// haven't been finished.
+	concurrentPages []*Page
+
+	// lock protects the page tree while pages are being created
+	// by several goroutines.
+	lock sync.Mutex
+
 	// When a pre-existing document is opened, pageTreeRoot and
 	// pageTreeRootIndirect are initialized with the pre-existing
 	// dictionary.  Both are reset to a newly generated page tree
@@ -50,10 +63,36 @@ type Document struct {
 	// pageCount is initialized with the pre-existing page count.
 	pageCount uint
 
+	// catalog is initialized with a copy of the pre-existing
+	// document catalog so that entries other than /Pages survive
+	// when the catalog is rewritten.  Otherwise it is initialized
+	// to an empty dictionary.  It is not nil.
+	catalog Dictionary
+
 	// DocumentInfo is initialized from a pre-existing documents
 	// document info dictionary.  Otherwise it is initialized to
 	// an empty dictionary.  It is not nil.
 	DocumentInfo
+
+	// metadata is the XMP metadata set by SetMetadata() or read
+	// by Metadata().  If nil, the metadata is read from the
+	// catalog when it must be updated.
+	metadata *XMPMetadata
+
+	// originalMetadata, originalCatalog, and originalPageTreeRoot
+	// are the serializations of the metadata read by Metadata(),
+	// and of the catalog and the page tree root of a pre-existing
+	// document, so that an update rewrites them only if they
+	// have changed.
+	originalMetadata, originalCatalog, originalPageTreeRoot []byte
+
+	// conformance is the PDF/A conformance level set by
+	// SetConformance().
+	conformance Conformance
+
+	// checker checks the objects of a write-only document as they
+	// are written.  Otherwise it is nil.
+	checker *conformanceChecker
 }
 
 var (
@@ -102,12 +141,31 @@ func (d *Document) makeNewPageTree() {
 
 // OpenDocument() constructs a document object from either a new or a pre-existing filename.
 func OpenDocument(filename string, mode int) *Document {
-	d := new(Document)
+	file,existing,_ := OpenFile(filename, mode)
+	return newDocument(file, existing)
+}
 
-	d.file,d.existing,_ = OpenFile(filename, mode)
+// openDocument() is OpenDocument() but returns the error of
+// OpenFile() instead of a document without a file.
+func openDocument(filename string, mode int) (*Document, error) {
+	file,existing,err := OpenFile(filename, mode)
+	if err != nil {
+		return nil, err
+	}
+	return newDocument(file, existing), nil
+}
+
+// newDocument() constructs a document object from an open File.
+// existing indicates whether the File was read from a pre-existing
+// file.
+func newDocument(file File, existing bool) *Document {
+	d := new(Document)
+	d.file = file
+	d.existing = existing
 
 	if !d.existing {
 		d.DocumentInfo = NewDocumentInfo()
+		d.catalog = NewDictionary()
 		d.makeNewPageTree()
 	} else {
 		existingInfo := d.file.Info();
@@ -119,9 +177,12 @@ func OpenDocument(filename string, mode int) *Document {
 		
 
 		existingPageTree := existingPageTree(d.file)
+		d.catalog = d.file.Catalog().Unprotect().(Dictionary)
 		d.pageTreeRoot = existingPageTree.root
 		d.pageTreeRootIndirect = existingPageTree.rootReference
 		d.pageCount = existingPageTree.pageCount
+		d.originalCatalog = serialization(d.catalog, d.file)
+		d.originalPageTreeRoot = serialization(d.pageTreeRoot, d.file)
 		out := bufio.NewWriter(os.Stdout)
 		out.WriteString("Pre-existing page tree root: ")
 		d.pageTreeRoot.Serialize(out,d.file)
@@ -142,20 +203,49 @@ func OpenDocument(filename string, mode int) *Document {
 func (d *Document) release() {
 	d.pages = nil
 	d.currentPage = nil
+	d.concurrentPages = nil
 	d.pageTreeRoot = nil
 	d.pageTreeRootIndirect = nil
 	d.procSetIndirect = nil
+	d.catalog = nil
 }
 
 func (d *Document) finishCatalog() {
 	if d.pageTreeRootIndirect != nil {
-		catalog := NewDictionary()
-		catalog.Add("Type", NewName("Catalog"))
-		catalog.Add("Pages", d.pageTreeRootIndirect)
-		d.file.SetCatalog(catalog)
+		d.catalog.Add("Type", NewName("Catalog"))
+		d.catalog.Add("Pages", d.pageTreeRootIndirect)
+		if !d.unchanged(d.catalog, d.originalCatalog) {
+			d.file.SetCatalog(d.catalog)
+		}
 	}
 }
 
+// unchanged() returns true if the document is pre-existing and the
+// serialization of o is original.
+func (d *Document) unchanged(o Object, original []byte) bool {
+	return d.existing && original != nil && bytes.Equal(serialization(o, d.file), original)
+}
+
+// serialization() returns the serialization of o as it would be
+// written to f.
+func serialization(o Object, f File) []byte {
+	buffer := new(serializationBuffer)
+	o.Serialize(buffer, f)
+	return buffer.Bytes()
+}
+
+// changed() returns true if closing the document updates its contents:
+// objects have been written, or the document information dictionary,
+// the metadata, or the catalog has changed.  The page tree is written
+// before changed() is called.
+func (d *Document) changed() bool {
+	if f,ok := d.file.(*file); ok && !f.hasWrittenObjects() {
+		return d.DocumentInfo.IsDirty() || d.metadataChanged() ||
+			(d.pageTreeRootIndirect != nil && !d.unchanged(d.catalog, d.originalCatalog))
+	}
+	return true
+}
+
 func (d *Document) finishCurrentPage() {
 	if d.currentPage != nil {
 		d.pages.Add(d.currentPage.Finish())
@@ -164,14 +254,22 @@ func (d *Document) finishCurrentPage() {
 	}
 }
 
+// finishDocumentInfo() writes the document information dictionary and
+// the XMP metadata (see finishMetadata()) if they have changed.  An
+// incremental update of an existing document sets /ModDate if it
+// changes the document (see changed()).
 func (d *Document) finishDocumentInfo() {
+	if d.existing && d.changed() {
+		d.SetModDate(time.Now())
+	}
+	d.finishMetadata()
 	if d.DocumentInfo.IsDirty() {
 		d.file.SetInfo (d.DocumentInfo)
 	}
 }
 
 func (d *Document) finishPageTree() {
-	if d.pageTreeRoot != nil {
+	if d.pageTreeRoot != nil && !d.unchanged(d.pageTreeRoot, d.originalPageTreeRoot) {
 		d.pageTreeRootIndirect.Write(d.pageTreeRoot)
 	}
 }
@@ -196,28 +294,96 @@ func (d *Document) finishProcSet() {
 // Document.NewPage() are closed by the next call to
 // Document.NewPage() or the call to Document.Close().
 func (d *Document) NewPage() *Page {
+	d.lock.Lock()
+	defer d.lock.Unlock()
 	d.finishCurrentPage()
-	d.currentPage = d.pageFactory.New(d.file)
+	d.currentPage = d.newPage()
+	return d.currentPage
+}
+
+// NewConcurrentPage() returns a new Page whose position in the
+// document is fixed when it is created, immediately after any pages
+// created earlier with NewPage() or NewConcurrentPage().  Unlike a
+// page obtained from NewPage(), it isn't finished by the next call to
+// NewPage().  Instead, its contents may be written by another
+// goroutine, which calls Page.Finish() when the page is complete, so
+// that several pages can be built in parallel.  The order in which
+// the pages are finished doesn't affect their order in the document.
+// Pages that haven't been finished are finished by Close(), which
+// must not be called until no goroutine is writing to a page.
+func (d *Document) NewConcurrentPage() *Page {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.finishCurrentPage()
+	d.currentPage = nil
+
+	page := d.newPage()
+	page.reference = NewIndirect(d.file)
+	d.pages.Add(page.reference)
+	d.pageCount += 1
+	d.pageTreeRoot.Add("Count", NewIntNumeric(int(d.pageCount)))
+	d.concurrentPages = append(d.concurrentPages, page)
+	return page
+}
+
+func (d *Document) newPage() *Page {
+	page := d.pageFactory.New(d.file)
 
 	if !d.readyForNewPages {
 		d.makeNewPageTree()
 	}
-	d.currentPage.SetParent(d.pageTreeRootIndirect)
-	d.currentPage.setProcSet(d.procSetIndirect)
-
-	return d.currentPage
+	page.SetParent(d.pageTreeRootIndirect)
+	page.setProcSet(d.procSetIndirect)
+	return page
 }
 
-func (d *Document) Close() {
+func (d *Document) Close() error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if f,ok := d.file.(*file); ok && f.readOnly {
+		err := d.file.Close()
+		d.release()
+		return err
+	}
 	d.finishCurrentPage()
+	for _,page := range d.concurrentPages {
+		page.Finish()
+	}
 	d.finishProcSet()
 	d.finishPageTree()
-	d.finishCatalog()
+	if d.conformance != NoConformance {
+		d.finishOutputIntents()
+	}
+	// The metadata must be written before the catalog that
+	// refers to it.
 	d.finishDocumentInfo()
+	d.finishCatalog()
+	if d.conformance != NoConformance {
+		d.finishID()
+		d.checkConformance()
+	}
 
-	d.file.Close()
+	err := d.file.Close()
 
 	d.release()
+	return err
+}
+
+// Err() returns the first error that occurred while writing the
+// document's objects.  See file.Err().
+func (d *Document) Err() error {
+	if f,ok := d.file.(*file); ok {
+		return f.Err()
+	}
+	return nil
+}
+
+// SetContext() associates ctx with the document's file.  See
+// file.SetContext().
+func (d *Document) SetContext(ctx context.Context) {
+	if f,ok := d.file.(*file); ok {
+		f.SetContext(ctx)
+	}
 }
 
 // Page(n) returns the ExistingPage (which contains a PageDictionary
@@ -280,6 +446,8 @@ func (d *Document) SetArtBox(llx, lly, urx, ury float64) {
 	d.pageTreeRoot.Add("ArtBox", NewRectangle(llx, lly, urx, ury))
 }
 
-func (d *Document) WriteObject(object Object) Indirect {
+// WriteObject() writes object to the document's file.  See
+// File.WriteObject().
+func (d *Document) WriteObject(object Object) (Indirect, error) {
 	return NewIndirect(d.file).Write(object)
 }
@@ -1,10 +1,34 @@
 package pdf
 
+import (
+	"bytes"
+	"sort"
+	"time")
+
 type DocumentInfo struct {
 	Dictionary
 	dirty bool
 }
 
+// Values of the /Trapped entry.
+const (
+	TrappedTrue = "True"
+	TrappedFalse = "False"
+	TrappedUnknown = "Unknown" )
+
+// standardInfoKeys are the keys of the document information
+// dictionary defined by the PDF spec.  Others are custom keys.
+var standardInfoKeys = map[string]bool{
+	"Title": true,
+	"Author": true,
+	"Subject": true,
+	"Keywords": true,
+	"Creator": true,
+	"Producer": true,
+	"CreationDate": true,
+	"ModDate": true,
+	"Trapped": true}
+
 func NewDocumentInfo() DocumentInfo {
 	return DocumentInfo{NewDictionary(), false}
 }
@@ -13,32 +37,143 @@ func (d DocumentInfo) IsDirty() bool {
 	return d.dirty
 }
 
-func (d DocumentInfo) SetTitle(s string) {
-	d.dirty = true
-	d.Add("Title", NewTextString(s))
+func (d *DocumentInfo) SetTitle(s string) {
+	d.setText("Title", s)
 }
 
-func (d DocumentInfo) SetAuthor(s string) {
-	d.dirty = true
-	d.Add("Author", NewTextString(s))
+func (d *DocumentInfo) SetAuthor(s string) {
+	d.setText("Author", s)
 }
 
-func (d DocumentInfo) SetSubject(s string) {
-	d.dirty = true
-	d.Add("Subject", NewTextString(s))
+func (d *DocumentInfo) SetSubject(s string) {
+	d.setText("Subject", s)
 }
 
-func (d DocumentInfo) SetKeywords(s string) {
-	d.dirty = true
-	d.Add("Keywords", NewTextString(s))
+func (d *DocumentInfo) SetKeywords(s string) {
+	d.setText("Keywords", s)
+}
+
+func (d *DocumentInfo) SetCreator(s string) {
+	d.setText("Creator", s)
+}
+
+func (d *DocumentInfo) SetProducer(s string) {
+	d.setText("Producer", s)
 }
 
-func (d DocumentInfo) SetCreator(s string) {
+func (d *DocumentInfo) SetCreationDate(t time.Time) {
+	d.setText("CreationDate", formatDate(t))
+}
+
+func (d *DocumentInfo) SetModDate(t time.Time) {
+	d.setText("ModDate", formatDate(t))
+}
+
+// SetTrapped() sets the /Trapped entry to TrappedTrue, TrappedFalse,
+// or TrappedUnknown.
+func (d *DocumentInfo) SetTrapped(value string) {
 	d.dirty = true
-	d.Add("Creator", NewTextString(s))
+	d.Add("Trapped", NewName(value))
+}
+
+// SetCustom() sets an entry that isn't defined by the PDF spec to a
+// text string.
+func (d *DocumentInfo) SetCustom(key, value string) {
+	d.setText(key, value)
 }
 
-func (d DocumentInfo) SetProducer(s string) {
+// setText() sets an entry to a text string.  The dictionary is marked
+// dirty only if the entry changes.
+func (d *DocumentInfo) setText(key, value string) {
+	s := NewTextString(value)
+	if b,ok := d.GetString(key); ok && bytes.Equal(b, s.Bytes()) {
+		return
+	}
 	d.dirty = true
-	d.Add("Producer", NewTextString(s))
+	d.Add(key, s)
+}
+
+func (d DocumentInfo) Title() (string,bool) {
+	return d.text("Title")
+}
+
+func (d DocumentInfo) Author() (string,bool) {
+	return d.text("Author")
+}
+
+func (d DocumentInfo) Subject() (string,bool) {
+	return d.text("Subject")
+}
+
+func (d DocumentInfo) Keywords() (string,bool) {
+	return d.text("Keywords")
+}
+
+func (d DocumentInfo) Creator() (string,bool) {
+	return d.text("Creator")
+}
+
+func (d DocumentInfo) Producer() (string,bool) {
+	return d.text("Producer")
+}
+
+// CreationDate() returns the parsed /CreationDate entry.  The boolean
+// return value is false if the entry is missing or isn't a valid date.
+func (d DocumentInfo) CreationDate() (time.Time,bool) {
+	return d.date("CreationDate")
+}
+
+// ModDate() returns the parsed /ModDate entry.  See CreationDate().
+func (d DocumentInfo) ModDate() (time.Time,bool) {
+	return d.date("ModDate")
+}
+
+// Trapped() returns the /Trapped entry.  Old documents may use a
+// boolean, which is converted to TrappedTrue or TrappedFalse.
+func (d DocumentInfo) Trapped() (string,bool) {
+	if name,ok := d.GetName("Trapped"); ok {
+		return name, true
+	}
+	if b,ok := d.GetBoolean("Trapped"); ok {
+		if b {
+			return TrappedTrue, true
+		}
+		return TrappedFalse, true
+	}
+	return "", false
+}
+
+// Custom() returns an entry that isn't defined by the PDF spec.
+func (d DocumentInfo) Custom(key string) (string,bool) {
+	return d.text(key)
+}
+
+// CustomKeys() returns the sorted keys of the entries that aren't
+// defined by the PDF spec.
+func (d DocumentInfo) CustomKeys() []string {
+	var keys []string
+	for _,key := range d.Keys() {
+		if !standardInfoKeys[key] {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// text() returns a decoded text string entry.
+func (d DocumentInfo) text(key string) (string,bool) {
+	if b,ok := d.GetString(key); ok {
+		return TextStringValue(b), true
+	}
+	return "", false
+}
+
+func (d DocumentInfo) date(key string) (time.Time,bool) {
+	if s,ok := d.text(key); ok {
+		if t,err := parseDate(s); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
 }
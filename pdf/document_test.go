@@ -1,8 +1,14 @@
 package pdf_test
 
 import (
+	"bytes"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
 	"github.com/mawicks/PDFiG/pdf" )
 
 func ExampleDocument() {
@@ -28,3 +34,485 @@ func ExampleDocument() {
 
 	doc.Close()
 }
+
+// makeFormFile() writes a one-page document containing a single text
+// field widget (with an appearance stream) and a link annotation.
+func makeFormFile(filename string) {
+	writeFormFile(filename, false)
+}
+
+// writeFormFile() is makeFormFile() with the widget's appearance
+// stream optionally stored as a direct object.
+func writeFormFile(filename string, directAppearance bool) {
+	os.Remove(filename)
+	f,_,_ := pdf.OpenFile(filename, os.O_RDWR|os.O_CREATE)
+
+	appearance := pdf.NewStream()
+	appearance.Add("Type", pdf.NewName("XObject"))
+	appearance.Add("Subtype", pdf.NewName("Form"))
+	appearance.Add("BBox", pdf.NewRectangle(0, 0, 200, 20))
+	appearance.Write([]byte("0 0 1 rg 0 0 200 20 re f"))
+
+	ap := pdf.NewDictionary()
+	if directAppearance {
+		ap.Add("N", appearance)
+	} else {
+		appearanceReference,_ := f.WriteObject(appearance)
+		ap.Add("N", appearanceReference)
+	}
+
+	widget := pdf.NewDictionary()
+	widget.Add("Type", pdf.NewName("Annot"))
+	widget.Add("Subtype", pdf.NewName("Widget"))
+	widget.Add("FT", pdf.NewName("Tx"))
+	widget.Add("T", pdf.NewTextString("name"))
+	widget.Add("Rect", pdf.NewRectangle(100, 700, 300, 720))
+	widget.Add("AP", ap)
+	widgetReference,_ := f.WriteObject(widget)
+
+	link := pdf.NewDictionary()
+	link.Add("Type", pdf.NewName("Annot"))
+	link.Add("Subtype", pdf.NewName("Link"))
+	link.Add("Rect", pdf.NewRectangle(0, 0, 10, 10))
+
+	annots := pdf.NewArray()
+	annots.Add(widgetReference)
+	linkReference,_ := f.WriteObject(link)
+	annots.Add(linkReference)
+
+	contents := pdf.NewStream()
+	contents.Write([]byte("0 0 m 612 792 l s"))
+
+	pagesReference := pdf.NewIndirect(f)
+	page := pdf.NewDictionary()
+	page.Add("Type", pdf.NewName("Page"))
+	page.Add("Parent", pagesReference)
+	page.Add("MediaBox", pdf.NewRectangle(0, 0, 612, 792))
+	contentsReference,_ := f.WriteObject(contents)
+	page.Add("Contents", contentsReference)
+	page.Add("Annots", annots)
+
+	kids := pdf.NewArray()
+	pageReference,_ := f.WriteObject(page)
+	kids.Add(pageReference)
+	pages := pdf.NewDictionary()
+	pages.Add("Type", pdf.NewName("Pages"))
+	pages.Add("Count", pdf.NewIntNumeric(1))
+	pages.Add("Kids", kids)
+	pagesReference.Write(pages)
+
+	fields := pdf.NewArray()
+	fields.Add(widgetReference)
+	acroForm := pdf.NewDictionary()
+	acroForm.Add("Fields", fields)
+
+	catalog := pdf.NewDictionary()
+	catalog.Add("Type", pdf.NewName("Catalog"))
+	catalog.Add("Pages", pagesReference)
+	catalog.Add("AcroForm", acroForm)
+	f.SetCatalog(catalog)
+	f.Close()
+}
+
+func TestFlatten(t *testing.T) {
+	for _,direct := range []bool{false, true} {
+		testFlatten(t, direct)
+	}
+
+	// A file that can't be opened is an error.
+	if err := pdf.FlattenFile(os.TempDir(), ""); err == nil {
+		t.Errorf("FlattenFile() of a directory didn't fail")
+	}
+}
+
+func testFlatten(t *testing.T, directAppearance bool) {
+	source := "/tmp/test-form.pdf"
+	destination := "/tmp/test-form-flattened.pdf"
+	writeFormFile(source, directAppearance)
+
+	if err := pdf.FlattenFile(source, destination); err != nil {
+		t.Fatalf("FlattenFile() returned error: %v", err)
+	}
+
+	f,_,_ := pdf.OpenFile(destination, os.O_RDONLY)
+	defer f.Close()
+
+	catalog := f.Catalog()
+	if catalog.Get("AcroForm") != nil {
+		t.Errorf("Flattened catalog still has /AcroForm")
+	}
+
+	page := catalog.GetDictionary("Pages").GetArray("Kids").At(0).Dereference().(pdf.ProtectedDictionary)
+	if annots := page.GetArray("Annots"); annots == nil || annots.Size() != 1 {
+		t.Errorf("Flattened page should retain only the link annotation")
+	}
+	if xobject := page.GetDictionary("Resources").GetDictionary("XObject"); xobject == nil || xobject.GetStream("Flat1") == nil {
+		t.Errorf("Flattened page has no /Flat1 Form XObject")
+	}
+	if contents := page.GetArray("Contents"); contents == nil || contents.Size() != 3 {
+		t.Errorf("Flattened page contents should be an array of three streams")
+	} else {
+		content,_ := ioutil.ReadAll(contents.At(2).Dereference().(pdf.ProtectedStream).Reader())
+		if expected := "Q\nq 1 0 0 1 100 700 cm /Flat1 Do Q\n"; string(content) != expected {
+			t.Errorf(`Flattened content is "%s"; expected "%s"`, content, expected)
+		}
+	}
+
+	// The source must not have been modified.
+	f,_,_ = pdf.OpenFile(source, os.O_RDONLY)
+	if f.Catalog().Get("AcroForm") == nil {
+		t.Errorf("FlattenFile() modified its source")
+	}
+	f.Close()
+}
+
+func TestConcurrentPages(t *testing.T) {
+	filename := "/tmp/test-concurrent.pdf"
+	os.Remove(filename)
+	defer os.Remove(filename)
+
+	d := pdf.OpenDocument(filename, os.O_RDWR|os.O_CREATE)
+	font := pdf.NewStandardFont(pdf.Helvetica)
+	const pageCount = 16
+	pages := make([]*pdf.Page, pageCount)
+	for i := range pages {
+		pages[i] = d.NewConcurrentPage()
+	}
+
+	// Build the pages in parallel, finishing them in reverse order.
+	var wg sync.WaitGroup
+	finished := make([]chan bool, pageCount+1)
+	for i := range finished {
+		finished[i] = make(chan bool)
+	}
+	for i,page := range pages {
+		wg.Add(1)
+		go func(i int, page *pdf.Page) {
+			defer wg.Done()
+			fmt.Fprintf(page, "BT /%s 24 Tf 250 528 Td (Page %d) Tj ET", page.AddFont(font), i+1)
+			reference,_ := d.WriteObject(pdf.NewIntNumeric(i))
+			if n,ok := reference.Dereference().(*pdf.IntNumeric); !ok || n.Value() != i {
+				t.Errorf("Object written by goroutine %d read back as %v", i, n)
+			}
+			<-finished[i+1]
+			page.Finish()
+			close(finished[i])
+		}(i, page)
+	}
+	close(finished[pageCount])
+	wg.Wait()
+	if err := d.Close(); err != nil {
+		t.Fatalf("Close() returned %v", err)
+	}
+
+	d = pdf.OpenDocument(filename, os.O_RDONLY)
+	defer d.Close()
+	for i:=0; i<pageCount; i++ {
+		contents,_ := ioutil.ReadAll(d.Page(uint(i)).Reader())
+		if expected := fmt.Sprintf("(Page %d)", i+1); !strings.Contains(string(contents), expected) {
+			t.Errorf("Page %d contents are %q; expected %s", i, contents, expected)
+		}
+	}
+}
+
+func TestDocumentInfo(t *testing.T) {
+	filename := "/tmp/test-document-info.pdf"
+	os.Remove(filename)
+	created := time.Date(2014, 3, 25, 16, 17, 3, 0, time.FixedZone("", -5*3600))
+
+	doc := pdf.OpenDocument(filename, os.O_RDWR|os.O_CREATE)
+	doc.SetTitle("Résumé — 日本")
+	doc.SetCreationDate(created)
+	doc.SetTrapped(pdf.TrappedFalse)
+	doc.SetCustom("Department", "Records")
+	doc.NewPage()
+	doc.Close()
+
+	before := time.Now().Add(-time.Second)
+	doc = pdf.OpenDocument(filename, os.O_RDWR)
+	if title,_ := doc.Title(); title != "Résumé — 日本" {
+		t.Errorf("Title() returned %q", title)
+	}
+	if producer,_ := doc.Producer(); producer != "PDFiG" {
+		t.Errorf("Producer() returned %q", producer)
+	}
+	if date,ok := doc.CreationDate(); !ok || !date.Equal(created) {
+		t.Errorf("CreationDate() returned %v", date)
+	}
+	if trapped,_ := doc.Trapped(); trapped != pdf.TrappedFalse {
+		t.Errorf("Trapped() returned %q", trapped)
+	}
+	if keys := doc.CustomKeys(); len(keys) != 1 || keys[0] != "Department" {
+		t.Errorf("CustomKeys() returned %v", keys)
+	}
+	if _,ok := doc.ModDate(); ok {
+		t.Errorf("New document has a /ModDate")
+	}
+	original,_ := os.Stat(filename)
+	doc.Close()
+
+	// An update that changes nothing isn't written.
+	if updated,_ := os.Stat(filename); updated.Size() != original.Size() {
+		t.Errorf("Update without changes grew the file from %d to %d bytes", original.Size(), updated.Size())
+	}
+
+	// An update that changes the document sets /ModDate.
+	doc = pdf.OpenDocument(filename, os.O_RDWR)
+	doc.SetSubject("Records")
+	doc.Close()
+	doc = pdf.OpenDocument(filename, os.O_RDONLY)
+	defer doc.Close()
+	if date,ok := doc.ModDate(); !ok || date.Before(before) {
+		t.Errorf("ModDate() after update returned %v", date)
+	}
+
+	for _,test := range []struct{ s string; expected time.Time }{
+		{"D:2014", time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"D:201403251617Z", time.Date(2014, 3, 25, 16, 17, 0, 0, time.UTC)},
+		{"D:20140325161703+05'30'", time.Date(2014, 3, 25, 10, 47, 3, 0, time.UTC)},
+		{"20140325161703-05", created}} {
+		doc.Add("CreationDate", pdf.NewTextString(test.s))
+		if date,ok := doc.CreationDate(); !ok || !date.Equal(test.expected) {
+			t.Errorf("CreationDate() of %q returned %v; expected %v", test.s, date, test.expected)
+		}
+	}
+	doc.Add("CreationDate", pdf.NewTextString("yesterday"))
+	if _,ok := doc.CreationDate(); ok {
+		t.Errorf("CreationDate() accepted an invalid date")
+	}
+}
+
+func TestXMPMetadata(t *testing.T) {
+	filename := "/tmp/test-xmp.pdf"
+	os.Remove(filename)
+	created := time.Date(2014, 3, 25, 16, 17, 3, 0, time.UTC)
+
+	doc := pdf.OpenDocument(filename, os.O_RDWR|os.O_CREATE)
+	doc.SetTitle("Fish & Chips <menu>")
+	doc.SetAuthor("Mark Wicks")
+	doc.SetKeywords("food")
+	doc.SetCreationDate(created)
+	doc.SetCustom("Department", "Records")
+	metadata := new(pdf.XMPMetadata)
+	metadata.Description = "Only in XMP"
+	metadata.SetProperty("http://example.com/ns/records/", "rec", "Retention", "7 years")
+	doc.SetMetadata(metadata)
+	doc.NewPage()
+	doc.Close()
+
+	doc = pdf.OpenDocument(filename, os.O_RDONLY)
+	m,err := doc.Metadata()
+	if err != nil || m == nil {
+		t.Fatalf("Metadata() returned %v, %v", m, err)
+	}
+	if m.Title != "Fish & Chips <menu>" || len(m.Creators) != 1 || m.Creators[0] != "Mark Wicks" ||
+		m.Keywords != "food" || m.Producer != "PDFiG" || !m.CreateDate.Equal(created) {
+		t.Errorf("Metadata() returned %+v", m)
+	}
+	if v,_ := m.Property("http://example.com/ns/records/", "Retention"); v != "7 years" {
+		t.Errorf("Custom namespace property is %q", v)
+	}
+	if v,_ := m.Property(pdf.PDFExtensionNamespace, "Department"); v != "Records" {
+		t.Errorf("Custom Info entry in XMP is %q", v)
+	}
+	// XMP properties missing from Info are copied to Info.
+	if subject,_ := doc.Subject(); subject != "Only in XMP" {
+		t.Errorf("Subject() returned %q", subject)
+	}
+	doc.Close()
+
+	// An update rewrites the existing /Metadata object.
+	metadataNumber := func() pdf.ObjectNumber {
+		f,_,_ := pdf.OpenFile(filename, os.O_RDONLY)
+		defer f.Close()
+		return f.Catalog().Get("Metadata").(pdf.ProtectedIndirect).ObjectNumber(f)
+	}
+	original := metadataNumber()
+	doc = pdf.OpenDocument(filename, os.O_RDWR)
+	doc.SetTitle("Fish & Chips")
+	doc.Close()
+	if updated := metadataNumber(); updated != original {
+		t.Errorf("Update wrote /Metadata as object %v; expected %v", updated, original)
+	}
+	doc = pdf.OpenDocument(filename, os.O_RDONLY)
+	if m,_ = doc.Metadata(); m == nil || m.Title != "Fish & Chips" {
+		t.Errorf("Metadata() after update returned %+v", m)
+	}
+	doc.Close()
+
+	parsed,err := pdf.ParseXMP([]byte(`<x:xmpmeta xmlns:x="adobe:ns:meta/">
+		<rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+		<rdf:Description rdf:about="" xmlns:pdf="http://ns.adobe.com/pdf/1.3/" pdf:Producer="Other"
+			xmlns:dc="http://purl.org/dc/elements/1.1/" xmlns:xmp="http://ns.adobe.com/xap/1.0/">
+		<dc:creator><rdf:Seq><rdf:li>A</rdf:li><rdf:li>B</rdf:li></rdf:Seq></dc:creator>
+		<xmp:ModifyDate>2014-03-25</xmp:ModifyDate>
+		</rdf:Description></rdf:RDF></x:xmpmeta>`))
+	if err != nil || parsed.Producer != "Other" || len(parsed.Creators) != 2 || parsed.ModifyDate.Year() != 2014 {
+		t.Errorf("ParseXMP() returned %+v, %v", parsed, err)
+	}
+}
+
+func TestConformance(t *testing.T) {
+	filename := "/tmp/test-pdfa.pdf"
+	os.Remove(filename)
+	defer os.Remove(filename)
+
+	doc := pdf.OpenDocument(filename, os.O_RDWR|os.O_CREATE)
+	doc.SetConformance(pdf.PDFA2B)
+	doc.SetTitle("Retained")
+	doc.SetCustom("Department", "Records")
+	page := doc.NewPage()
+	page.Write([]byte("0 0 1 rg 10 10 100 100 re f"))
+	if err := doc.Close(); err != nil {
+		t.Fatalf("Close() returned %v", err)
+	}
+
+	contents,_ := ioutil.ReadFile(filename)
+	for _,s := range []string{"%PDF-1.4\n%\xe2\xe3\xcf\xd3\n", "/OutputIntents", "/GTS_PDFA1", "/DestOutputProfile", "/ID [<"} {
+		if !strings.Contains(string(contents), s) {
+			t.Errorf("Output doesn't contain %q", s)
+		}
+	}
+
+	doc = pdf.OpenDocument(filename, os.O_RDONLY)
+	m,err := doc.Metadata()
+	if err != nil || m == nil {
+		t.Fatalf("Metadata() returned %v, %v", m, err)
+	}
+	if part,_ := m.Property(pdf.PDFAIdentificationNamespace, "part"); part != "2" {
+		t.Errorf("pdfaid:part is %q", part)
+	}
+	if conformance,_ := m.Property(pdf.PDFAIdentificationNamespace, "conformance"); conformance != "B" {
+		t.Errorf("pdfaid:conformance is %q", conformance)
+	}
+	// Custom entries need an extension schema, so they aren't
+	// copied to the XMP.
+	if _,ok := m.Property(pdf.PDFExtensionNamespace, "Department"); ok {
+		t.Errorf("Custom Info entry was copied to the XMP")
+	}
+	doc.Close()
+
+	// The standard fonts aren't embedded.
+	os.Remove(filename)
+	doc = pdf.OpenDocument(filename, os.O_RDWR|os.O_CREATE)
+	doc.SetConformance(pdf.PDFA3B)
+	page = doc.NewPage()
+	page.AddFont(pdf.NewStandardFont(pdf.Helvetica))
+	err = doc.Close()
+	conformanceError,ok := err.(*pdf.ConformanceError)
+	if !ok || conformanceError.Conformance != pdf.PDFA3B {
+		t.Fatalf("Close() returned %v", err)
+	}
+	if len(conformanceError.Violations) != 1 || !strings.Contains(conformanceError.Violations[0], "font Helvetica isn't embedded") {
+		t.Errorf("Violations are %q", conformanceError.Violations)
+	}
+	if _,err := os.Stat(filename); err == nil {
+		t.Errorf("Nonconforming output wasn't removed")
+	}
+}
+
+// embeddedFont is a Font whose descriptor, which claims an embedded
+// font file, is written after the font.
+type embeddedFont struct {}
+
+func (embeddedFont) Indirect(f pdf.File) pdf.Indirect {
+	descriptor := pdf.NewIndirect(f)
+	font := pdf.NewDictionary()
+	font.Add("Type", pdf.NewName("Font"))
+	font.Add("Subtype", pdf.NewName("TrueType"))
+	font.Add("BaseFont", pdf.NewName("Embedded"))
+	font.Add("FontDescriptor", descriptor)
+	result,_ := f.WriteObject(font)
+
+	d := pdf.NewDictionary()
+	d.Add("Type", pdf.NewName("FontDescriptor"))
+	fontFile,_ := f.WriteObject(pdf.NewStream())
+	d.Add("FontFile2", fontFile)
+	descriptor.Write(d)
+	return result
+}
+
+func TestConformanceWriter(t *testing.T) {
+	var buffer bytes.Buffer
+	doc := pdf.NewDocumentWriter(&buffer)
+	doc.SetConformance(pdf.PDFA2B)
+	page := doc.NewPage()
+	page.AddFont(embeddedFont{})
+	page.Write([]byte("0 0 1 rg 10 10 100 100 re f"))
+	if err := doc.Close(); err != nil {
+		t.Fatalf("Close() returned %v", err)
+	}
+	if !bytes.Contains(buffer.Bytes(), []byte("/OutputIntents")) {
+		t.Errorf("Output doesn't contain an output intent")
+	}
+
+	buffer.Reset()
+	doc = pdf.NewDocumentWriter(&buffer)
+	doc.SetConformance(pdf.PDFA2B)
+	page = doc.NewPage()
+	page.AddFont(pdf.NewStandardFont(pdf.Courier))
+	err := doc.Close()
+	conformanceError,ok := err.(*pdf.ConformanceError)
+	if !ok || len(conformanceError.Violations) != 1 || !strings.Contains(conformanceError.Violations[0], "font Courier isn't embedded") {
+		t.Errorf("Close() returned %v", err)
+	}
+
+	buffer.Reset()
+	doc = pdf.NewDocumentWriter(&buffer)
+	doc.WriteObject(pdf.NewDictionary())
+	doc.SetConformance(pdf.PDFA2B)
+	if _,ok := doc.Close().(*pdf.ConformanceError); !ok {
+		t.Errorf("Close() didn't fail when SetConformance() was called late")
+	}
+}
+
+func TestConformanceMetadata(t *testing.T) {
+	const records = "http://example.com/ns/records/"
+	filename := "/tmp/test-pdfa-xmp.pdf"
+	os.Remove(filename)
+	defer os.Remove(filename)
+
+	metadata := new(pdf.XMPMetadata)
+	metadata.SetProperty("http://ns.adobe.com/xap/1.0/mm/", "xmpMM", "DocumentID", "uuid:1234")
+	metadata.SetProperty(records, "rec", "Retention", "7 years")
+	metadata.ExtensionSchemas = []pdf.XMPExtensionSchema{{
+		Schema: "Records retention",
+		NamespaceURI: records,
+		Prefix: "rec",
+		Properties: []pdf.XMPExtensionProperty{{
+			Name: "Retention", ValueType: "Text", Category: "external", Description: "Retention period"}}}}
+
+	doc := pdf.OpenDocument(filename, os.O_RDWR|os.O_CREATE)
+	doc.SetConformance(pdf.PDFA3B)
+	doc.SetMetadata(metadata)
+	doc.NewPage()
+	if err := doc.Close(); err != nil {
+		t.Fatalf("Close() returned %v", err)
+	}
+
+	doc = pdf.OpenDocument(filename, os.O_RDONLY)
+	m,err := doc.Metadata()
+	if err != nil || m == nil {
+		t.Fatalf("Metadata() returned %v, %v", m, err)
+	}
+	if len(m.ExtensionSchemas) != 1 || m.ExtensionSchemas[0].Prefix != "rec" || !m.Declares(records, "Retention") {
+		t.Errorf("Extension schemas are %+v", m.ExtensionSchemas)
+	}
+	if _,ok := m.Property("http://www.aiim.org/pdfa/ns/extension/", "schemas"); ok {
+		t.Errorf("Extension schemas were parsed as a simple property")
+	}
+	doc.Close()
+
+	// pdfx properties need an extension schema too.
+	os.Remove(filename)
+	metadata = new(pdf.XMPMetadata)
+	metadata.SetProperty(pdf.PDFExtensionNamespace, "", "Department", "Records")
+	doc = pdf.OpenDocument(filename, os.O_RDWR|os.O_CREATE)
+	doc.SetConformance(pdf.PDFA2B)
+	doc.SetMetadata(metadata)
+	doc.NewPage()
+	err = doc.Close()
+	if e,ok := err.(*pdf.ConformanceError); !ok || len(e.Violations) != 1 || !strings.Contains(e.Violations[0], "Department") {
+		t.Errorf("Close() returned %v", err)
+	}
+}
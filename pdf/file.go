@@ -3,12 +3,14 @@ package pdf
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"os"
 	"regexp"
 	"strconv"
+	"sync"
 	"github.com/mawicks/PDFiG/containers"
 	"github.com/mawicks/PDFiG/readers" )
 
@@ -28,6 +30,13 @@ type xrefEntry struct {
 	// number that has not yet been written to disk.
 	serialization []byte
 
+	// written, if not nil, is closed after the queued
+	// serialization has been written.  It is set only when the
+	// serialization has deferred stream bodies (see
+	// deferringWriter), which can't be read back until they're
+	// in the file.  It is nulled when the write succeeds.
+	written chan struct{}
+
 	// indirect is nil unless an Indirect has been created for
 	// this object, either via NewIndirect() or by
 	// newIndirectFromParse().  The reason for having this entry
@@ -41,7 +50,11 @@ type xrefEntry struct {
 
 type writeQueueEntry struct {
 	index uint32
+	generation uint16
 	xrefEntry *xrefEntry
+	serialization []byte
+	bodies []deferredBody
+	written chan struct{}
 }
 
 // Write xrefEntry to output stream using Writer.
@@ -77,13 +90,19 @@ func (entry *xrefEntry) setInUse (location uint64) {
 
 type file struct {
 	pdfVersion uint
-	file *os.File
+	file storage
 	mode int
+	// filename is empty unless the file was opened by name.
+	filename string
 	originalSize int64
 	// Location of xref for pre-existing files.
 	xrefLocation int64
 	xref containers.ArrayStack
 
+	// revisions describes the xref sections of a pre-existing
+	// file, oldest first.  It is empty for new files.
+	revisions []revision
+
 	// trailerDictionary is never nil
 	// It is initialized from a pre-existing trailer
 	// or is initialized to an empty dictionary
@@ -101,27 +120,101 @@ type file struct {
 
 	writeQueue chan writeQueueEntry
 	writingFinished chan bool
-	readNesting int
-
-	// semaphore protects access to "file" so that reads and
-	// writes are properly interleaved.
-	semaphore chan bool
 	closed bool
+
+	// lock protects xref and its entries, the trailer dictionary,
+	// the deduplicator, and "dirty" so that objects may be read,
+	// written, reserved and deleted by several goroutines at once.
+	// gowriter() acquires it only to update the entries of objects
+	// it has written.  Objects are read from "file" with ReadAt(),
+	// which doesn't disturb the position used by the writer, so
+	// reads and writes needn't exclude each other.
+	lock sync.Mutex
+
+	// pendingLock serializes the reading of deferred xref sections
+	// (see pendingXref) and protects pendingXref and revisions.
+	pendingLock sync.Mutex
+
+	// readOnly is true for views of earlier revisions opened with
+	// OpenRevision() and for files opened with OpenReaderAt().
+	// Such files cannot be modified.
+	readOnly bool
+
+	// err is the first error encountered while writing.  Once it
+	// is set, nothing more is written.  ctx, if not nil, stops the
+	// writer when it is cancelled.  Both are shared with
+	// gowriter() and protected by errLock.
+	err error
+	ctx context.Context
+	errLock sync.Mutex
+
+	// writeOnly is true for files constructed with
+	// NewFileWriter().  Objects written to such files can't be
+	// read back.
+	writeOnly bool
+
+	// inspector, if not nil, is called with each object before it
+	// is written.  A Document in a PDF/A conformance mode uses it
+	// to check the objects of a write-only file, which can't be
+	// read back when the document is closed.  objectsWritten is
+	// true once any object has been passed to the writer.  Both
+	// are protected by lock.
+	inspector func(ObjectNumber, Object)
+	objectsWritten bool
+
+	// linearization is the linearization parameter dictionary of a
+	// linearized file opened with OpenReaderAt().  Otherwise it is
+	// nil.
+	linearization Dictionary
+
+	// pendingXref is the location of the newest xref section that
+	// has not been read yet.  Only the most recent xref section
+	// (the first-page section of a linearized file) is read when
+	// a file is opened with OpenReaderAt().  Earlier sections are
+	// read one at a time when an object that isn't in the
+	// sections read so far is requested.
+	pendingXref int64
+
+	// deduplicator is nil unless deduplication has been enabled
+	// with SetDeduplication().
+	deduplicator *deduplicator
+
+	// cache holds recently parsed objects.  It is protected by
+	// lock.
+	cache *objectCache
 }
 
 // OpenFile() construct a File object from either a new or a pre-existing filename.
 func OpenFile(filename string, mode int) (result *file,exists bool,err error) {
+	return openFile(filename, mode, 0)
+}
+
+// openFile() is OpenFile() with the location of the most recent xref
+// section to be read.  If xrefLocation is 0, it is found using the
+// "startxref" at the end of the file.  A non-zero xrefLocation
+// ignores any revisions that were appended after that xref section.
+func openFile(filename string, mode int, xrefLocation int64) (result *file,exists bool,err error) {
 	var f *os.File
 	f,err = os.OpenFile(filename, mode, 0666)
 	if err != nil {
 		return
 	}
+	result,exists = newFile(f, mode, xrefLocation, false)
+	result.filename = filename
+	return
+}
 
+// newFile() constructs a file from the passed storage.  xrefLocation
+// is interpreted as for openFile().  If lazy is true, only the most
+// recent xref section is read (the first-page section if the storage
+// holds a linearized file) and the others are read on demand.
+func newFile(f storage, mode int, xrefLocation int64, lazy bool) (result *file,exists bool) {
 	result = new(file)
 	result.file = f
 	result.mode = mode
 
 	result.xref = &containers.StackArrayDecorator{containers.NewDynamicArray(1024)}
+	result.cache = newObjectCache(defaultObjectCacheSize)
 	result.originalSize,_ = f.Seek(0, os.SEEK_END)
 
 	if (result.originalSize == 0) {
@@ -136,12 +229,30 @@ func OpenFile(filename string, mode int) (result *file,exists bool,err error) {
 		result.dirty = true
 	} else {
 		exists = true
-		// For pre-existing files, read the xref
-		result.xrefLocation = findXrefLocation(f)
-		var nextXref int
-		nextXref,result.trailerDictionary = readOneXrefSection(result, result.xrefLocation)
-		for ; nextXref != 0; {
-			nextXref,_ = readOneXrefSection(result, int64(nextXref))
+		if lazy && xrefLocation == 0 {
+			result.linearization,xrefLocation = findLinearization(f, result.originalSize)
+		}
+		if result.linearization != nil {
+			result.xrefLocation = xrefLocation
+			prevXref,trailer,objects := readOneXrefSection(result, xrefLocation)
+			result.trailerDictionary = trailer
+			result.revisions = []revision{{
+				xrefOffset: xrefLocation,
+				end: result.originalSize,
+				trailer: trailer.Clone().(Dictionary),
+				objects: objects}}
+			result.pendingXref = int64(prevXref)
+		} else {
+			// For pre-existing files, read the xref.
+			if xrefLocation == 0 {
+				xrefLocation = findXrefLocation(f)
+			}
+			result.xrefLocation = xrefLocation
+			if lazy {
+				result.pendingXref = result.readXrefSection(xrefLocation)
+			} else {
+				result.readXrefChain(xrefLocation)
+			}
 		}
 	}
 	// If no pre-existing trailer was parsed, create a new dictionary.
@@ -154,34 +265,106 @@ func OpenFile(filename string, mode int) (result *file,exists bool,err error) {
 		result.trailerDictionary.Add ("Prev", NewIntNumeric(int(result.xrefLocation)))
 	}
 
+	// A header that can't be written is reported by Close() like
+	// any other write error.
 	result.writer = bufio.NewWriter(f)
 	if (result.originalSize == 0) {
-		writeHeader(result.writer)
+		if err := writeHeader(result.writer); err != nil {
+			result.setErr(err)
+		}
+	}
+	if _,err := result.Seek(0,os.SEEK_END); err != nil {
+		result.setErr(err)
 	}
-	result.Seek(0,os.SEEK_END)
 
 	result.writeQueue = make(chan writeQueueEntry, 5)
 	result.writingFinished = make(chan bool)
-	result.semaphore = make(chan bool, 1)
-	result.semaphore <- true
 
 	go result.gowriter()
 
 	return
 }
 
+// readXrefChain() reads the xref section at location and the earlier
+// sections in its /Prev chain.  Each section is an earlier revision of
+// the file.
+func (f *file) readXrefChain(location int64) {
+	for location != 0 && !f.xrefRead(location) {
+		location = f.readXrefSection(location)
+	}
+}
+
+// xrefRead() returns true if the xref section at location has been
+// read.
+func (f *file) xrefRead(location int64) bool {
+	for _,r := range f.revisions {
+		if r.xrefOffset == location {
+			return true
+		}
+	}
+	return false
+}
+
+// readXrefSection() reads the xref section at location, which is
+// older than the sections already read, and returns the location of
+// the previous section (0 if there is none).
+func (f *file) readXrefSection(location int64) int64 {
+	prevXref,trailer,objects := readOneXrefSection(f, location)
+	if f.trailerDictionary == nil {
+		f.trailerDictionary = trailer
+	}
+	f.revisions = append([]revision{{
+		xrefOffset: location,
+		end: findRevisionEnd(f.file, location),
+		trailer: trailer.Clone().(Dictionary),
+		objects: objects}}, f.revisions...)
+	return int64(prevXref)
+}
+
+// loadPendingXref() reads the next xref section whose reading was
+// deferred.  The file position is preserved.  It returns true if a
+// section was read.
+func (f *file) loadPendingXref() bool {
+	f.pendingLock.Lock()
+	defer f.pendingLock.Unlock()
+	location := f.pendingXref
+	f.pendingXref = 0
+	if location == 0 || f.xrefRead(location) {
+		return false
+	}
+	position,_ := f.file.Seek(0, os.SEEK_CUR)
+	f.pendingXref = f.readXrefSection(location)
+	f.file.Seek(position, os.SEEK_SET)
+	return true
+}
+
+// loadAllPendingXref() reads every xref section whose reading was
+// deferred.
+func (f *file) loadAllPendingXref() {
+	for f.loadPendingXref() {
+	}
+}
+
 // Implements WriteObject() in File interface
-func (f *file) WriteObject(object Object) Indirect {
+func (f *file) WriteObject(object Object) (Indirect, error) {
 	return NewIndirect(f).Write(object)
 }
 
 // Implements DeleteObject() in File interface
 func (f *file) DeleteObject(indirect Indirect) {
+	f.checkWritable()
 	objectNumber := indirect.ObjectNumber(f)
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
 	entry := (*f.xref.At(uint(objectNumber.number))).(*xrefEntry)
 	if objectNumber.generation != entry.generation {
 		panic("Generation number mismatch")
 	}
+	if f.deduplicator != nil {
+		f.deduplicator.forget(objectNumber.number)
+	}
+	f.cache.invalidate(objectNumber.number)
 
 	if entry.generation < 65535 {
 		// Increment the generation count for the next use
@@ -211,72 +394,128 @@ func (f *file) Indirect(o ObjectNumber) Indirect {
 	// retained within the file object, not written to disk, and
 	// not provided to clients, the duplication is only in memory
 	// and not in an output file.
+	f.lock.Lock()
+	defer f.lock.Unlock()
 	if o.number < uint32(f.xref.Size()) {
-		if entry,ok := (*f.xref.At(uint(o.number))).(*xrefEntry); ok {
-			if entry.indirect != nil {
-				return entry.indirect
+		if entry,ok := (*f.xref.At(uint(o.number))).(*xrefEntry); ok && entry.generation == o.generation {
+			if entry.indirect == nil {
+				// Remember the reference so that every
+				// occurrence of "n g R" in the file maps to
+				// the same Indirect.  Otherwise an object
+				// copied to another file would be copied
+				// once per reference, and reference cycles
+				// (e.g., /Parent and /Kids) would never
+				// terminate.
+				entry.indirect = newIndirectWithNumber(o, f)
 			}
+			return entry.indirect
 		}
 	}
 	return newIndirectWithNumber(o, f)
 }
 
 // Object() retrieves an object that already exists (or is in the
-// process of being written to) a PDF file.  Each call causes a new
-// object to be unserialized from the file or a buffer so the caller
-// has exclusive ownership of the returned object.
+// process of being written to) a PDF file.  Each call returns either
+// a newly unserialized object or a copy of a cached one (see
+// SetObjectCacheSize()), so the caller has exclusive ownership of the
+// returned object.
 func (f *file) Object(o ObjectNumber) (object Object,err error) {
-	entry := (*f.xref.At(uint(o.number))).(*xrefEntry)
+	serialization,byteOffset,cached,written,ok := f.entryLocation(o)
+	for !ok && f.loadPendingXref() {
+		serialization,byteOffset,cached,written,ok = f.entryLocation(o)
+	}
+	if !ok {
+		return nil, fmt.Errorf(`Object %d %d is not in the xref`, o.number, o.generation)
+	}
+	if cached != nil {
+		return cached.Clone(), nil
+	}
+	if written != nil {
+		// A successful write nulls written before closing it,
+		// so a closed channel means the write failed.
+		select {
+		case <-written:
+			return nil, fmt.Errorf(`Object %d %d could not be written`, o.number, o.generation)
+		default:
+		}
+		<-written
+		return f.Object(o)
+	}
+	if f.writeOnly && serialization == nil {
+		return nil, fmt.Errorf(`Object %d %d has been written to a write-only file and can't be read`, o.number, o.generation)
+	}
 	var r Scanner
 
 	// Reads can trigger additional reads, so this routine is
 	// recursive (For example, read a stream dictionary containing
 	// an indirect reference to the stream length; read the length
 	// from another part of the file, then return to the original
-	// position to read the stream data.  All reads occur in main
-	// goroutine so there should never be more than one goroutine
-	// manipulating f.readNesting.
-	if f.readNesting == 0 {
-		// Block writes
-		<-f.semaphore
-	}
-	f.readNesting += 1
-
-	if entry.serialization == nil {
-		// Save file position before moving for later restore
-		// so that f.Writer is unaware of the move.
-		position,_ := f.file.Seek(0, os.SEEK_CUR)
-		f.file.Seek(int64(entry.byteOffset),os.SEEK_SET)
-
-		r = bufio.NewReader(f.file)
-		object,err = NewParser(r).ScanIndirect(o, f)
-
-		// Restore position
-		f.file.Seek(position,os.SEEK_SET)
+	// position to read the stream data.  Reading with ReadAt()
+	// leaves the file position alone, so neither the writer nor
+	// other readers are disturbed.
+	if serialization == nil {
+		object,err = newFileParser(f.file, int64(byteOffset)).ScanIndirect(o, f)
 	} else {
-		r = bytes.NewReader(entry.serialization)
+		r = bytes.NewReader(serialization)
 		// Cached entry does not contain "obj" header and "endobj" trailer
 		// so use Parser.Scan() rather than Parser.ScanIndirect().
 		object,err = NewParser(r).Scan(f)
-		fmt.Fprintf(logger, "Object pulled from cache: \"%v\"\n", string(entry.serialization))
+		fmt.Fprintf(logger, "Object pulled from cache: \"%v\"\n", string(serialization))
 	}
 
-	f.readNesting -= 1
-	if f.readNesting == 0 {
-		// Allow writes
-		f.semaphore<-true
+	if err == nil {
+		f.cacheObject(o, object, serialization, byteOffset)
 	}
-
 	return object,err
 }
 
+// entryLocation() returns either the cached copy of an object, the
+// serialization of an object that is waiting to be written, or the
+// location of an object that has been written.  written is not nil if
+// the serialization can't be read until it has been written.  ok is
+// false if the object isn't in the xref.
+func (f *file) entryLocation(o ObjectNumber) (serialization []byte, byteOffset uint64, cached Object, written chan struct{}, ok bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if o.number >= uint32(f.xref.Size()) || *f.xref.At(uint(o.number)) == nil {
+		return nil, 0, nil, nil, false
+	}
+	if cached = f.cache.get(o); cached != nil {
+		return nil, 0, cached, nil, true
+	}
+	entry := (*f.xref.At(uint(o.number))).(*xrefEntry)
+	return entry.serialization, entry.byteOffset, nil, entry.written, true
+}
+
+// cacheObject() caches a copy of an object that was read from
+// serialization or byteOffset unless the object was rewritten or
+// deleted while it was being read.
+func (f *file) cacheObject(o ObjectNumber, object Object, serialization []byte, byteOffset uint64) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	entry := (*f.xref.At(uint(o.number))).(*xrefEntry)
+	if entry.generation != o.generation || entry.byteOffset != byteOffset || !sameBytes(entry.serialization, serialization) {
+		return
+	}
+	f.cache.put(o, object.Clone())
+}
+
 // Implements ReserveObjectNumber() in File interface
 func (f *file) ReserveObjectNumber(indirect Indirect) ObjectNumber {
+	f.checkWritable()
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.reserveObjectNumber(indirect)
+}
+
+// reserveObjectNumber() implements ReserveObjectNumber().  The caller
+// must hold f.lock.
+func (f *file) reserveObjectNumber(indirect Indirect) ObjectNumber {
 	var (
 		newNumber uint32
 		generation uint16
 	)
-
 	// Find an unused node if possible taken from beginning of
 	// free list.
 	newNumber = uint32((*f.xref.At(0)).(*xrefEntry).byteOffset)
@@ -297,16 +536,31 @@ func (f *file) ReserveObjectNumber(indirect Indirect) ObjectNumber {
 		freeHead.clear(entry.byteOffset)
 
 		entry.clear(0)
+		entry.indirect = indirect
 		generation = entry.generation
+		f.cache.invalidate(newNumber)
 	}
 	f.dirty = true
 	result := ObjectNumber{newNumber, generation}
 	return result
 }
 
-// Implements Close() in File interface
-func (f *file) Close() {
-	if f.trailerDictionary.Get("Root") == nil {
+// Implements Close() in File interface.  If an error occurred while
+// writing, or the file's context was cancelled, the xref and trailer
+// aren't written.  Instead, the partial update is removed (a new file
+// opened by name is deleted, and a pre-existing file is truncated to
+// its original size, when the storage permits), and the error is
+// returned.
+func (f *file) Close() error {
+	if f.readOnly {
+		close(f.writeQueue)
+		<- f.writingFinished
+		err := f.file.Close()
+		f.release()
+		return err
+	}
+
+	if f.Trailer().Get("Root") == nil {
 		f.SetCatalog(NewDictionary())
 		fmt.Fprintf(logger, "Warning: No document catalog has been specified.  Creating empty dictionary.  Use File.SetCatalog() to set one.\n")
 	}
@@ -314,20 +568,82 @@ func (f *file) Close() {
 	close(f.writeQueue)
 	<- f.writingFinished
 
-	if f.dirty {
+	err := f.Err()
+	if err == nil && f.dirty {
 //	 	dumpXref(f.xref)
 
-		xrefPosition,_ := f.Seek(0, os.SEEK_END)
-		f.writeXref()
+		var xrefPosition int64
+		if xrefPosition,err = f.Seek(0, os.SEEK_END); err == nil {
+			f.writeXref()
 
-		f.trailerDictionary.Add("Size", NewIntNumeric(int(f.xref.Size())))
-		f.writeTrailer(xrefPosition)
+			f.trailerDictionary.Add("Size", NewIntNumeric(int(f.xref.Size())))
+			f.writeTrailer(xrefPosition)
+		}
 	}
 
-	f.writer.Flush()
-	f.file.Close()
+	if err == nil {
+		err = f.writer.Flush()
+	}
+	if err == nil {
+		err = f.file.Close()
+	} else {
+		f.discard()
+	}
 
 	f.release()
+	return err
+}
+
+// discard() removes a partially written update after an error.
+func (f *file) discard() {
+	if t,ok := f.file.(interface{ Truncate(int64) error }); ok {
+		t.Truncate(f.originalSize)
+	}
+	f.file.Close()
+	if f.originalSize == 0 && f.filename != "" {
+		os.Remove(f.filename)
+	}
+}
+
+// Err() returns the first error that occurred while writing objects to
+// the file, or the error of its context if it was cancelled.  Once an
+// error has occurred, objects passed to WriteObject() and
+// WriteObjectAt() are discarded, and Close() returns the error.
+func (f *file) Err() error {
+	f.errLock.Lock()
+	defer f.errLock.Unlock()
+	if f.err == nil && f.ctx != nil {
+		f.err = f.ctx.Err()
+	}
+	return f.err
+}
+
+func (f *file) setErr(err error) {
+	f.errLock.Lock()
+	if f.err == nil {
+		f.err = err
+	}
+	f.errLock.Unlock()
+}
+
+// SetContext() associates ctx with the file.  When ctx is cancelled,
+// the writer stops, nothing more is written, and Close() returns the
+// context's error after removing the partial update.
+func (f *file) SetContext(ctx context.Context) {
+	f.errLock.Lock()
+	f.ctx = ctx
+	f.errLock.Unlock()
+}
+
+// done() returns the channel closed when the file's context is
+// cancelled or nil if the file has no context.
+func (f *file) done() <-chan struct{} {
+	f.errLock.Lock()
+	defer f.errLock.Unlock()
+	if f.ctx == nil {
+		return nil
+	}
+	return f.ctx.Done()
 }
 
 func (f *file) Closed() bool {
@@ -363,7 +679,10 @@ func ReadLine(r io.ByteScanner) (result string, err error) {
 
 
 func (f *file) dictionaryFromTrailer(name string) Dictionary {
-	if infoValue := f.trailerDictionary.Get(name); infoValue != nil {
+	f.lock.Lock()
+	infoValue := f.trailerDictionary.Get(name)
+	f.lock.Unlock()
+	if infoValue != nil {
 		indirect := infoValue.(Indirect)
 		if direct,_ := f.Object(indirect.ObjectNumber(f)); direct != nil {
 			if info,ok := direct.(Dictionary); ok {
@@ -375,7 +694,10 @@ func (f *file) dictionaryFromTrailer(name string) Dictionary {
 }
 
 func (f *file) dictionaryToTrailer(name string, d Dictionary) {
-	f.trailerDictionary.Add(name,NewIndirect(f).Write(d))
+	indirect,_ := NewIndirect(f).Write(d)
+	f.lock.Lock()
+	f.trailerDictionary.Add(name, indirect)
+	f.lock.Unlock()
 }
 
 // Catalog() returns the current document catalog or nil if one doesn't
@@ -401,16 +723,20 @@ func (f *file) SetInfo(info DocumentInfo) {
 
 // Trailer() returns the current trailer, which is never nil
 func (f *file) Trailer() ProtectedDictionary {
-	// Return a protected interface so nobody can alter the real
-	// dictionary
-	return f.trailerDictionary.Protect().(ProtectedDictionary)
+	// Return a protected copy so nobody can alter the real
+	// dictionary and so it can't change while being read.
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.trailerDictionary.Clone().(Dictionary).Protect().(ProtectedDictionary)
 }
 
 // Using pdf.file.Seek() rather than calling pdf.file.file.Seek()
 // directly provides a measure of safety by making sure the internal
 // writer is flushed before the file position is moved.
 func (f *file) Seek(position int64, whence int) (int64, error) {
-	f.writer.Flush()
+	if err := f.writer.Flush(); err != nil {
+		return 0, err
+	}
 	return f.file.Seek(position, whence)
 }
 
@@ -422,7 +748,7 @@ func (f *file) Tell() int64 {
 
 // Scan the file for the xref location, returning with the original
 // file position unchanged.
-func findXrefLocation(f *os.File) (result int64) {
+func findXrefLocation(f io.ReadSeeker) (result int64) {
 	save,_ := f.Seek(0,os.SEEK_END)
 	regexp,_ := regexp.Compile (`\s*FOE%%\s*(\d+)(\s*ferxtrats)`)
 	reader := bufio.NewReader(&io.LimitedReader{readers.NewReverseReader(f),512})
@@ -441,7 +767,10 @@ func findXrefLocation(f *os.File) (result int64) {
 	return result
 }
 
-func readXrefSubsection(xref containers.Array, r *bufio.Reader, start, count uint) {
+// readXrefSubsection() reads count xref entries beginning with
+// object number start.  It returns the object numbers of the entries
+// that were read.
+func readXrefSubsection(xref containers.Array, r *bufio.Reader, start, count uint) (objects []ObjectNumber) {
 	var (
 		position uint64
 		generation uint16
@@ -464,6 +793,7 @@ func readXrefSubsection(xref containers.Array, r *bufio.Reader, start, count uin
 			panic (fmt.Sprintf("Invalid character '%c' in xref use field.", useChar))
 		}
 		inUse := (useChar == 'n')
+		objects = append(objects, ObjectNumber{uint32(start+i), generation})
 
 		// Never overwrite a pre-existing entry.
 		if *xref.At(start+i) == nil {
@@ -476,6 +806,7 @@ func readXrefSubsection(xref containers.Array, r *bufio.Reader, start, count uin
 				indirect: nil}
 		}
 	}
+	return objects
 }
 
 func readTrailer(subsectionHeader string, r *bufio.Reader, f *file) (Dictionary,error) {
@@ -489,9 +820,8 @@ func readTrailer(subsectionHeader string, r *bufio.Reader, f *file) (Dictionary,
 		parser := NewParser (r)
 		object, err := parser.Scan(f)
 		if err != nil {
-			errmsg := fmt.Sprintf("%s\nLast data read before error: \"%s\"",
-				err.Error(), AsciiFromBytes(parser.GetContext()))
-			return nil, errors.New(errmsg)
+			return nil, fmt.Errorf("%w\nLast data read before error: \"%s\"",
+				err, AsciiFromBytes(parser.GetContext()))
 		}
 		trailer,ok := object.(Dictionary)
 		if !ok {
@@ -502,7 +832,7 @@ func readTrailer(subsectionHeader string, r *bufio.Reader, f *file) (Dictionary,
 	return nil,err
 }
 
-func readOneXrefSection (f *file, location int64) (prevXref int, trailer Dictionary) {
+func readOneXrefSection (f *file, location int64) (prevXref int, trailer Dictionary, objects []ObjectNumber) {
 
 	if _,err := f.file.Seek (location, os.SEEK_SET); err != nil {
 		panic ("Seeking to xref position failed")
@@ -521,7 +851,9 @@ func readOneXrefSection (f *file, location int64) (prevXref int, trailer Diction
 		if (err != nil || n != 2) {
 			break;
 		}
-		readXrefSubsection(f.xref, r, start, count)
+		f.lock.Lock()
+		objects = append(objects, readXrefSubsection(f.xref, r, start, count)...)
+		f.lock.Unlock()
 	}
 
 	var err error
@@ -536,63 +868,212 @@ func readOneXrefSection (f *file, location int64) (prevXref int, trailer Diction
 
 func (f *file) release() {
 	f.file = nil
+	f.linearization = nil
 	f.xref.SetSize(0)
 	f.xref = nil
+	f.revisions = nil
 	f.trailerDictionary = nil
 	f.writer = nil
 	f.writeQueue = nil
 	f.writingFinished = nil
-	f.semaphore = nil
 	f.closed = true
 }
 
 func (f* file) gowriter () {
+	for f.Err() == nil {
+		select {
+		case entry,ok := <-f.writeQueue:
+			if !ok {
+				f.writingFinished <- true
+				return
+			}
+			f.setErr(f.writeEntry(entry))
+			entry.finish()
+		case <-f.done():
+		}
+	}
+	// After an error, discard the remaining objects so that
+	// senders never block.
 	for entry := range f.writeQueue {
-		position,_ := f.Seek(0, os.SEEK_CUR)
-		entry.xrefEntry.setInUse(uint64(position))
+		f.lock.Lock()
+		entry.clearSerialization()
+		f.lock.Unlock()
+		entry.finish()
+	}
+	f.writingFinished <- true
+}
 
-		<-f.semaphore
-		fmt.Fprintf(f.writer, "%d %d obj\n", entry.index, entry.xrefEntry.generation)
+// writeEntry() writes one queued object.
+func (f *file) writeEntry(entry writeQueueEntry) error {
+	position,err := f.Seek(0, os.SEEK_CUR)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(f.writer, "%d %d obj\n", entry.index, entry.generation)
+	if err = writeWithBodies(f.writer, entry.serialization, entry.bodies); err != nil {
+		return fmt.Errorf(`Unable to write object %d: %v`, entry.index, err)
+	}
+	f.writer.WriteString("\nendobj\n")
 
-		_,err := f.writer.Write(entry.xrefEntry.serialization)
-		if err != nil {
-			panic(errors.New("Unable to write serialized object in file.writeObject()"))
-		}
-		f.writer.WriteString("\nendobj\n")
+	// Make sure writer is flushed so the object can be
+	// read before serialization is nulled.  The bufio.Writer
+	// retains the first error of any of the writes.
+	if err = f.writer.Flush(); err != nil {
+		return fmt.Errorf(`Unable to write object %d: %v`, entry.index, err)
+	}
 
-		// Make sure writer is flushed so the object can be
-		// read before serialization is nulled.
-		f.writer.Flush()
-		f.semaphore<-true
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	// If the object was rewritten while this version was in the
+	// queue, the later version is the one that must be found.
+	if entry.clearSerialization() {
+		entry.xrefEntry.setInUse(uint64(position))
+	}
+	f.dirty = true
+	return nil
+}
 
-		entry.xrefEntry.serialization = nil
-		f.dirty = true
+// clearSerialization() nulls the serialization of the xref entry if it
+// is still the one that was queued and returns true if it was.
+func (entry writeQueueEntry) clearSerialization() bool {
+	current := entry.xrefEntry.serialization
+	if current == nil || !sameBytes(current, entry.serialization) {
+		return false
 	}
-	f.writingFinished <- true
+	entry.xrefEntry.serialization = nil
+	entry.xrefEntry.written = nil
+	return true
+}
+
+// finish() signals readers waiting for the entry to be written.
+func (entry writeQueueEntry) finish() {
+	if entry.written != nil {
+		close(entry.written)
+	}
+}
+
+// sameBytes() returns true if a and b are the same slice (not merely
+// equal contents) or are both empty.
+func sameBytes(a, b []byte) bool {
+	if len(a) == 0 || len(b) == 0 {
+		return len(a) == len(b)
+	}
+	return len(a) == len(b) && &a[0] == &b[0]
 }
 
 // Implements WriteObjectAt() in File interface
-func (f *file) WriteObjectAt(objectNumber ObjectNumber, object Object) {
+func (f *file) WriteObjectAt(objectNumber ObjectNumber, object Object) error {
+	f.inspect(objectNumber, object)
+	serialization,bodies := f.serialize(object)
+	f.writeSerialization(nil, objectNumber, serialization, bodies, false)
+	return f.Err()
+}
+
+// inspect() passes an object about to be written at objectNumber to
+// the file's inspector, if any.
+func (f *file) inspect(objectNumber ObjectNumber, object Object) {
+	f.lock.Lock()
+	f.objectsWritten = true
+	inspector := f.inspector
+	f.lock.Unlock()
+	if inspector != nil {
+		inspector(objectNumber, object)
+	}
+}
+
+// hasWrittenObjects() returns true if objects have been written.
+func (f *file) hasWrittenObjects() bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.objectsWritten
+}
+
+// setInspector() sets the file's inspector.  It returns false if
+// objects have already been written without being inspected.
+func (f *file) setInspector(inspector func(ObjectNumber, Object)) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.inspector = inspector
+	return !f.objectsWritten
+}
+
+// checkedEntry() returns the xref entry for objectNumber after
+// verifying that the file is writable and the generation matches.
+// The caller must hold f.lock.
+func (f *file) checkedEntry(objectNumber ObjectNumber) *xrefEntry {
+	f.checkWritable()
 	xrefEntry := (*f.xref.At(uint(objectNumber.number))).(*xrefEntry)
 	if xrefEntry.generation != objectNumber.generation {
 		panic(fmt.Sprintf("Generation number mismatch: object %d current generation is %d but attempted to write %d",
 			objectNumber.number, xrefEntry.generation, objectNumber.generation))
 	}
-	buffer := new(bytes.Buffer)
-	object.Serialize(buffer, f)
-	xrefEntry.serialization = buffer.Bytes()
-	f.writeQueue<-writeQueueEntry{objectNumber.number,xrefEntry}
+	return xrefEntry
+}
+
+// writeSerialization() queues a serialized object for writing at
+// objectNumber, on behalf of the Indirect rewriter if it isn't nil,
+// and returns the number written.  If deduplicate is true, the object
+// may instead be found to duplicate an existing object (see
+// writeObjectOrDuplicate()), whose number is returned.  If other
+// objects were deduplicated to objectNumber, the object is written at
+// a new number instead (see copyOnWrite()).  The object is discarded
+// if an error has already occurred.  Objects whose digest can't be
+// computed are never deduplicated (see objectDigest()).
+func (f *file) writeSerialization(rewriter Indirect, objectNumber ObjectNumber, serialization []byte, bodies []deferredBody, deduplicate bool) ObjectNumber {
+	if f.Err() != nil {
+		return objectNumber
+	}
+	d := f.objectDigest(serialization, bodies)
+	entry,result := f.queueEntry(rewriter, objectNumber, serialization, bodies, d, deduplicate && d != nil)
+	if entry.xrefEntry != nil {
+		// Don't hold the lock here.  The writer needs it to
+		// make room in the queue.
+		f.writeQueue<-entry
+	}
+	return result
+}
+
+func (f *file) queueEntry(rewriter Indirect, objectNumber ObjectNumber, serialization []byte, bodies []deferredBody, d *digest, deduplicate bool) (writeQueueEntry, ObjectNumber) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	xrefEntry := f.checkedEntry(objectNumber)
+	if deduplicate {
+		if existing,ok := f.findDuplicate(objectNumber, xrefEntry, d); ok {
+			return writeQueueEntry{}, existing
+		}
+	}
+	if f.deduplicator != nil && f.deduplicator.shared[objectNumber.number] {
+		objectNumber,xrefEntry = f.copyOnWrite(rewriter, objectNumber, xrefEntry)
+	}
+	var written chan struct{}
+	if len(bodies) > 0 {
+		written = make(chan struct{})
+	}
+	if f.deduplicator != nil && d != nil {
+		f.deduplicator.record(objectNumber, d.hash)
+	}
+	f.cache.invalidate(objectNumber.number)
+	xrefEntry.serialization = serialization
+	xrefEntry.written = written
+	return writeQueueEntry{objectNumber.number, objectNumber.generation, xrefEntry, serialization, bodies, written}, objectNumber
+}
+
+func (f *file) checkWritable() {
+	if f.readOnly {
+		panic(errors.New(`Attempt to modify a read-only file`))
+	}
 }
 
 func (f *file) parseExistingFile() {
 	panic("Not implemented")
 }
 
-func writeHeader(w *bufio.Writer) {
-	_,err := w.WriteString("%PDF-1.4\n")
-	if (err != nil) {
-		panic("Unable to write PDF header")
-	}
+// writeHeader() writes the version followed by a comment of bytes
+// above 127, which marks the file as binary (and which PDF/A
+// requires).
+func writeHeader(w *bufio.Writer) error {
+	_,err := w.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+	return err
 }
 
 func dumpXref (xref containers.Array) {
@@ -625,11 +1106,18 @@ func nextSegment(xref containers.Array, start uint) (nextStart, length uint) {
 func (f *file) writeXref() {
 	f.writer.WriteString("xref\n")
 
+	// Entries on the free list are expected to be unused.
+	free := make(map[uint64]bool)
+	for next := (*f.xref.At(0)).(*xrefEntry).byteOffset; next != 0 && !free[next] && next < uint64(f.xref.Size()); {
+		free[next] = true
+		next = (*f.xref.At(uint(next))).(*xrefEntry).byteOffset
+	}
+
 	for s, l := nextSegment(f.xref, 0); s < f.xref.Size(); s, l = nextSegment(f.xref, s+l) {
 		fmt.Fprintf(f.writer, "%d %d\n", s, l)
 		for i := s; i < s+l; i++ {
 			entry := (*f.xref.At(uint(i))).(*xrefEntry)
-			if entry.byteOffset == 0 && entry.generation != 65535 {
+			if !entry.inUse && entry.byteOffset == 0 && entry.generation != 65535 && !free[uint64(i)] {
 				fmt.Fprintf(logger, "Warning: Object %d reserved but never written\n", i)
 			}
 			entry.Serialize(f.writer)
@@ -14,15 +14,21 @@ type File interface {
 	// returned indirect reference may be used for backward
 	// references to the object.  A new object is created
 	// either at a new index in the xref or at an old index
-	// using a new generation.
-	WriteObject(Object) (Indirect)
+	// using a new generation.  Objects are written by a
+	// background writer, so the error returned is the first one
+	// that occurred while writing this or any earlier object.
+	// Once a write fails, later objects are discarded, and
+	// Close() returns the error after removing the partial
+	// update.
+	WriteObject(Object) (Indirect, error)
 
 	// WriteObjectAt() adds the object to the File at the specified
 	// location.  ObjectNumber may have been obtained by an
 	// earlier call to ReserveObjectNumber(), or ObjectNumber may
 	// be a pre-existing (finalized) object that is being
-	// overwritten with a modified copy.
-	WriteObjectAt(ObjectNumber, Object)
+	// overwritten with a modified copy.  It returns errors as
+	// WriteObject() does.
+	WriteObjectAt(ObjectNumber, Object) error
 
 	// Indirect() returns an Indirect that can be used to refer
 	// to ObjectNumber in this file.  If an Indirect already
@@ -64,8 +70,9 @@ type File interface {
 	DeleteObject(Indirect)
 
 	// Close() writes the xref, trailer, etc., and closes the
-	// underlying file.
-	Close()
+	// underlying file.  It returns the first error that occurred
+	// while writing the file.
+	Close() error
 
 	// Closed() returns true if the file has been closed.
 	Closed() bool
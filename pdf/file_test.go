@@ -1,8 +1,17 @@
 package pdf_test
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"github.com/mawicks/PDFiG/pdf" )
 
@@ -10,10 +19,10 @@ func ExampleFile_creation() {
 	f,_,_ := pdf.OpenFile("/tmp/test-file.pdf", os.O_RDWR|os.O_CREATE)
 
 	o1 := pdf.NewIndirect()
-	indirect1 := f.WriteObject(o1)
+	indirect1,_ := f.WriteObject(o1)
 	o1.Write(pdf.NewNumeric(3.14))
 
-	indirect2 := f.WriteObject(pdf.NewNumeric(2.718))
+	indirect2,_ := f.WriteObject(pdf.NewNumeric(2.718))
 
 	f.WriteObject(pdf.NewName("foo"))
 
@@ -61,3 +70,731 @@ func TestPDFReadLine (t *testing.T) {
 	}
 }
 
+
+func TestRevisions(t *testing.T) {
+	filename := "/tmp/test-revisions.pdf"
+	makeFormFile(filename)
+	pdf.FlattenFile(filename, "")
+
+	revisions,err := pdf.ReadRevisions(filename)
+	if err != nil || len(revisions) != 2 {
+		t.Fatalf("ReadRevisions() returned %d revisions (err=%v); expected 2", len(revisions), err)
+	}
+	if info,_ := os.Stat(filename); revisions[1].End != info.Size() {
+		t.Errorf("Last revision ends at %d; file size is %d", revisions[1].End, info.Size())
+	}
+	if prev,_ := revisions[1].Trailer.GetInt("Prev"); int64(prev) != revisions[0].XrefOffset {
+		t.Errorf("Second revision /Prev is %d; expected %d", prev, revisions[0].XrefOffset)
+	}
+	if len(revisions[1].Objects) == 0 {
+		t.Errorf("Second revision reports no changed objects")
+	}
+
+	for n,expectForm := range []bool{true, false} {
+		f,err := pdf.OpenRevision(filename, n)
+		if err != nil {
+			t.Fatalf("OpenRevision(%d) returned error: %v", n, err)
+		}
+		if hasForm := f.Catalog().Get("AcroForm") != nil; hasForm != expectForm {
+			t.Errorf("Revision %d has form: %v; expected %v", n, hasForm, expectForm)
+		}
+		f.Close()
+	}
+
+	if err := pdf.TruncateToRevision(filename, 0); err != nil {
+		t.Fatalf("TruncateToRevision() returned error: %v", err)
+	}
+	f,_,_ := pdf.OpenFile(filename, os.O_RDONLY)
+	if f.Catalog().Get("AcroForm") == nil {
+		t.Errorf("Truncated file doesn't have the original form")
+	}
+	if len(f.Revisions()) != 1 {
+		t.Errorf("Truncated file has %d revisions; expected 1", len(f.Revisions()))
+	}
+	f.Close()
+}
+
+func TestCompactFile(t *testing.T) {
+	source := "/tmp/test-compact-source.pdf"
+	destination := "/tmp/test-compact.pdf"
+	makeFormFile(source)
+	// Flattening in place leaves the widget, its appearance, and
+	// the old page in the previous revision.
+	pdf.FlattenFile(source, "")
+
+	if err := pdf.CompactFile(source, destination); err != nil {
+		t.Fatalf("CompactFile() returned error: %v", err)
+	}
+
+	sourceInfo,_ := os.Stat(source)
+	destinationInfo,_ := os.Stat(destination)
+	if destinationInfo.Size() >= sourceInfo.Size() {
+		t.Errorf("Compacted file (%d bytes) isn't smaller than source (%d bytes)", destinationInfo.Size(), sourceInfo.Size())
+	}
+
+	f,_,_ := pdf.OpenFile(destination, os.O_RDONLY)
+	defer f.Close()
+
+	revisions := f.Revisions()
+	if len(revisions) != 1 {
+		t.Fatalf("Compacted file has %d revisions; expected 1", len(revisions))
+	}
+	// Catalog, page tree root, page, contents (3 streams),
+	// resources' Flat1 XObject, the link annotation, the Info
+	// dictionary, and the XMP metadata stream.
+	if size,_ := f.Trailer().GetInt("Size"); size != 11 {
+		t.Errorf("Compacted file /Size is %d; expected 11", size)
+	}
+	for _,o := range revisions[0].Objects[1:] {
+		if _,err := f.Object(o); err != nil {
+			t.Errorf("Object %v of compacted file unreadable: %v", o, err)
+		}
+	}
+
+	page := f.Catalog().GetDictionary("Pages").GetArray("Kids").At(0).Dereference().(pdf.ProtectedDictionary)
+	if page.GetDictionary("Resources").GetDictionary("XObject").GetStream("Flat1") == nil {
+		t.Errorf("Compacted page lost its /Flat1 XObject")
+	}
+}
+
+func TestDeduplication(t *testing.T) {
+	filename := "/tmp/test-dedup.pdf"
+	os.Remove(filename)
+	d := pdf.OpenDocument(filename, os.O_RDWR|os.O_CREATE)
+	d.SetDeduplication(true)
+	for i:=0; i<3; i++ {
+		p := d.NewPage()
+		p.Write([]byte("0 0 m 612 792 l s"))
+	}
+	image := pdf.NewStream()
+	image.Write([]byte("identical stream contents"))
+	d.WriteObject(image)
+	d.WriteObject(image)
+	statistics := d.DeduplicationStatistics()
+	d.Close()
+
+	// The contents and resources of the second page (the third
+	// page isn't finished until Close()) and the second stream.
+	if statistics.Objects != 3 || statistics.BytesSaved == 0 {
+		t.Errorf("DeduplicationStatistics() returned %+v; expected 3 objects", statistics)
+	}
+
+	if data,_ := ioutil.ReadFile(filename); bytes.Count(data, []byte("identical stream contents")) != 1 {
+		t.Errorf("Identical streams written more than once")
+	}
+
+	f,_,_ := pdf.OpenFile(filename, os.O_RDONLY)
+	defer f.Close()
+
+	kids := f.Catalog().GetDictionary("Pages").GetArray("Kids")
+	if kids.Size() != 3 {
+		t.Fatalf("Document has %d pages; expected 3", kids.Size())
+	}
+	pages := make(map[pdf.ObjectNumber]bool)
+	contents := make(map[pdf.ObjectNumber]bool)
+	for i:=0; i<kids.Size(); i++ {
+		pages[kids.At(i).(pdf.ProtectedIndirect).ObjectNumber(f)] = true
+		page := kids.At(i).Dereference().(pdf.ProtectedDictionary)
+		contents[page.Get("Contents").(pdf.ProtectedIndirect).ObjectNumber(f)] = true
+	}
+	if len(pages) != 3 {
+		t.Errorf("Identical pages were deduplicated")
+	}
+	if len(contents) != 1 {
+		t.Errorf("Identical page contents written as %d objects; expected 1", len(contents))
+	}
+}
+
+func TestDeduplicationRewrite(t *testing.T) {
+	filename := "/tmp/test-dedup-rewrite.pdf"
+	os.Remove(filename)
+	f,_,_ := pdf.OpenFile(filename, os.O_RDWR|os.O_CREATE)
+	f.SetDeduplication(true)
+	original,_ := f.WriteObject(pdf.NewTextString("shared"))
+	duplicate,_ := f.WriteObject(pdf.NewTextString("shared"))
+	if original.ObjectNumber(f) != duplicate.ObjectNumber(f) {
+		t.Fatalf("Identical objects weren't deduplicated")
+	}
+
+	// Rewriting the original must not change the duplicate.
+	original.Write(pdf.NewTextString("rewritten"))
+	originalNumber := original.ObjectNumber(f)
+	duplicateNumber := duplicate.ObjectNumber(f)
+	if originalNumber == duplicateNumber {
+		t.Fatalf("Rewritten object still shares its number with a duplicate")
+	}
+	f.Close()
+
+	f,_,_ = pdf.OpenFile(filename, os.O_RDONLY)
+	defer f.Close()
+	for _,test := range []struct {
+		objectNumber pdf.ObjectNumber
+		expected string
+	}{{originalNumber, "rewritten"}, {duplicateNumber, "shared"}} {
+		o,err := f.Object(test.objectNumber)
+		if err != nil {
+			t.Fatalf("Object(%v) failed: %v", test.objectNumber, err)
+		}
+		if s,ok := o.(pdf.ProtectString); !ok || string(s.Bytes()) != test.expected {
+			t.Errorf("Object %v is %v; expected (%s)", test.objectNumber, o, test.expected)
+		}
+	}
+}
+
+func TestLinearizeFile(t *testing.T) {
+	source := "/tmp/test-linearize-source.pdf"
+	destination := "/tmp/test-linearize.pdf"
+	os.Remove(source)
+	d := pdf.OpenDocument(source, os.O_RDWR|os.O_CREATE)
+	helvetica := pdf.NewStandardFont(pdf.Helvetica)
+	courier := pdf.NewStandardFont(pdf.Courier)
+	for i:=0; i<4; i++ {
+		page := d.NewPage()
+		font := courier
+		if i == 0 {
+			font = helvetica
+		}
+		fmt.Fprintf(page, "BT /%s 24 Tf 250 528 Td (Page %d) Tj ET", page.AddFont(font), i+1)
+	}
+	d.Close()
+
+	if err := pdf.LinearizeFile(source, destination); err != nil {
+		t.Fatalf("LinearizeFile() returned error: %v", err)
+	}
+	data,_ := ioutil.ReadFile(destination)
+
+	parameters := regexp.MustCompile(`^%PDF-1\.\d\n%[^\n]*\n(\d+) 0 obj\n<</Linearized 1 /L (\d+) *` +
+		`/H \[(\d+) *(\d+) *\] /O (\d+) /E (\d+) */N (\d+) /T (\d+) *>>`).FindSubmatch(data)
+	if parameters == nil {
+		t.Fatalf("Linearization dictionary not found at start of file")
+	}
+	value := func(i int) int {
+		v,_ := strconv.Atoi(string(parameters[i]))
+		return v
+	}
+	if value(2) != len(data) {
+		t.Errorf("/L is %d; file length is %d", value(2), len(data))
+	}
+	if value(7) != 4 {
+		t.Errorf("/N is %d; expected 4", value(7))
+	}
+	if hint := data[value(3):value(3)+value(4)]; !bytes.HasPrefix(hint, []byte(fmt.Sprintf("%d 0 obj\n", value(1)+2))) || !bytes.HasSuffix(hint, []byte("endobj\n")) {
+		t.Errorf("/H doesn't locate the hint stream")
+	}
+	if !bytes.HasPrefix(data[value(8)-len(fmt.Sprintf("xref\n0 %d", value(1))):], []byte(fmt.Sprintf("xref\n0 %d\n", value(1)))) {
+		t.Errorf("/T doesn't locate the main xref")
+	}
+
+	f,_,err := pdf.OpenFile(destination, os.O_RDONLY)
+	if err != nil {
+		t.Fatalf("OpenFile() returned error: %v", err)
+	}
+	defer f.Close()
+	kids := f.Catalog().GetDictionary("Pages").GetArray("Kids")
+	firstPage := kids.At(0).(pdf.ProtectedIndirect).ObjectNumber(f)
+	if firstPage != pdf.NewObjectNumber(uint32(value(5)), 0) {
+		t.Errorf("/O is %d; first page is %v", value(5), firstPage)
+	}
+	pageOffset := bytes.Index(data, []byte(fmt.Sprintf("\n%d 0 obj\n", value(5))))
+	if pageOffset < 0 || pageOffset > value(6) {
+		t.Errorf("First page object isn't before /E")
+	}
+	for _,r := range f.Revisions() {
+		for _,o := range r.Objects[1:] {
+			if _,err := f.Object(o); err != nil {
+				t.Errorf("Object %v of linearized file unreadable: %v", o, err)
+			}
+		}
+	}
+
+	// Check the hint tables against the objects' actual offsets
+	// and lengths.  Offsets in the hint tables are given as if the
+	// hint stream were absent.
+	offset := func(n int) int {
+		return bytes.Index(data, []byte(fmt.Sprintf("\n%d 0 obj\n", n))) + 1
+	}
+	length := func(n int) int {
+		return bytes.Index(data[offset(n):], []byte("endobj\n")) + len("endobj\n")
+	}
+	adjusted := func(offset int) int {
+		if offset > value(3) {
+			return offset - value(4)
+		}
+		return offset
+	}
+	hint,_ := f.Object(pdf.NewObjectNumber(uint32(value(1)+2), 0))
+	tables,_ := ioutil.ReadAll(hint.(pdf.ProtectedStream).Reader())
+	sharedTable,_ := hint.(pdf.ProtectedStream).Dictionary().GetInt("S")
+	pages := &bitReader{data: tables}
+	shared := &bitReader{data: tables[sharedTable:]}
+
+	// Page offset hint table header
+	leastObjects := pages.read(32)
+	firstPageOffset := pages.read(32)
+	objectBits := pages.read(16)
+	leastLength := pages.read(32)
+	lengthBits := pages.read(16)
+	pages.read(32 + 16 + 32 + 16)
+	referenceBits := pages.read(16)
+	identifierBits := pages.read(16)
+	pages.read(16 + 16)
+	if firstPageOffset != adjusted(offset(value(5))) {
+		t.Errorf("Page offset hint table locates the first page at %d; expected %d", firstPageOffset, adjusted(offset(value(5))))
+	}
+	objectCounts := make([]int, value(7))
+	for i := range objectCounts {
+		objectCounts[i] = leastObjects + pages.read(objectBits)
+	}
+	pages.align()
+	pageLengths := make([]int, value(7))
+	for i := range pageLengths {
+		pageLengths[i] = leastLength + pages.read(lengthBits)
+	}
+	pages.align()
+	references := make([]int, value(7))
+	for i := range references {
+		references[i] = pages.read(referenceBits)
+	}
+	pages.align()
+	var identifiers []int
+	for _,count := range references {
+		for i:=0; i<count; i++ {
+			identifiers = append(identifiers, pages.read(identifierBits))
+		}
+	}
+
+	// Shared object hint table header
+	firstShared := shared.read(32)
+	firstSharedOffset := shared.read(32)
+	firstPageGroups := shared.read(32)
+	groups := shared.read(32)
+	shared.read(16)
+	leastGroup := shared.read(32)
+	groupBits := shared.read(16)
+	groupLengths := make([]int, groups)
+	for i := range groupLengths {
+		groupLengths[i] = leastGroup + shared.read(groupBits)
+	}
+	if firstSharedOffset != adjusted(offset(firstShared)) {
+		t.Errorf("Shared object hint table locates the shared objects at %d; expected %d", firstSharedOffset, adjusted(offset(firstShared)))
+	}
+
+	// Each page begins with its page object, and the pages are
+	// followed by the shared objects.
+	firstPageLength := value(6) - offset(value(5))
+	if objectCounts[0] != firstPageGroups || pageLengths[0] != firstPageLength {
+		t.Errorf("First page has %d objects of %d bytes; expected %d objects of %d bytes", objectCounts[0], pageLengths[0], firstPageGroups, firstPageLength)
+	}
+	start := adjusted(offset(value(5))) + pageLengths[0]
+	for i:=1; i<kids.Size(); i++ {
+		var reference bytes.Buffer
+		kids.At(i).Serialize(&reference, f)
+		page,_ := strconv.Atoi(strings.Fields(reference.String())[0])
+		if start != adjusted(offset(page)) {
+			t.Errorf("Page %d is at %d; the page offset hint table implies %d", i+1, adjusted(offset(page)), start)
+		}
+		end := 0
+		for n:=page; n<page+objectCounts[i]; n++ {
+			end = offset(n) + length(n)
+		}
+		if end - offset(page) != pageLengths[i] {
+			t.Errorf("Page %d has length %d; the page offset hint table records %d", i+1, end - offset(page), pageLengths[i])
+		}
+		start += pageLengths[i]
+	}
+	if start != firstSharedOffset {
+		t.Errorf("Shared objects begin at %d; expected %d", firstSharedOffset, start)
+	}
+
+	total := 0
+	for _,length := range groupLengths[:firstPageGroups] {
+		total += length
+	}
+	if total != firstPageLength {
+		t.Errorf("First page groups have %d bytes; expected %d", total, firstPageLength)
+	}
+	for i,groupLength := range groupLengths[firstPageGroups:] {
+		if n := firstShared + i; groupLength != length(n) {
+			t.Errorf("Shared object %d has length %d; the shared object hint table records %d", n, length(n), groupLength)
+		}
+	}
+	if len(identifiers) == 0 {
+		t.Errorf("No page refers to a shared object")
+	}
+	for _,id := range identifiers {
+		if id >= groups {
+			t.Errorf("Shared object identifier %d is out of range", id)
+		}
+	}
+}
+
+// bitReader reads the fields of a hint table.
+type bitReader struct {
+	data []byte
+	position uint
+}
+
+func (r *bitReader) read(bits int) int {
+	value := 0
+	for i:=0; i<bits; i++ {
+		bit := r.data[r.position/8] >> (7 - r.position%8) & 1
+		value = value<<1 | int(bit)
+		r.position += 1
+	}
+	return value
+}
+
+// align() skips to the next byte boundary.
+func (r *bitReader) align() {
+	r.position = (r.position + 7) / 8 * 8
+}
+
+// rangeRecorder is an io.ReaderAt that records the furthest byte read
+// and whether the byte at watch was read.
+type rangeRecorder struct {
+	r *bytes.Reader
+	end int64
+	watch int64
+	watched bool
+}
+
+func (r *rangeRecorder) ReadAt(b []byte, offset int64) (int, error) {
+	n,err := r.r.ReadAt(b, offset)
+	if end := offset + int64(n); end > r.end {
+		r.end = end
+	}
+	if offset <= r.watch && r.watch < offset + int64(n) {
+		r.watched = true
+	}
+	return n, err
+}
+
+func TestOpenReaderAt(t *testing.T) {
+	source := "/tmp/test-readerat-source.pdf"
+	destination := "/tmp/test-readerat.pdf"
+	os.Remove(source)
+	d := pdf.OpenDocument(source, os.O_RDWR|os.O_CREATE)
+	font := pdf.NewStandardFont(pdf.Helvetica)
+	for i:=0; i<200; i++ {
+		page := d.NewPage()
+		fmt.Fprintf(page, "BT /%s 24 Tf 250 528 Td (Page %d) Tj ET", page.AddFont(font), i+1)
+	}
+	d.Close()
+	pdf.LinearizeFile(source, destination)
+	data,_ := ioutil.ReadFile(destination)
+
+	recorder := &rangeRecorder{r: bytes.NewReader(data)}
+	f,err := pdf.OpenReaderAt(recorder, int64(len(data)))
+	if err != nil {
+		t.Fatalf("OpenReaderAt() returned error: %v", err)
+	}
+	linearization := f.Linearization()
+	if linearization == nil {
+		t.Fatalf("Linearization dictionary not found")
+	}
+	page,err := f.FirstPage()
+	if err != nil {
+		t.Fatalf("FirstPage() returned error: %v", err)
+	}
+	contents,_ := ioutil.ReadAll(page.GetStream("Contents").Reader())
+	if !bytes.Contains(contents, []byte("(Page 1)")) {
+		t.Errorf("First page contents are %q", contents)
+	}
+	endOfFirstPage,_ := linearization.GetInt("E")
+	if recorder.end > int64(endOfFirstPage) + 4096 || recorder.end >= int64(len(data)) {
+		t.Errorf("Reading the first page read through offset %d of %d (/E is %d)", recorder.end, len(data), endOfFirstPage)
+	}
+	f.Close()
+
+	doc,err := pdf.OpenDocumentReaderAt(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatalf("OpenDocumentReaderAt() returned error: %v", err)
+	}
+	contents,_ = ioutil.ReadAll(doc.Page(150).Reader())
+	if !bytes.Contains(contents, []byte("(Page 151)")) {
+		t.Errorf("Page 151 contents are %q", contents)
+	}
+	doc.Close()
+}
+
+func TestOpenReaderAtUpdated(t *testing.T) {
+	filename := "/tmp/test-readerat-updated.pdf"
+	os.Remove(filename)
+	f,_,_ := pdf.OpenFile(filename, os.O_RDWR|os.O_CREATE)
+	// Padding keeps the original xref section away from the start
+	// and the end of the file, which are read when it's opened.
+	padding := pdf.NewTextString(strings.Repeat(" ", 8192))
+	originalReference,_ := f.WriteObject(pdf.NewTextString("original"))
+	original := originalReference.ObjectNumber(f)
+	f.WriteObject(padding)
+	f.SetCatalog(pdf.NewDictionary())
+	f.Close()
+	f,_,_ = pdf.OpenFile(filename, os.O_RDWR)
+	f.WriteObject(padding)
+	updatedReference,_ := f.WriteObject(pdf.NewTextString("updated"))
+	updated := updatedReference.ObjectNumber(f)
+	f.Close()
+	f,_,_ = pdf.OpenFile(filename, os.O_RDONLY)
+	originalXref := f.Revisions()[0].XrefOffset
+	f.Close()
+	data,_ := ioutil.ReadFile(filename)
+
+	// The xref section of the original revision is read only when
+	// an object that isn't in the update is requested.
+	recorder := &rangeRecorder{r: bytes.NewReader(data), watch: originalXref}
+	f,err := pdf.OpenReaderAt(recorder, int64(len(data)))
+	if err != nil {
+		t.Fatalf("OpenReaderAt() returned error: %v", err)
+	}
+	defer f.Close()
+	if _,err := f.Object(updated); err != nil || recorder.watched {
+		t.Errorf("Reading an updated object read the original xref section (error %v)", err)
+	}
+	if o,err := f.Object(original); err != nil || !recorder.watched {
+		t.Errorf("Object() of an original object returned %v, %v", o, err)
+	}
+}
+
+func TestInMemoryFiles(t *testing.T) {
+	var buffer bytes.Buffer
+	d := pdf.NewDocumentWriter(&buffer)
+	page := d.NewPage()
+	fmt.Fprintf(page, "BT /%s 24 Tf 250 528 Td (In memory) Tj ET", page.AddFont(pdf.NewStandardFont(pdf.Helvetica)))
+	d.Close()
+	if !bytes.HasPrefix(buffer.Bytes(), []byte("%PDF-")) || !bytes.HasSuffix(buffer.Bytes(), []byte("%%EOF\n")) {
+		t.Fatalf("NewDocumentWriter() didn't write a PDF file")
+	}
+
+	// Append a page to the in-memory file through an io.ReadWriteSeeker.
+	filename := "/tmp/test-memory.pdf"
+	ioutil.WriteFile(filename, buffer.Bytes(), 0666)
+	rws,_ := os.OpenFile(filename, os.O_RDWR, 0)
+	d,err := pdf.NewDocument(rws)
+	if err != nil {
+		t.Fatalf("NewDocument() returned error: %v", err)
+	}
+	fmt.Fprintf(d.NewPage(), "0 0 m 612 792 l s")
+	d.Close()
+
+	data,_ := ioutil.ReadFile(filename)
+	if !bytes.HasPrefix(data, buffer.Bytes()) {
+		t.Errorf("NewDocument() didn't append an incremental update")
+	}
+	d,err = pdf.OpenDocumentBytes(data)
+	if err != nil {
+		t.Fatalf("OpenDocumentBytes() returned error: %v", err)
+	}
+	contents,_ := ioutil.ReadAll(d.Page(0).Reader())
+	if !bytes.Contains(contents, []byte("(In memory)")) {
+		t.Errorf("First page contents are %q", contents)
+	}
+	if d.Page(1) == nil {
+		t.Errorf("Appended page not found")
+	}
+	d.Close()
+}
+
+// countingWriter is an io.Writer that supports neither seeking nor
+// reading.  The lock protects buffer, which is written by the
+// file's background writer.
+type countingWriter struct {
+	buffer bytes.Buffer
+	lock sync.Mutex
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.buffer.Write(b)
+}
+
+func (w *countingWriter) Len() int {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.buffer.Len()
+}
+
+func TestStreamingWrite(t *testing.T) {
+	w := new(countingWriter)
+	d := pdf.NewDocumentWriter(w)
+	font := pdf.NewStandardFont(pdf.Helvetica)
+	for i:=0; i<100; i++ {
+		page := d.NewPage()
+		fmt.Fprintf(page, "BT /%s 24 Tf 250 528 Td (Page %d) Tj ET", page.AddFont(font), i+1)
+	}
+	if w.Len() == 0 {
+		t.Errorf("Nothing was streamed before Close()")
+	}
+	d.Close()
+
+	d,err := pdf.OpenDocumentBytes(w.buffer.Bytes())
+	if err != nil {
+		t.Fatalf("OpenDocumentBytes() returned error: %v", err)
+	}
+	defer d.Close()
+	contents,_ := ioutil.ReadAll(d.Page(99).Reader())
+	if !bytes.Contains(contents, []byte("(Page 100)")) {
+		t.Errorf("Last page contents are %q", contents)
+	}
+}
+
+// fullDisk is a file that fails writes once it reaches its limit.
+type fullDisk struct {
+	*os.File
+	limit int64
+}
+
+func (f *fullDisk) Write(b []byte) (int, error) {
+	position,_ := f.Seek(0, os.SEEK_CUR)
+	if position + int64(len(b)) > f.limit {
+		return 0, errors.New("no space left on device")
+	}
+	return f.File.Write(b)
+}
+
+func TestWriteError(t *testing.T) {
+	f,err := ioutil.TempFile("", "pdfig-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	d,err := pdf.NewDocument(&fullDisk{f, 2000})
+	if err != nil {
+		t.Fatalf("NewDocument() returned error: %v", err)
+	}
+	font := pdf.NewStandardFont(pdf.Helvetica)
+	for i:=0; i<20; i++ {
+		page := d.NewPage()
+		fmt.Fprintf(page, "BT /%s 24 Tf 250 528 Td (Page %d) Tj ET", page.AddFont(font), i+1)
+	}
+	if d.Err() == nil {
+		t.Errorf("Err() returned nil after the disk filled")
+	}
+	if _,err := d.WriteObject(pdf.NewIntNumeric(1)); err == nil || !strings.Contains(err.Error(), "no space") {
+		t.Errorf("WriteObject() returned %v after the disk filled", err)
+	}
+	if err = d.Close(); err == nil || !strings.Contains(err.Error(), "no space") {
+		t.Errorf("Close() returned %v", err)
+	}
+	if info,err := os.Stat(f.Name()); err != nil || info.Size() != 0 {
+		t.Errorf("Partially written file wasn't truncated")
+	}
+}
+
+// brokenPipe is a writer that always fails.
+type brokenPipe struct {}
+
+func (brokenPipe) Write(b []byte) (int, error) {
+	return 0, errors.New("broken pipe")
+}
+
+func TestHeaderWriteError(t *testing.T) {
+	d := pdf.NewDocumentWriter(brokenPipe{})
+	d.NewPage()
+	if err := d.Close(); err == nil || !strings.Contains(err.Error(), "broken pipe") {
+		t.Errorf("Close() returned %v", err)
+	}
+}
+
+func TestCancelledWrite(t *testing.T) {
+	filename := filepath.Join(os.TempDir(), "pdfig-cancelled.pdf")
+	os.Remove(filename)
+
+	ctx,cancel := context.WithCancel(context.Background())
+	d := pdf.OpenDocument(filename, os.O_RDWR|os.O_CREATE)
+	d.SetContext(ctx)
+	d.NewPage()
+	cancel()
+	d.NewPage()
+	if err := d.Close(); err != context.Canceled {
+		t.Errorf("Close() returned %v; expected context.Canceled", err)
+	}
+	if _,err := os.Stat(filename); !os.IsNotExist(err) {
+		t.Errorf("Cancelled file wasn't removed")
+		os.Remove(filename)
+	}
+}
+
+func TestObjectCache(t *testing.T) {
+	filename := "/tmp/test-cache.pdf"
+	os.Remove(filename)
+	f,_,_ := pdf.OpenFile(filename, os.O_RDWR|os.O_CREATE)
+	array := pdf.NewArray()
+	array.Add(pdf.NewIntNumeric(1))
+	indirect,_ := f.WriteObject(array)
+	objectNumber := indirect.ObjectNumber(f)
+	f.SetCatalog(pdf.NewDictionary())
+	f.Close()
+
+	f,_,_ = pdf.OpenFile(filename, os.O_RDWR)
+	defer f.Close()
+
+	// Changing a returned object mustn't change the cached copy.
+	first,_ := f.Object(objectNumber)
+	first.(pdf.Array).Add(pdf.NewIntNumeric(2))
+	if second,_ := f.Object(objectNumber); second.(pdf.Array).Size() != 1 {
+		t.Errorf("Object() returned a modified cached object %v", second)
+	}
+
+	// Rewriting the object must invalidate the cached copy.
+	replacement := pdf.NewArray()
+	replacement.Add(pdf.NewIntNumeric(3))
+	replacement.Add(pdf.NewIntNumeric(4))
+	f.WriteObjectAt(objectNumber, replacement)
+	if third,_ := f.Object(objectNumber); third.(pdf.Array).Size() != 2 {
+		t.Errorf("Object() returned a stale cached object %v", third)
+	}
+}
+
+func TestLazyStreams(t *testing.T) {
+	data := make([]byte, 200000)
+	for i := range data {
+		data[i] = byte(i*7 ^ i>>8)
+	}
+	readContents := func(f pdf.File, n pdf.ObjectNumber) []byte {
+		object,err := f.Object(n)
+		if err != nil {
+			t.Fatalf("Object() returned error: %v", err)
+		}
+		contents,_ := ioutil.ReadAll(object.(pdf.ProtectedStream).Reader())
+		return contents
+	}
+
+	source := "/tmp/test-lazy-source.pdf"
+	os.Remove(source)
+	f,_,_ := pdf.OpenFile(source, os.O_RDWR|os.O_CREATE)
+	streamReference,_ := f.WriteObject(pdf.NewStreamFromReader(bytes.NewReader(data), int64(len(data))))
+	n := streamReference.ObjectNumber(f)
+	// Reading the stream back must wait until it has been written.
+	if contents := readContents(f, n); !bytes.Equal(contents, data) {
+		t.Errorf("Stream read before Close() has %d bytes", len(contents))
+	}
+	f.SetCatalog(pdf.NewDictionary())
+	f.Close()
+
+	destination := "/tmp/test-lazy-destination.pdf"
+	os.Remove(destination)
+	f,_,_ = pdf.OpenFile(source, os.O_RDONLY)
+	g,_,_ := pdf.OpenFile(destination, os.O_RDWR|os.O_CREATE)
+	g.SetDeduplication(true)
+	object,_ := f.Object(n)
+	copyReference,_ := g.WriteObject(object)
+	m := copyReference.ObjectNumber(g)
+	// Streams left in the source file are deduplicated too.
+	duplicate,_ := g.WriteObject(object)
+	if statistics := g.DeduplicationStatistics(); duplicate.ObjectNumber(g) != m || statistics.BytesSaved < int64(len(data)) {
+		t.Errorf("Copied stream wasn't deduplicated: %+v", statistics)
+	}
+	g.SetCatalog(pdf.NewDictionary())
+	if err := g.Close(); err != nil {
+		t.Fatalf("Close() returned error: %v", err)
+	}
+	f.Close()
+
+	g,_,_ = pdf.OpenFile(destination, os.O_RDONLY)
+	defer g.Close()
+	if contents := readContents(g, m); !bytes.Equal(contents, data) {
+		t.Errorf("Copied stream has %d bytes", len(contents))
+	}
+}
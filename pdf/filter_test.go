@@ -3,9 +3,15 @@ package pdf_test
 import (
 	"github.com/mawicks/PDFiG/pdf"
 //	"fmt"
+	"compress/lzw"
+	"image"
+	"image/jpeg"
 	"io"
+	"io/ioutil"
 	"bytes"
 	"math/rand"
+	"os"
+	"strings"
 	"testing" )
 
 func randomBytes(n int) []byte {
@@ -82,11 +88,46 @@ func testRoundTrip (t *testing.T, filter pdf.StreamFilterFactory, data []byte) {
 }
 
 
+// testLZWCompatibility() checks that EarlyChange 0 is compatible with
+// the Go LZW library.
+func testLZWCompatibility(t *testing.T, data []byte) {
+	var encoded bytes.Buffer
+	w := lzw.NewWriter(&encoded, lzw.MSB, 8)
+	w.Write(data)
+	w.Close()
+	testDecoder (t, new(pdf.LZWFilter), encoded.Bytes(), data)
+
+	ours := pdf.NewBufferCloser()
+	encoder := new(pdf.LZWFilter).NewEncoder(ours)
+	encoder.Write(data)
+	encoder.Close()
+	decoded,err := ioutil.ReadAll(lzw.NewReader(bytes.NewReader(ours.Bytes()), lzw.MSB, 8))
+	if err != nil || !bytes.Equal(decoded, data) {
+		t.Errorf(`Go LZW reader failed to decode LZWFilter output: %v`, err)
+	}
+}
+
 func TestFilters(t *testing.T) {
 	// Test some specific cases that are easy enough to type
 	testDecoder (t, new(pdf.AsciiHexFilter), []byte("3332313>"), []byte("3210"))
 	testDecoder (t, new(pdf.AsciiHexFilter), []byte("33323130>"), []byte("3210"))
 	testEncoder (t, new(pdf.AsciiHexFilter), []byte("3210"), []byte("33323130>"))
+	testDecoder (t, new(pdf.Ascii85Filter), []byte("9jqo^F*2M7/c~>"), []byte("Man sure."))
+	testDecoder (t, new(pdf.Ascii85Filter), []byte("<~9jqo^\r\nF*2M7/c~>"), []byte("Man sure."))
+	testDecoder (t, new(pdf.Ascii85Filter), []byte("z9jqo^~>"), []byte("\x00\x00\x00\x00Man "))
+	testEncoder (t, new(pdf.Ascii85Filter), []byte("Man sure."), []byte("9jqo^F*2M7/c~>"))
+	testDecoder (t, new(pdf.RunLengthFilter), []byte("\xfea\x01bc\x80"), []byte("aaabc"))
+	testDecoder (t, new(pdf.RunLengthFilter), []byte("\xfea\x01bc"), []byte("aaabc"))
+	testEncoder (t, new(pdf.RunLengthFilter), []byte("aaabc"), []byte("\xfea\x01bc\x80"))
+
+	// The LZW example from the PDF spec uses the default EarlyChange.
+	lzwSpecExample := []byte{0x80, 0x0b, 0x60, 0x50, 0x22, 0x0c, 0x0c, 0x85, 0x01}
+	testDecoder (t, pdf.FilterFactory("LZWDecode", nil), lzwSpecExample, []byte("-----A---B"))
+	earlyChangeFilter := pdf.NewLZWFilter()
+	testEncoder (t, earlyChangeFilter, []byte("-----A---B"), lzwSpecExample)
+	if earlyChangeFilter.DecodeParms() != pdf.NewNull() {
+		t.Errorf(`NewLZWFilter() doesn't use the default EarlyChange`)
+	}
 
 	// Then make sure random sequences can make the round trip.
 	flateFilter := new(pdf.FlateFilter)
@@ -96,6 +137,328 @@ func TestFilters(t *testing.T) {
 		testRoundTrip (t, new(pdf.AsciiHexFilter), r)
 		testRoundTrip (t, flateFilter, r)
 		testRoundTrip (t, new(pdf.LZWFilter), r)
+		testRoundTrip (t, earlyChangeFilter, r)
+		testRoundTrip (t, earlyChangeFilter, bytes.Repeat(r, 50))
+		testLZWCompatibility (t, r)
+		testRoundTrip (t, new(pdf.Ascii85Filter), r)
+		testRoundTrip (t, new(pdf.RunLengthFilter), r)
+		testRoundTrip (t, new(pdf.RunLengthFilter), bytes.Repeat(r, 3))
+		testRoundTrip (t, new(pdf.RunLengthFilter), bytes.Repeat([]byte{'x'}, i))
+	}
+}
+
+func TestPredictors(t *testing.T) {
+	// Two rows of three RGB pixels with PNG Sub and Up filters.
+	parms := pdf.NewDictionary()
+	parms.Add("Predictor", pdf.NewIntNumeric(pdf.PNGUpPredictor))
+	parms.Add("Colors", pdf.NewIntNumeric(3))
+	parms.Add("Columns", pdf.NewIntNumeric(3))
+	encoded := []byte{
+		1, 1,2,3, 1,1,1, 1,1,1,
+		2, 1,1,1, 1,1,1, 1,1,1 }
+	uncompressed := pdf.NewBufferCloser()
+	compressor := new(pdf.FlateFilter).NewEncoder(uncompressed)
+	compressor.Write(encoded)
+	compressor.Close()
+	flateFilter := pdf.FilterFactory("FlateDecode", parms.Protect().(pdf.ProtectedDictionary))
+	testDecoder (t, flateFilter, uncompressed.Bytes(), []byte{1,2,3, 2,3,4, 3,4,5, 2,3,4, 3,4,5, 4,5,6})
+
+	// TIFF predictor with 4 bits per component
+	tiffFilter := new(pdf.LZWFilter)
+	tiffFilter.SetPredictor(pdf.TIFFPredictor, 1, 4, 4)
+	testRoundTrip (t, tiffFilter, []byte{0x12, 0x34, 0xff, 0x01, 0x77})
+
+	for predictor:=pdf.PNGNonePredictor; predictor<=pdf.PNGOptimumPredictor; predictor++ {
+		for _,bitsPerComponent := range []int{1, 8, 16} {
+			filter := new(pdf.FlateFilter)
+			filter.SetPredictor(predictor, 3, bitsPerComponent, 17)
+			r := randomBytes(1000)
+			testRoundTrip (t, filter, r)
+
+			// Decode using the parameters the encoder wrote.
+			decodeParms := filter.DecodeParms().Protect().(pdf.ProtectedDictionary)
+			testRoundTrip (t, pdf.FilterFactory("FlateDecode", decodeParms), r)
+		}
+	}
+	filter := new(pdf.FlateFilter)
+	filter.SetPredictor(pdf.TIFFPredictor, 3, 16, 17)
+	testRoundTrip (t, filter, randomBytes(1000))
+}
+
+
+// bitsToBytes() converts a string of "0" and "1" characters (and
+// ignored spaces) to bytes, padding the last byte with zeros.
+func bitsToBytes(bits string) []byte {
+	result := make([]byte, 0, len(bits)/8+1)
+	n := 0
+	for _,c := range bits {
+		if c == ' ' {
+			continue
+		}
+		if n%8 == 0 {
+			result = append(result, 0)
+		}
+		if c == '1' {
+			result[n/8] |= 0x80 >> uint(n%8)
+		}
+		n += 1
+	}
+	return result
+}
+
+func TestCCITTFaxDecode(t *testing.T) {
+	// An 8x3 image with black pixels in columns 2 through 5 of
+	// the last two rows.
+	expected := []byte{0xff, 0xc3, 0xc3}
+	eol := "000000000001 "
+
+	testFax := func(k int, endOfLine bool, rows int, bits string) {
+		parms := pdf.NewDictionary()
+		parms.Add("K", pdf.NewIntNumeric(k))
+		parms.Add("Columns", pdf.NewIntNumeric(8))
+		if rows > 0 {
+			parms.Add("Rows", pdf.NewIntNumeric(rows))
+		}
+		parms.Add("EndOfLine", pdf.NewBoolean(endOfLine))
+		testDecoder (t, pdf.FilterFactory("CCITTFaxDecode", parms.Protect().(pdf.ProtectedDictionary)),
+			bitsToBytes(bits), expected)
+	}
+
+	// Group 4 with EOFB
+	testFax(-1, false, 0, "1 001 0111 011 1 111 " + eol + eol)
+	// Group 4 without EOFB
+	testFax(-1, false, 3, "1 001 0111 011 1 111")
+	// One-dimensional Group 3 with and without EOLs
+	testFax(0, false, 3, "10011 0111 011 0111 0111 011 0111")
+	testFax(0, true, 0, eol + "10011 " + eol + "0111 011 0111 " + eol + "0111 011 0111 " +
+		strings.Repeat(eol, 6))
+	// Two-dimensional Group 3 with fill bits before an EOL
+	testFax(1, true, 0, eol + "1 10011 0000 " + eol + "0 001 0111 011 1 " + eol + "0 111 " +
+		strings.Repeat(eol + "1 ", 6))
+
+	parms := pdf.NewDictionary()
+	parms.Add("K", pdf.NewIntNumeric(-1))
+	parms.Add("Columns", pdf.NewIntNumeric(8))
+	parms.Add("BlackIs1", pdf.NewBoolean(true))
+	testDecoder (t, pdf.FilterFactory("CCITTFaxDecode", parms.Protect().(pdf.ProtectedDictionary)),
+		bitsToBytes("1 001 0111 011 1 111 " + eol + eol), []byte{0x00, 0x3c, 0x3c})
+}
+
+func TestImageFilters(t *testing.T) {
+	img := image.NewGray(image.Rect(0, 0, 16, 8))
+	for i := range img.Pix {
+		img.Pix[i] = 0x80
+	}
+	var jpegData bytes.Buffer
+	jpeg.Encode(&jpegData, img, nil)
+
+	s := pdf.NewStream()
+	s.AddFilter(new(pdf.DCTFilter))
+	s.Write(jpegData.Bytes())
+	var serialized bytes.Buffer
+	s.Serialize(&serialized)
+	parsed,err := pdf.NewParser(bytes.NewReader(serialized.Bytes())).Scan()
+	if err != nil {
+		t.Fatalf(`Scan() of DCTDecode stream returned error: %v`, err)
+	}
+	dct := parsed.(pdf.Stream)
+
+	samples,_ := ioutil.ReadAll(dct.Reader())
+	if len(samples) != 16*8 || samples[0] < 0x7c || samples[0] > 0x84 {
+		t.Errorf(`DCTDecode produced %d samples starting with %v`, len(samples), samples[:1])
+	}
+	raw,remaining := dct.RawReader()
+	rawData,_ := ioutil.ReadAll(raw)
+	if !bytes.Equal(rawData, jpegData.Bytes()) || len(remaining) != 1 || remaining[0] != "DCTDecode" {
+		t.Errorf(`RawReader() returned %d bytes and filters %v`, len(rawData), remaining)
+	}
+
+	s = pdf.NewStream()
+	s.AddFilter(new(pdf.FlateFilter))
+	s.AddFilter(pdf.NewPassThroughFilter("JPXDecode", nil))
+	s.Write([]byte("not really JPEG 2000"))
+	serialized.Reset()
+	s.Serialize(&serialized)
+	parsed,_ = pdf.NewParser(bytes.NewReader(serialized.Bytes())).Scan()
+	jpx := parsed.(pdf.Stream)
+	if jpx.Reader() != nil {
+		t.Errorf(`Reader() of a JPXDecode stream wasn't nil`)
+	}
+	raw,remaining = jpx.RawReader()
+	rawData,_ = ioutil.ReadAll(raw)
+	if string(rawData) != "not really JPEG 2000" || len(remaining) != 1 || remaining[0] != "JPXDecode" {
+		t.Errorf(`RawReader() returned "%s" and filters %v`, rawData, remaining)
+	}
+}
+
+func TestStreamEncodingPreserved(t *testing.T) {
+	serialize := func(o pdf.Object) []byte {
+		var b bytes.Buffer
+		o.Serialize(&b)
+		return b.Bytes()
+	}
+	parse := func(b []byte) pdf.Stream {
+		parsed,err := pdf.NewParser(bytes.NewReader(b)).Scan()
+		if err != nil {
+			t.Fatalf(`Scan() returned error: %v`, err)
+		}
+		return parsed.(pdf.Stream)
+	}
+	contents := func(s pdf.Stream) string {
+		b,_ := ioutil.ReadAll(s.Reader())
+		return string(b)
+	}
+
+	s := pdf.NewStream()
+	s.AddFilter(new(pdf.FlateFilter))
+	s.Write([]byte("hello"))
+	original := serialize(s)
+
+	// An unmodified stream is written exactly as it was read.
+	if copied := serialize(parse(original)); !bytes.Equal(copied, original) {
+		t.Errorf(`Unmodified stream was written as "%s"; expected "%s"`, copied, original)
+	}
+
+	// A modified stream is re-encoded with the same filters.
+	modified := parse(original)
+	modified.Write([]byte(" world"))
+	reparsed := parse(serialize(modified))
+	if name,_ := reparsed.Dictionary().GetName("Filter"); name != "FlateDecode" || contents(reparsed) != "hello world" {
+		t.Errorf(`Modified stream has filter %s and contents "%s"`, name, contents(reparsed))
+	}
+
+	factory := pdf.NewStreamFactory()
+	factory.AddFilter(new(pdf.AsciiHexFilter))
+	recompressed := parse(original)
+	if err := recompressed.Recompress(factory); err != nil {
+		t.Fatalf(`Recompress() returned error: %v`, err)
+	}
+	reparsed = parse(serialize(recompressed))
+	if name,_ := reparsed.Dictionary().GetName("Filter"); name != "ASCIIHexDecode" || contents(reparsed) != "hello" {
+		t.Errorf(`Recompressed stream has filter %s and contents "%s"`, name, contents(reparsed))
+	}
+
+	// Image data is never decoded and re-encoded.
+	image := pdf.NewStream()
+	image.AddFilter(pdf.NewPassThroughFilter("JPXDecode", nil))
+	image.Write([]byte("not really JPEG 2000"))
+	jpx := parse(serialize(image))
+	if _,err := jpx.Write([]byte("more")); err == nil {
+		t.Errorf(`Write() to a JPXDecode stream didn't fail`)
+	}
+	if err := jpx.Recompress(factory); err != nil {
+		t.Fatalf(`Recompress() of a JPXDecode stream returned error: %v`, err)
+	}
+	filters := parse(serialize(jpx)).Dictionary().GetArray("Filter")
+	if filters == nil || filters.Size() != 2 || filters.At(1).(pdf.Name).String() != "JPXDecode" {
+		t.Errorf(`Recompressed JPXDecode stream has filters %v`, filters)
 	}
 }
 
+func TestCryptFilter(t *testing.T) {
+	parse := func(s string) pdf.Object {
+		parsed,err := pdf.NewParser(strings.NewReader(s)).Scan()
+		if err != nil {
+			t.Fatalf(`Scan() of "%s" returned error: %v`, s, err)
+		}
+		return parsed
+	}
+
+	identity := parse("<</Length 5 /Filter /Crypt>>\nstream\nclear\nendstream").(pdf.Stream)
+	if contents,_ := ioutil.ReadAll(identity.Reader()); string(contents) != "clear" {
+		t.Errorf(`Identity crypt filter produced "%s"`, contents)
+	}
+
+	named := parse("<</Length 6 /Filter [/Crypt /FlateDecode] /DecodeParms [<</Name /EmbeddedFiles>> null]>>\nstream\nsecret\nendstream").(pdf.Stream)
+	if named.Reader() != nil {
+		t.Errorf(`Reader() of a stream with a named crypt filter wasn't nil`)
+	}
+	raw,remaining := named.RawReader()
+	if contents,_ := ioutil.ReadAll(raw); string(contents) != "secret" || len(remaining) != 2 || remaining[0] != "Crypt" {
+		t.Errorf(`RawReader() returned "%s" and filters %v`, contents, remaining)
+	}
+
+	encrypt := parse(`<</Filter /Standard /V 4 /R 4 /CF <</StdCF <</CFM /AESV2>> /EmbeddedFiles <</CFM /V2>>>>
+		/StmF /StdCF /StrF /StdCF /EFF /EmbeddedFiles /EncryptMetadata false>>`).(pdf.Dictionary)
+	cf := pdf.NewCryptFilters(encrypt)
+	for _,test := range []struct{ stream pdf.Stream; filter, method string }{
+		{identity, "Identity", "None"},
+		{named, "EmbeddedFiles", "V2"},
+		{parse("<</Length 0 /Type /Metadata>>\nstream\n\nendstream").(pdf.Stream), "Identity", "None"},
+		{parse("<</Length 0 /Type /EmbeddedFile>>\nstream\n\nendstream").(pdf.Stream), "EmbeddedFiles", "V2"},
+		{parse("<</Length 0>>\nstream\n\nendstream").(pdf.Stream), "StdCF", "AESV2"}} {
+		if filter := cf.StreamCryptFilter(test.stream); filter != test.filter || cf.Method(filter) != test.method {
+			t.Errorf(`StreamCryptFilter() returned %s (method %s); expected %s (method %s)`,
+				filter, cf.Method(filter), test.filter, test.method)
+		}
+	}
+	if cf.StringFilter != "StdCF" {
+		t.Errorf(`StringFilter is %s`, cf.StringFilter)
+	}
+
+	// Only the Identity crypt filter can be written.
+	if _,err := pdf.NewCryptFilter("EmbeddedFiles"); err == nil {
+		t.Errorf(`NewCryptFilter() of a named crypt filter didn't fail`)
+	}
+	identityFilter,err := pdf.NewCryptFilter("")
+	if err != nil {
+		t.Fatalf(`NewCryptFilter() of the Identity crypt filter returned error: %v`, err)
+	}
+	s := pdf.NewStream()
+	s.AddFilter(identityFilter)
+	s.Write([]byte("data"))
+	var serialized bytes.Buffer
+	s.Serialize(&serialized)
+	if !strings.Contains(serialized.String(), "/Filter /Crypt") || strings.Contains(serialized.String(), "/Name") {
+		t.Errorf(`Identity crypt filter was serialized as "%s"`, serialized.String())
+	}
+
+	// A named crypt filter from FilterFactory() refuses to write
+	// data in clear.
+	s = pdf.NewStream()
+	s.AddFilter(pdf.FilterFactory("Crypt", named.Dictionary().GetArray("DecodeParms").At(0).(pdf.ProtectedDictionary)))
+	s.Write([]byte("data"))
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Errorf(`Serialize() with a named crypt filter didn't fail`)
+			}
+		}()
+		s.Serialize(new(bytes.Buffer))
+	}()
+}
+
+func TestIndirectDecodeParms(t *testing.T) {
+	filename := "/tmp/test-decode-parms.pdf"
+	os.Remove(filename)
+	f,_,_ := pdf.OpenFile(filename, os.O_RDWR|os.O_CREATE)
+	parms := pdf.NewDictionary()
+	parms.Add("Name", pdf.NewName("EmbeddedFiles"))
+	filters := pdf.NewArray()
+	filters.Add(pdf.NewName("Crypt"))
+	filters.Add(pdf.NewName("FlateDecode"))
+	decodeParms := pdf.NewArray()
+	parmsReference,_ := f.WriteObject(parms)
+	decodeParms.Add(parmsReference)
+	decodeParms.Add(pdf.NewNull())
+	s := pdf.NewStream()
+	s.Add("Filter", filters)
+	s.Add("DecodeParms", decodeParms)
+	s.Write([]byte("secret"))
+	streamReference,_ := f.WriteObject(s)
+	streamNumber := streamReference.ObjectNumber(f)
+	f.SetCatalog(pdf.NewDictionary())
+	f.Close()
+
+	f,_,_ = pdf.OpenFile(filename, os.O_RDONLY)
+	defer f.Close()
+	object,_ := f.Object(streamNumber)
+	named := object.(pdf.Stream)
+	if named.Reader() != nil {
+		t.Errorf(`Reader() ignored an indirect DecodeParms entry`)
+	}
+	cf := pdf.NewCryptFilters(pdf.NewDictionary())
+	if filter := cf.StreamCryptFilter(named); filter != "EmbeddedFiles" {
+		t.Errorf(`StreamCryptFilter() returned %s for an indirect DecodeParms entry`, filter)
+	}
+}
@@ -7,13 +7,16 @@ import ( //"errors"
 
 type FlateFilter struct {
 	compressionLevel int
+	predictor predictor
 }
 
 const ( flateDecoderName = "FlateDecode" )
 
 func init () {
 	RegisterFilterFactoryFactory(flateDecoderName,
-		func(ProtectedDictionary) StreamFilterFactory { return new(FlateFilter) })
+		func(d ProtectedDictionary) StreamFilterFactory {
+			return &FlateFilter{predictor: newPredictor(d)}
+		})
 }
 
 func (filter *FlateFilter) Name() string {
@@ -24,18 +27,31 @@ func (filter *FlateFilter) SetCompressionLevel(level int) {
 	filter.compressionLevel = level
 }
 
+// SetPredictor() causes the encoder to apply a predictor (one of
+// TIFFPredictor or PNGNonePredictor through PNGOptimumPredictor) to
+// rows of columns samples with the passed number of colors and bits
+// per component.  NoPredictor disables prediction.
+func (filter *FlateFilter) SetPredictor(predictor, colors, bitsPerComponent, columns int) {
+	filter.predictor = newPredictorWithParameters(predictor, colors, bitsPerComponent, columns)
+}
+
 func (filter *FlateFilter) NewEncoder(writer io.WriteCloser) io.WriteCloser {
 	flateWriter,_ := zlib.NewWriterLevel(writer,filter.compressionLevel)
-	return &FlateWriter{flateWriter,writer}
+	return newPredictorWriter(&FlateWriter{flateWriter,writer}, filter.predictor)
 }
 
 func (filter *FlateFilter) NewDecoder(reader io.Reader) io.Reader {
 	flateReader,_ := zlib.NewReader(reader)
-	return &FlateReader{flateReader}
+	return newPredictorReader(&FlateReader{flateReader}, filter.predictor)
 }
 
 func (filter *FlateFilter) DecodeParms(file ...File) Object {
-	return NewNull()
+	if !filter.predictor.enabled() {
+		return NewNull()
+	}
+	d := NewDictionary()
+	filter.predictor.addDecodeParms(d)
+	return d
 }
 
 type FlateWriter struct {
@@ -0,0 +1,272 @@
+package pdf
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+)
+
+// Annotation flags that suppress display of an annotation.  Widgets
+// with either flag set are removed without being drawn.
+const (
+	annotationFlagHidden = 1<<1
+	annotationFlagNoView = 1<<5
+)
+
+// Flatten() makes the interactive form of the document non-editable.
+// The normal appearance stream of each visible widget annotation is
+// drawn into the contents of its page as a Form XObject, the widget
+// annotations are removed from the pages, and the /AcroForm entry is
+// removed from the catalog.  Other annotations are left alone.  The
+// modified pages and catalog are written as an incremental update
+// when the document is closed.
+func (d *Document) Flatten() {
+	// A page that is still being generated has no widgets.  Finish
+	// it so that it becomes part of the page tree being walked.
+	d.finishCurrentPage()
+	d.currentPage = nil
+
+	for n:=uint(0); n<d.pageCount; n++ {
+		if page := pageFromTree(d.pageTreeRoot, n); page != nil {
+			d.flattenPage(page)
+		}
+	}
+	d.catalog.Remove("AcroForm")
+}
+
+// FlattenFile() flattens the form in the PDF file named by source.
+// If destination is empty or names the source, the source file is
+// modified in place using an incremental update.  Otherwise the
+// source is copied to destination and only the copy is modified.
+// The form remains in the earlier revision of the file; use
+// CompactFile() to remove it.
+func FlattenFile(source, destination string) error {
+	if _,err := os.Stat(source); err != nil {
+		return err
+	}
+	if destination != "" && destination != source {
+		if err := copyFile(source, destination); err != nil {
+			return err
+		}
+		source = destination
+	}
+	return flattenInPlace(source)
+}
+
+func flattenInPlace(filename string) error {
+	d,err := openDocument(filename, os.O_RDWR)
+	if err != nil {
+		return err
+	}
+	d.Flatten()
+	return d.Close()
+}
+
+func copyFile(source, destination string) error {
+	in,err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out,err := os.OpenFile(destination, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	if _,err = io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// flattenPage() draws and removes the widget annotations on a single
+// page.  Pages without widgets are not rewritten.
+func (d *Document) flattenPage(page *ExistingPage) {
+	annots := page.dictionary.GetArray("Annots")
+	if annots == nil {
+		return
+	}
+
+	var resources, xobjects Dictionary
+	if r := page.dictionary.GetDictionary("Resources"); r != nil {
+		resources = r.Unprotect().(Dictionary)
+	} else {
+		resources = NewDictionary()
+	}
+	if x := resources.GetDictionary("XObject"); x != nil {
+		xobjects = x.Unprotect().(Dictionary)
+	} else {
+		xobjects = NewDictionary()
+	}
+
+	keep := NewArray()
+	content := new(bytes.Buffer)
+	flattened := false
+	for i:=0; i<annots.Size(); i++ {
+		annotReference := annots.At(i)
+		annot,ok := annotReference.Dereference().(ProtectedDictionary)
+		if !ok || !annot.CheckNameValue("Subtype", "Widget") {
+			keep.Add(annotReference)
+			continue
+		}
+		flattened = true
+
+		if flags,_ := annot.GetInt("F"); flags & (annotationFlagHidden|annotationFlagNoView) != 0 {
+			continue
+		}
+		appearance := d.widgetAppearance(annot)
+		rect,ok := rectangleValues(annot.GetArray("Rect"))
+		if appearance == nil || !ok {
+			continue
+		}
+
+		name := uniqueResourceName(xobjects, "Flat")
+		xobjects.Add(name, appearance)
+		writeFormPlacement(content, appearance.Dereference().(ProtectedStream).Dictionary(), rect, name)
+	}
+
+	if !flattened {
+		return
+	}
+
+	if keep.Size() == 0 {
+		page.dictionary.Remove("Annots")
+	} else {
+		page.dictionary.Add("Annots", keep)
+	}
+
+	if content.Len() != 0 {
+		resources.Add("XObject", xobjects)
+		page.dictionary.Add("Resources", resources)
+
+		// Write errors are reported by Close().
+		if page.dictionary.Get("Contents") == nil {
+			contents,_ := d.WriteObject(d.newContentStream(content.Bytes()))
+			page.SetContents(contents)
+		} else {
+			// Isolate the existing contents so that any
+			// graphics state it leaves behind doesn't
+			// affect the flattened fields.
+			before,_ := d.WriteObject(d.newContentStream([]byte("q\n")))
+			after,_ := d.WriteObject(d.newContentStream(append([]byte("Q\n"), content.Bytes()...)))
+			page.PrependContents(before)
+			page.AppendContents(after)
+		}
+	}
+	page.Rewrite()
+}
+
+func (d *Document) newContentStream(b []byte) Stream {
+	s := d.streamFactory.New()
+	s.Write(b)
+	return s
+}
+
+// widgetAppearance() returns an Indirect reference to the normal
+// appearance of the widget annotation as a Form XObject, or nil if
+// the widget has no normal appearance.  For widgets with appearance
+// states (e.g., check boxes) the appearance selected by /AS is used.
+// If the appearance stream is direct or lacks the entries required
+// of a Form XObject, a (corrected) copy is written to the document.
+func (d *Document) widgetAppearance(annot ProtectedDictionary) Indirect {
+	ap := annot.GetDictionary("AP")
+	if ap == nil {
+		return nil
+	}
+
+	// The normal appearance is usually an indirect stream but may
+	// be a direct one.
+	var normal Object
+	if states := ap.GetDictionary("N"); states != nil {
+		if state,ok := annot.GetName("AS"); ok {
+			normal = states.Get(state)
+		}
+	} else {
+		normal = ap.Get("N")
+	}
+	if normal == nil {
+		return nil
+	}
+
+	appearance,ok := normal.Dereference().(ProtectedStream)
+	if !ok {
+		return nil
+	}
+
+	dictionary := appearance.Dictionary()
+	isForm := dictionary.CheckNameValue("Subtype", "Form") && dictionary.GetArray("BBox") != nil
+	if reference,ok := normal.(ProtectedIndirect); ok && isForm {
+		return reference.Unprotect().(Indirect)
+	}
+
+	form := appearance.Unprotect().(Stream)
+	if !isForm {
+		form.Add("Type", NewName("XObject"))
+		form.Add("Subtype", NewName("Form"))
+		if dictionary.GetArray("BBox") == nil {
+			rect,_ := rectangleValues(annot.GetArray("Rect"))
+			form.Add("BBox", NewRectangle(0, 0, rect[2]-rect[0], rect[3]-rect[1]))
+		}
+	}
+	reference,_ := d.WriteObject(form)
+	return reference
+}
+
+// uniqueResourceName() returns a name beginning with prefix that
+// is not a key in the resource dictionary d.
+func uniqueResourceName(d ProtectedDictionary, prefix string) string {
+	for i:=1; ; i++ {
+		name := prefix + strconv.Itoa(i)
+		if d.Get(name) == nil {
+			return name
+		}
+	}
+}
+
+// writeFormPlacement() writes the content stream operators that draw
+// the named Form XObject so that its bounding box (as transformed by
+// its own /Matrix) fills rect.  The algorithm is the one used by
+// viewers to render annotation appearances.
+func writeFormPlacement(w io.Writer, form ProtectedDictionary, rect [4]float64, name string) {
+	bbox,ok := rectangleValues(form.GetArray("BBox"))
+	if !ok {
+		return
+	}
+	matrix := [6]float64{1, 0, 0, 1, 0, 0}
+	if m := form.GetArray("Matrix"); m != nil && m.Size() == 6 {
+		for i:=0; i<6; i++ {
+			matrix[i],_ = floatValue(m.At(i))
+		}
+	}
+
+	// Transform the corners of the bounding box and find the
+	// smallest upright rectangle that contains them.
+	minX,minY := math.Inf(1),math.Inf(1)
+	maxX,maxY := math.Inf(-1),math.Inf(-1)
+	for _,corner := range [][2]float64{{bbox[0],bbox[1]}, {bbox[0],bbox[3]}, {bbox[2],bbox[1]}, {bbox[2],bbox[3]}} {
+		x := matrix[0]*corner[0] + matrix[2]*corner[1] + matrix[4]
+		y := matrix[1]*corner[0] + matrix[3]*corner[1] + matrix[5]
+		minX,maxX = math.Min(minX, x),math.Max(maxX, x)
+		minY,maxY = math.Min(minY, y),math.Max(maxY, y)
+	}
+
+	sx,sy := 1.0,1.0
+	if maxX > minX {
+		sx = (rect[2]-rect[0])/(maxX-minX)
+	}
+	if maxY > minY {
+		sy = (rect[3]-rect[1])/(maxY-minY)
+	}
+	fmt.Fprintf(w, "q %s 0 0 %s %s %s cm /%s Do Q\n",
+		formatReal(sx), formatReal(sy),
+		formatReal(rect[0]-sx*minX), formatReal(rect[1]-sy*minY),
+		name)
+}
+
+func formatReal(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 32)
+}
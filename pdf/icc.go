@@ -0,0 +1,105 @@
+package pdf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math")
+
+// srgbDescription identifies the profile returned by sRGBProfile().
+const srgbDescription = "sRGB IEC61966-2.1"
+
+// sRGBProfile() returns an ICC version 2 display profile for sRGB
+// built from the primaries, white point, and tone curve of IEC
+// 61966-2.1.
+func sRGBProfile() []byte {
+	type tag struct {
+		signature string
+		data []byte
+	}
+	trc := iccCurve()
+	tags := []tag{
+		{"desc", iccDescription(srgbDescription)},
+		{"cprt", iccText("No copyright, use freely")},
+		{"wtpt", iccXYZ(0.9505, 1.0, 1.0890)},
+		{"rXYZ", iccXYZ(0.4361, 0.2225, 0.0139)},
+		{"gXYZ", iccXYZ(0.3851, 0.7169, 0.0971)},
+		{"bXYZ", iccXYZ(0.1431, 0.0606, 0.7141)},
+		{"rTRC", trc},
+		{"gTRC", trc},
+		{"bTRC", trc}}
+
+	// The tag data follows the 128-byte header and the tag table,
+	// with each element aligned on a 4-byte boundary.
+	offset := 128 + 4 + 12*len(tags)
+	var table, data bytes.Buffer
+	binary.Write(&table, binary.BigEndian, uint32(len(tags)))
+	for _,t := range tags {
+		table.WriteString(t.signature)
+		binary.Write(&table, binary.BigEndian, []uint32{uint32(offset + data.Len()), uint32(len(t.data))})
+		data.Write(t.data)
+		for data.Len() % 4 != 0 {
+			data.WriteByte(0)
+		}
+	}
+
+	var header bytes.Buffer
+	size := uint32(offset + data.Len())
+	binary.Write(&header, binary.BigEndian, []uint32{size, 0, 0x02100000})
+	header.WriteString("mntrRGB XYZ ")
+	binary.Write(&header, binary.BigEndian, []uint16{2014, 3, 25, 0, 0, 0})
+	header.WriteString("acsp")
+	// Platform, flags, manufacturer, model, attributes (8
+	// bytes), and rendering intent.
+	header.Write(make([]byte, 24))
+	header.Write(iccXYZ(0.9642, 1.0, 0.8249)[8:])
+	header.Write(make([]byte, 128 - header.Len()))
+
+	return append(append(header.Bytes(), table.Bytes()...), data.Bytes()...)
+}
+
+func iccS15Fixed16(v float64) uint32 {
+	return uint32(int32(math.Floor(v*65536 + 0.5)))
+}
+
+func iccXYZ(x, y, z float64) []byte {
+	var b bytes.Buffer
+	b.WriteString("XYZ \x00\x00\x00\x00")
+	binary.Write(&b, binary.BigEndian, []uint32{iccS15Fixed16(x), iccS15Fixed16(y), iccS15Fixed16(z)})
+	return b.Bytes()
+}
+
+func iccText(s string) []byte {
+	return []byte("text\x00\x00\x00\x00" + s + "\x00")
+}
+
+// iccDescription() returns a version 2 textDescriptionType with an
+// ASCII description and empty Unicode and ScriptCode descriptions.
+func iccDescription(s string) []byte {
+	var b bytes.Buffer
+	b.WriteString("desc\x00\x00\x00\x00")
+	binary.Write(&b, binary.BigEndian, uint32(len(s)+1))
+	b.WriteString(s)
+	b.WriteByte(0)
+	// Unicode language code and count, ScriptCode code and
+	// count, and the 67-byte ScriptCode description.
+	b.Write(make([]byte, 4+4+2+1+67))
+	return b.Bytes()
+}
+
+// iccCurve() returns the sRGB tone curve as a table.
+func iccCurve() []byte {
+	const n = 1024
+	var b bytes.Buffer
+	b.WriteString("curv\x00\x00\x00\x00")
+	binary.Write(&b, binary.BigEndian, uint32(n))
+	for i:=0; i<n; i++ {
+		v := float64(i) / (n-1)
+		if v <= 0.04045 {
+			v /= 12.92
+		} else {
+			v = math.Pow((v+0.055)/1.055, 2.4)
+		}
+		binary.Write(&b, binary.BigEndian, uint16(math.Floor(v*65535 + 0.5)))
+	}
+	return b.Bytes()
+}
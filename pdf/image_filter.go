@@ -0,0 +1,142 @@
+package pdf
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io")
+
+const (
+	dctDecoderName = "DCTDecode"
+	ccittFaxDecoderName = "CCITTFaxDecode"
+	jbig2DecoderName = "JBIG2Decode"
+	jpxDecoderName = "JPXDecode" )
+
+// IsImageFilter() returns true if name is one of the filters that
+// encode image data (DCTDecode, CCITTFaxDecode, JBIG2Decode, and
+// JPXDecode).  The encoders of these filters copy data that is
+// already encoded, such as the contents of a JPEG file, into a stream.
+func IsImageFilter(name string) bool {
+	switch name {
+	case dctDecoderName, ccittFaxDecoderName, jbig2DecoderName, jpxDecoderName:
+		return true
+	}
+	return false
+}
+
+func init () {
+	RegisterFilterFactoryFactory(dctDecoderName,
+		func(ProtectedDictionary) StreamFilterFactory { return new(DCTFilter) })
+	RegisterFilterFactoryFactory(jbig2DecoderName,
+		func(d ProtectedDictionary) StreamFilterFactory { return &PassThroughFilter{jbig2DecoderName,d} })
+	RegisterFilterFactoryFactory(jpxDecoderName,
+		func(d ProtectedDictionary) StreamFilterFactory { return &PassThroughFilter{jpxDecoderName,d} })
+}
+
+// PassThroughFilter is a filter that can't be decoded.  Its decoder
+// is nil, so Stream.Reader() returns nil but Stream.RawReader()
+// returns the encoded data.  Its encoder copies encoded data.
+type PassThroughFilter struct {
+	name string
+	decodeParms ProtectedDictionary
+}
+
+// NewPassThroughFilter() returns a filter that writes data already
+// encoded by the named filter with the passed DecodeParms, which may
+// be nil.
+func NewPassThroughFilter(name string, decodeParms ProtectedDictionary) *PassThroughFilter {
+	return &PassThroughFilter{name, decodeParms}
+}
+
+func (filter *PassThroughFilter) Name() string {
+	return filter.name
+}
+
+func (filter *PassThroughFilter) NewEncoder(writer io.WriteCloser) io.WriteCloser {
+	return writer
+}
+
+func (filter *PassThroughFilter) NewDecoder(reader io.Reader) io.Reader {
+	return nil
+}
+
+func (filter *PassThroughFilter) DecodeParms(file... File) Object {
+	if filter.decodeParms == nil {
+		return NewNull()
+	}
+	return filter.decodeParms.Unprotect()
+}
+
+// DCTFilter decodes JPEG data to the samples of the image: one byte
+// per pixel for gray images, three (RGB) for color images, and four
+// (CMYK) for CMYK images.  The encoder copies JPEG data.
+type DCTFilter struct {
+}
+
+func (filter *DCTFilter) Name() string {
+	return dctDecoderName
+}
+
+func (filter *DCTFilter) NewEncoder(writer io.WriteCloser) io.WriteCloser {
+	return writer
+}
+
+func (filter *DCTFilter) NewDecoder(reader io.Reader) io.Reader {
+	return &DCTReader{reader: reader}
+}
+
+func (filter *DCTFilter) DecodeParms(file... File) Object {
+	return NewNull()
+}
+
+// DCTReader decodes the entire image on the first call to Read().
+type DCTReader struct {
+	reader io.Reader
+	samples *bytes.Reader
+	err error
+}
+
+func (r *DCTReader) Read(buffer []byte) (int, error) {
+	if r.samples == nil && r.err == nil {
+		var img image.Image
+		if img,r.err = jpeg.Decode(r.reader); r.err != nil {
+			return 0, r.err
+		}
+		r.samples = bytes.NewReader(imageSamples(img))
+	}
+	if r.err != nil {
+		return 0, r.err
+	}
+	return r.samples.Read(buffer)
+}
+
+// imageSamples() returns the samples of a decoded JPEG image in the
+// order PDF expects.
+func imageSamples(img image.Image) []byte {
+	bounds := img.Bounds()
+	switch img := img.(type) {
+	case *image.Gray:
+		samples := make([]byte, 0, bounds.Dx()*bounds.Dy())
+		for y:=bounds.Min.Y; y<bounds.Max.Y; y++ {
+			i := img.PixOffset(bounds.Min.X, y)
+			samples = append(samples, img.Pix[i:i+bounds.Dx()]...)
+		}
+		return samples
+	case *image.CMYK:
+		samples := make([]byte, 0, 4*bounds.Dx()*bounds.Dy())
+		for y:=bounds.Min.Y; y<bounds.Max.Y; y++ {
+			i := img.PixOffset(bounds.Min.X, y)
+			samples = append(samples, img.Pix[i:i+4*bounds.Dx()]...)
+		}
+		return samples
+	}
+	samples := make([]byte, 0, 3*bounds.Dx()*bounds.Dy())
+	for y:=bounds.Min.Y; y<bounds.Max.Y; y++ {
+		for x:=bounds.Min.X; x<bounds.Max.X; x++ {
+			c := color.RGBAModel.Convert(img.At(x, y)).(color.RGBA)
+			samples = append(samples, c.R, c.G, c.B)
+		}
+	}
+	return samples
+}
@@ -3,7 +3,8 @@ package pdf
 import (
 	"errors"
 	"fmt"
-	"strconv" )
+	"strconv"
+	"sync" )
 
 // Implements:
 // 	pdf.Object
@@ -16,13 +17,24 @@ type ProtectedIndirect interface {
 
 type Indirect interface {
 	ProtectedIndirect
-	Write(o Object) Indirect
+	Write(o Object) (Indirect, error)
 }
 
 type indirect struct {
 	fileBindings map[File]ObjectNumber
 	// When not nil, sourceFile is a file this indirect object was read from.
 	sourceFile      File
+	// referenced is true once the reference has been serialized.
+	// The objects of referenced Indirects are never deduplicated
+	// because the reserved object numbers may already be in use.
+	referenced bool
+	// lock protects the fields above so that an Indirect shared
+	// by pages being built in parallel (a font, for example) can
+	// be serialized by several goroutines at once.  bindLock is
+	// held while binding to a file so that only one object number
+	// is reserved.  It is separate from lock because reserving a
+	// number may look up the existing bindings.
+	lock, bindLock sync.Mutex
 }
 
 /*
@@ -101,7 +113,9 @@ obtained from X.
 Currently, objects are discarded from memory once written.  They are
 re-read and read back from from disk when dererenced or written to
 another file.  Even better would be a weak-reference to the object,
-but weak references are not implemented in Go.
+but weak references are not implemented in Go.  Instead, files keep a
+bounded cache of recently parsed objects (see
+file.SetObjectCacheSize()).
 
 */
 
@@ -137,13 +151,16 @@ func (i *indirect) Clone() Object {
 }
 
 func (i *indirect) Dereference() Object {
-	if i.sourceFile == nil {
+	i.lock.Lock()
+	sourceFile := i.sourceFile
+	i.lock.Unlock()
+	if sourceFile == nil {
 		panic (errors.New(`Attempt to deference an object with no known source`))
 	}
 
-	object,err := i.sourceFile.Object(i.ObjectNumber(i.sourceFile))
+	object,err := sourceFile.Object(i.ObjectNumber(sourceFile))
 	if err != nil {
-		panic (errors.New(fmt.Sprintf(`Unable to read object at %v`, i.ObjectNumber(i.sourceFile))))
+		panic (errors.New(fmt.Sprintf(`Unable to read object at %v`, i.ObjectNumber(sourceFile))))
 	}
 	// TODO:  Think about whether Dereference() is a good idea here.
 	return object.Dereference()
@@ -174,6 +191,9 @@ func (i *indirect) Serialize(w Writer, file ...File) {
 		if file[0].Closed() {
 			panic("Attempt to Serialize to a closed file")
 		}
+		i.lock.Lock()
+		i.referenced = true
+		i.lock.Unlock()
 		objectNumber := i.ObjectNumber(file[0])
 		w.WriteString(strconv.FormatInt(int64(objectNumber.number), 10))
 		w.WriteByte(' ')
@@ -185,22 +205,43 @@ func (i *indirect) Serialize(w Writer, file ...File) {
 // Write() writes the passed object as an indirect object (complete
 // with an entry in the xref, an "obj" header, and an "endobj"
 // trailer) to all files to which the Indirect object has been bound.
-// Write() may be used to replace an existing object.
+// Write() may be used to replace an existing object.  If a file has
+// deduplication enabled and the Indirect has never been serialized,
+// the Indirect may be rebound to an identical object that already
+// exists in the file.  If other Indirects were rebound to its object,
+// the Indirect is instead rebound to a new object (see
+// file.SetDeduplication()).
 // Write() returns its Indirect object for constructions such as
-//  a := NewIndirect(f).Write(object)
-func (i *indirect) Write(o Object) Indirect{
-	wroteSomething := false
+//  a,err := NewIndirect(f).Write(object)
+// and the first write error of any of the files (see
+// File.WriteObject()).
+func (i *indirect) Write(o Object) (result Indirect, err error) {
+	// Writing serializes o, which may refer back to i, so the
+	// lock isn't held while writing.
+	i.lock.Lock()
+	bindings := make(map[File]ObjectNumber, len(i.fileBindings))
 	for file, objectNumber := range i.fileBindings {
-		file.WriteObjectAt(objectNumber, o)
-		wroteSomething = true
+		bindings[file] = objectNumber
+	}
+	canDeduplicate := !i.referenced
+	i.lock.Unlock()
+
+	if len(bindings) == 0 {
+		panic(fmt.Sprintf("Indirect.Write() called on an object with no file bindings."))
+	}
+	for file, objectNumber := range bindings {
+		written,writeErr := writeObjectAt(file, i, objectNumber, o, canDeduplicate)
+		if err == nil {
+			err = writeErr
+		}
+		i.lock.Lock()
+		i.fileBindings[file] = written
 		if i.sourceFile == nil {
 			i.sourceFile = file
 		}
+		i.lock.Unlock()
 	}
-	if !wroteSomething {
-		panic(fmt.Sprintf("Indirect.Write() called on an object with no file bindings."))
-	}
-	return i
+	return i, err
 }
 
 // ObjectNumber() binds its object to the passed pdf.File object and
@@ -215,28 +256,48 @@ func (i *indirect) Write(o Object) Indirect{
 // Indirect that may be used for backward references.  In the latter
 // case, the reference will only be tied to only one file.
 func (i *indirect) ObjectNumber(f File) ObjectNumber {
-	destObjectNumber,exists := i.fileBindings[f]
-	if !exists {
-		destObjectNumber = f.ReserveObjectNumber(i)
-		i.fileBindings[f] = destObjectNumber
-		// If the object was a pre-existing object, silently
-		// add it to "file."
-		if i.sourceFile != nil {
-			sourceObjectNumber := i.fileBindings[i.sourceFile]
-			o, err := i.sourceFile.Object(sourceObjectNumber)
-			if err == nil {
-				f.WriteObjectAt(destObjectNumber,o)
-			}
+	if destObjectNumber,exists := i.binding(f); exists {
+		return destObjectNumber
+	}
+	i.bindLock.Lock()
+	destObjectNumber,exists := i.binding(f)
+	if exists {
+		i.bindLock.Unlock()
+		return destObjectNumber
+	}
+	destObjectNumber = f.ReserveObjectNumber(i)
+	i.lock.Lock()
+	i.fileBindings[f] = destObjectNumber
+	sourceFile := i.sourceFile
+	sourceObjectNumber := i.fileBindings[sourceFile]
+	i.lock.Unlock()
+	// The binding is recorded before the object is copied so that
+	// reference cycles in the copied objects terminate.
+	i.bindLock.Unlock()
+
+	// If the object was a pre-existing object, silently
+	// add it to "file."
+	if sourceFile != nil {
+		o, err := sourceFile.Object(sourceObjectNumber)
+		if err == nil {
+			f.WriteObjectAt(destObjectNumber,o)
 		}
 	}
 	return destObjectNumber
 }
 
 func (i *indirect) BoundToFile(f File) bool {
-	_,exists := i.fileBindings[f]
+	_,exists := i.binding(f)
 	return exists
 }
 
+func (i *indirect) binding(f File) (ObjectNumber, bool) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	objectNumber,exists := i.fileBindings[f]
+	return objectNumber,exists
+}
+
 
 type protectedIndirect struct {
 	i Indirect
@@ -247,7 +308,22 @@ func (roi protectedIndirect) Clone() Object {
 }
 
 func (roi protectedIndirect) Dereference() Object {
-	return roi.i
+	// A protected view of a cached object needn't be copied.
+	if i,ok := roi.i.(*indirect); ok {
+		i.lock.Lock()
+		sourceFile := i.sourceFile
+		i.lock.Unlock()
+		f,ok := sourceFile.(*file)
+		if !ok {
+			return i.Dereference().Protect()
+		}
+		object,err := f.ProtectedObject(i.ObjectNumber(f))
+		if err != nil {
+			panic (errors.New(fmt.Sprintf(`Unable to read object at %v`, i.ObjectNumber(f))))
+		}
+		return object.Dereference()
+	}
+	return roi.i.Dereference().Protect()
 }
 
 func (roi protectedIndirect) Serialize(w Writer, file... File) {
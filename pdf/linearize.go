@@ -0,0 +1,700 @@
+package pdf
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// SaveLinearized() writes a linearized ("Fast Web View") copy of the
+// file to filename.  As with SaveAs(), only the objects reachable from
+// the trailer's /Root and /Info entries are copied.  The objects are
+// renumbered and reordered so that a viewer reading the file over a
+// slow connection can display the first page after reading only the
+// beginning of the file:
+//
+//	header
+//	linearization parameter dictionary
+//	first-page xref and trailer
+//	document catalog
+//	primary hint stream (page offset and shared object hint tables)
+//	first page and every object it requires
+//	remaining pages, each followed by the objects only it requires
+//	objects shared by more than one of the remaining pages
+//	all other objects
+//	main xref and trailer
+//
+// The layout is computed before anything is written, so every object
+// is serialized twice: once to measure it and once to write it.  Only
+// one object is held in memory at a time, and the contents of large
+// streams are copied from the source file without being held in
+// memory at all.  The receiver is not modified and remains open.
+func (f *file) SaveLinearized(filename string) (err error) {
+	output,err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if x := recover(); x != nil {
+			if err,_ = x.(error); err == nil {
+				err = fmt.Errorf("%v", x)
+			}
+			output.Close()
+			os.Remove(filename)
+		}
+	} ()
+
+	w := bufio.NewWriter(output)
+	newLinearizer(f).linearize(w)
+	if err = w.Flush(); err != nil {
+		panic(err)
+	}
+	return output.Close()
+}
+
+// LinearizeFile() writes a linearized copy of the PDF file named by
+// source to destination as described for SaveLinearized().  The copy
+// is written to a temporary file that replaces destination only when
+// it is complete, so destination may name the source.
+func LinearizeFile(source, destination string) error {
+	info,err := os.Stat(source)
+	if err != nil {
+		return err
+	}
+	f,_,err := OpenFile(source, os.O_RDONLY)
+	if err != nil {
+		return err
+	}
+
+	temporary,err := ioutil.TempFile(filepath.Dir(destination), ".pdfig-")
+	if err != nil {
+		f.Close()
+		return err
+	}
+	temporary.Close()
+
+	err = f.SaveLinearized(temporary.Name())
+	f.Close()
+	if err != nil {
+		os.Remove(temporary.Name())
+		return err
+	}
+	os.Chmod(temporary.Name(), info.Mode().Perm())
+	return os.Rename(temporary.Name(), destination)
+}
+
+// linearizer holds the state required to linearize one source file.
+type linearizer struct {
+	source *file
+
+	// numbers maps source object numbers to output object numbers.
+	numbers map[ObjectNumber]ObjectNumber
+
+	// pages lists, for each page, the source numbers of the page
+	// object and every object it requires, page object first.
+	pages [][]ObjectNumber
+
+	renumbered *renumberedFile
+}
+
+func newLinearizer(source *file) *linearizer {
+	l := &linearizer{
+		source: source,
+		numbers: make(map[ObjectNumber]ObjectNumber, 256)}
+	l.renumbered = &renumberedFile{l}
+	return l
+}
+
+// object() returns the parsed source object with number n.  A missing
+// object is treated as null.  The linearizer doesn't retain the
+// objects.  Objects read again are usually found in the source file's
+// object cache.
+func (l *linearizer) object(n ObjectNumber) Object {
+	o,err := l.source.ProtectedObject(n)
+	if err != nil {
+		return NewNull()
+	}
+	return o
+}
+
+func sortedKeys(d ProtectedDictionary) []string {
+	keys := d.Keys()
+	sort.Strings(keys)
+	return keys
+}
+
+// collect() appends to result the numbers of the objects referenced,
+// directly or indirectly, by o in depth-first order.  Objects in
+// visited are skipped, and objects for which stop() returns true are
+// neither appended nor descended into.
+func (l *linearizer) collect(o Object, visited map[ObjectNumber]bool, stop func(Object) bool, result []ObjectNumber) []ObjectNumber {
+	switch t := o.(type) {
+	case ProtectedIndirect:
+		n := t.ObjectNumber(l.source)
+		if visited[n] {
+			return result
+		}
+		target := l.object(n)
+		if stop != nil && stop(target) {
+			return result
+		}
+		visited[n] = true
+		result = append(result, n)
+		return l.collect(target, visited, stop, result)
+	case ProtectedStream:
+		d := t.Dictionary()
+		for _,key := range sortedKeys(d) {
+			// The length is written as a direct object.
+			if key != "Length" {
+				result = l.collect(d.Get(key), visited, stop, result)
+			}
+		}
+	case ProtectedDictionary:
+		for _,key := range sortedKeys(t) {
+			result = l.collect(t.Get(key), visited, stop, result)
+		}
+	case ProtectedArray:
+		for i:=0; i<t.Size(); i++ {
+			result = l.collect(t.At(i), visited, stop, result)
+		}
+	}
+	return result
+}
+
+// isStructural() returns true for the catalog and the nodes of the
+// page tree, which belong to no particular page.
+func isStructural(o Object) bool {
+	if d,ok := o.(ProtectedDictionary); ok {
+		t,_ := d.GetName("Type")
+		return t == "Catalog" || t == "Pages" || t == "Page"
+	}
+	return false
+}
+
+// findPages() walks the page tree below node and records the objects
+// required by each page, including resources inherited from an
+// ancestor.
+func (l *linearizer) findPages(node Object, inherited Object, visited map[ObjectNumber]bool) {
+	reference,ok := node.(ProtectedIndirect)
+	if !ok {
+		panic(errors.New(`Page tree node isn't an indirect reference`))
+	}
+	n := reference.ObjectNumber(l.source)
+	if visited[n] {
+		panic(errors.New(`Page tree contains a cycle`))
+	}
+	visited[n] = true
+	d,ok := l.object(n).(ProtectedDictionary)
+	if !ok {
+		panic(errors.New(`Page tree node isn't a dictionary`))
+	}
+
+	if t,_ := d.GetName("Type"); t == "Pages" {
+		if resources := d.Get("Resources"); resources != nil {
+			inherited = resources
+		}
+		if kids := d.GetArray("Kids"); kids != nil {
+			for i:=0; i<kids.Size(); i++ {
+				l.findPages(kids.At(i), inherited, visited)
+			}
+		}
+		return
+	}
+
+	objects := []ObjectNumber{n}
+	pageVisited := map[ObjectNumber]bool{n: true}
+	for _,key := range sortedKeys(d) {
+		if key != "Parent" {
+			objects = l.collect(d.Get(key), pageVisited, isStructural, objects)
+		}
+	}
+	if d.Get("Resources") == nil && inherited != nil {
+		objects = l.collect(inherited, pageVisited, isStructural, objects)
+	}
+	l.pages = append(l.pages, objects)
+}
+
+// linearization describes the layout of the output file.
+type linearization struct {
+	// first is the number of the linearization dictionary.  The
+	// catalog and hint stream follow it.  main objects are numbered
+	// from 1.
+	first uint32
+	catalog, info ProtectedIndirect
+	main, firstPage, shared []ObjectNumber
+
+	// private[i] is the number of objects in main belonging only to
+	// page i+1 (including the page object).
+	private []int
+}
+
+func (l *linearizer) plan() *linearization {
+	root,ok := l.source.trailerDictionary.Get("Root").(ProtectedIndirect)
+	if !ok {
+		panic(errors.New(`File has no document catalog`))
+	}
+	catalogNumber := root.ObjectNumber(l.source)
+	catalog,ok := l.object(catalogNumber).(ProtectedDictionary)
+	if !ok || catalog.Get("Pages") == nil {
+		panic(errors.New(`Document catalog has no page tree`))
+	}
+	l.findPages(catalog.Get("Pages"), nil, make(map[ObjectNumber]bool))
+	if len(l.pages) == 0 {
+		panic(errors.New(`Document has no pages`))
+	}
+
+	p := &linearization{catalog: root, firstPage: l.pages[0]}
+	p.info,_ = l.source.trailerDictionary.Get("Info").(ProtectedIndirect)
+
+	assigned := map[ObjectNumber]bool{catalogNumber: true}
+	for _,n := range p.firstPage {
+		assigned[n] = true
+	}
+	usage := make(map[ObjectNumber]int)
+	for _,objects := range l.pages[1:] {
+		for _,n := range objects {
+			usage[n] += 1
+		}
+	}
+
+	for _,objects := range l.pages[1:] {
+		count := 0
+		for _,n := range objects {
+			if !assigned[n] && usage[n] == 1 {
+				p.main = append(p.main, n)
+				assigned[n] = true
+				count += 1
+			}
+		}
+		p.private = append(p.private, count)
+	}
+	for _,objects := range l.pages[1:] {
+		for _,n := range objects {
+			if !assigned[n] {
+				p.main = append(p.main, n)
+				p.shared = append(p.shared, n)
+				assigned[n] = true
+			}
+		}
+	}
+
+	// Everything else reachable from the trailer.
+	visited := make(map[ObjectNumber]bool)
+	var others []ObjectNumber
+	others = l.collect(root, visited, nil, others)
+	if p.info != nil {
+		others = l.collect(p.info, visited, nil, others)
+	}
+	for _,n := range others {
+		if !assigned[n] {
+			p.main = append(p.main, n)
+			assigned[n] = true
+		}
+	}
+
+	for i,n := range p.main {
+		l.numbers[n] = ObjectNumber{uint32(i+1), 0}
+	}
+	p.first = uint32(len(p.main) + 1)
+	l.numbers[catalogNumber] = ObjectNumber{p.first+1, 0}
+	for i,n := range p.firstPage {
+		l.numbers[n] = ObjectNumber{p.first+3+uint32(i), 0}
+	}
+	return p
+}
+
+// serialize() returns the complete serialization of an indirect
+// object, including its "obj" header and "endobj" trailer, as written
+// by gowriter(), and the stream bodies to be copied into it.
+func (l *linearizer) serialize(n ObjectNumber, o Object) ([]byte, []deferredBody) {
+	b := new(serializationBuffer)
+	fmt.Fprintf(b, "%d %d obj\n", n.number, n.generation)
+	o.Serialize(b, l.renumbered)
+	b.WriteString("\nendobj\n")
+	return b.Bytes(), b.bodies
+}
+
+// measure() returns the length of the output serialization of the
+// source object n.
+func (l *linearizer) measure(n ObjectNumber) int64 {
+	return serializedLength(l.serialize(l.numbers[n], l.object(n)))
+}
+
+func serializedLength(serialization []byte, bodies []deferredBody) int64 {
+	length := int64(len(serialization))
+	for _,body := range bodies {
+		length += body.source.size()
+	}
+	return length
+}
+
+// writeSource() writes the source object n, which measure() found to
+// be length bytes long, to w.
+func (l *linearizer) writeSource(w io.Writer, n ObjectNumber, length int64) {
+	serialization,bodies := l.serialize(l.numbers[n], l.object(n))
+	if serializedLength(serialization, bodies) != length {
+		panic(errors.New(`Linearized layout changed size while being written`))
+	}
+	if err := writeWithBodies(w, serialization, bodies); err != nil {
+		panic(err)
+	}
+}
+
+// layout holds the offsets computed for the output file.  The offsets
+// of the objects in the hint tables are adjusted as if the hint stream
+// were absent.
+type layout struct {
+	length, firstXref, hint, hintLength, endOfFirstPage, mainXref int64
+
+	// offsets[i] and lengths[i] are the offset and length of
+	// output object i.
+	offsets, lengths []int64
+}
+
+// adjusted() returns an offset as if the hint stream were absent.
+func (a *layout) adjusted(offset int64) int64 {
+	if offset > a.hint {
+		return offset - a.hintLength
+	}
+	return offset
+}
+
+// linearize() writes the linearized file to w.
+func (l *linearizer) linearize(w io.Writer) {
+	p := l.plan()
+	size := p.first + 3 + uint32(len(p.firstPage))
+	a := layout{offsets: make([]int64, size), lengths: make([]int64, size)}
+	place := func(n uint32, position int64, length int64) int64 {
+		a.offsets[n] = position
+		a.lengths[n] = length
+		return position + length
+	}
+	catalog := p.catalog.ObjectNumber(l.source)
+
+	// All variable values in the linearization dictionary, the
+	// trailer, and the hint stream have fixed widths, so the
+	// layout can be computed from placeholder serializations.
+	header := []byte("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+	position := place(p.first, int64(len(header)), int64(len(l.linearizationDictionary(p, &a))))
+	a.firstXref = position
+	position += int64(len(xrefSection(p.first, a.offsets[p.first:size])))
+	position += int64(len(l.firstPageTrailer(p, &a, size)))
+	position = place(p.first+1, position, l.measure(catalog))
+	a.hint = position
+	a.hintLength = int64(len(l.hintStream(p, &a)))
+	position = place(p.first+2, position, a.hintLength)
+	for i,n := range p.firstPage {
+		position = place(p.first+3+uint32(i), position, l.measure(n))
+	}
+	a.endOfFirstPage = position
+	for i,n := range p.main {
+		position = place(uint32(i+1), position, l.measure(n))
+	}
+	a.mainXref = position
+	position += int64(len(xrefSection(0, a.offsets[0:p.first])))
+	position += int64(len(mainTrailer(p, &a)))
+	a.length = position
+
+	output := &streamStorage{w: w}
+	write := func(b []byte) {
+		if _,err := output.Write(b); err != nil {
+			panic(err)
+		}
+	}
+	write(header)
+	write(l.linearizationDictionary(p, &a))
+	write(xrefSection(p.first, a.offsets[p.first:size]))
+	write(l.firstPageTrailer(p, &a, size))
+	l.writeSource(output, catalog, a.lengths[p.first+1])
+	write(l.hintStream(p, &a))
+	for i,n := range p.firstPage {
+		l.writeSource(output, n, a.lengths[p.first+3+uint32(i)])
+	}
+	for i,n := range p.main {
+		l.writeSource(output, n, a.lengths[i+1])
+	}
+	write(xrefSection(0, a.offsets[0:p.first]))
+	write(mainTrailer(p, &a))
+
+	if output.written != a.length {
+		panic(errors.New(`Linearized layout changed size while being written`))
+	}
+}
+
+// pageObject() returns the output object number of page i.
+func (l *linearizer) pageObject(i int) uint32 {
+	return l.numbers[l.pages[i][0]].number
+}
+
+func (l *linearizer) linearizationDictionary(p *linearization, a *layout) []byte {
+	return []byte(fmt.Sprintf("%d 0 obj\n<</Linearized 1 /L %-10d /H [%-10d %-10d] /O %d /E %-10d /N %d /T %-10d>>\nendobj\n",
+		p.first, a.length, a.hint, a.hintLength, l.pageObject(0), a.endOfFirstPage, len(l.pages),
+		// The white-space character preceding the first entry of
+		// the main xref table.
+		a.mainXref + int64(len(fmt.Sprintf("xref\n0 %d", p.first)))))
+}
+
+// xrefSection() returns a single xref section containing one
+// subsection for len(offsets) objects numbered from first.  Object 0
+// is the head of the free list.
+func xrefSection(first uint32, offsets []int64) []byte {
+	b := new(bytes.Buffer)
+	fmt.Fprintf(b, "xref\n%d %d\n", first, len(offsets))
+	for i,offset := range offsets {
+		entry := xrefEntry{byteOffset: uint64(offset), inUse: true}
+		if first == 0 && i == 0 {
+			entry = xrefEntry{generation: 65535}
+		}
+		entry.Serialize(b)
+	}
+	return b.Bytes()
+}
+
+func (l *linearizer) firstPageTrailer(p *linearization, a *layout, size uint32) []byte {
+	trailer := NewDictionary()
+	trailer.Add("Size", NewIntNumeric(int(size)))
+	trailer.Add("Root", p.catalog)
+	if p.info != nil {
+		trailer.Add("Info", p.info)
+	}
+	if id := l.source.trailerDictionary.Get("ID"); id != nil {
+		trailer.Add("ID", id)
+	}
+	trailer.Add("Prev", newRawObject([]byte(fmt.Sprintf("%-10d", a.mainXref))))
+
+	b := new(bytes.Buffer)
+	b.WriteString("trailer\n")
+	trailer.Serialize(b, l.renumbered)
+	// Readers use the startxref at the end of the file.
+	b.WriteString("\nstartxref\n0\n%%EOF\n")
+	return b.Bytes()
+}
+
+func mainTrailer(p *linearization, a *layout) []byte {
+	return []byte(fmt.Sprintf("trailer\n<</Size %d>>\nstartxref\n%d\n%%%%EOF\n", p.first, a.firstXref))
+}
+
+// bitWriter packs values of arbitrary width, most significant bit
+// first, as required by the hint tables.
+type bitWriter struct {
+	buffer bytes.Buffer
+	current byte
+	count uint
+}
+
+func (w *bitWriter) write(value int64, bits uint) {
+	for i:=bits; i>0; i-- {
+		w.current = w.current<<1 | byte(uint64(value)>>(i-1)&1)
+		w.count += 1
+		if w.count == 8 {
+			w.buffer.WriteByte(w.current)
+			w.current,w.count = 0,0
+		}
+	}
+}
+
+// flush() pads the last byte with zero bits.  Each row of a hint
+// table begins on a byte boundary.
+func (w *bitWriter) flush() {
+	if w.count > 0 {
+		w.buffer.WriteByte(w.current << (8-w.count))
+		w.current,w.count = 0,0
+	}
+}
+
+// Every variable item of the hint tables uses hintBits bits so that
+// the size of the hint stream doesn't depend on the layout.
+const hintBits = 32
+
+func minimum(values []int64) int64 {
+	result := values[0]
+	for _,v := range values[1:] {
+		if v < result {
+			result = v
+		}
+	}
+	return result
+}
+
+func (l *linearizer) hintStream(p *linearization, a *layout) []byte {
+	first := p.first+3
+	// Identifiers of the shared object hint table entries: the
+	// objects of the first page followed by the shared objects.
+	identifiers := make(map[ObjectNumber]int64, len(p.firstPage)+len(p.shared))
+	groupLengths := make([]int64, 0, len(p.firstPage)+len(p.shared))
+	for i,n := range p.firstPage {
+		identifiers[n] = int64(i)
+		groupLengths = append(groupLengths, a.lengths[first+uint32(i)])
+	}
+	for i,n := range p.shared {
+		identifiers[n] = int64(len(p.firstPage)+i)
+		groupLengths = append(groupLengths, a.lengths[l.numbers[n].number])
+	}
+
+	pageCount := len(l.pages)
+	objectCounts := make([]int64, pageCount)
+	pageOffsets := make([]int64, pageCount)
+	pageLengths := make([]int64, pageCount)
+	references := make([][]int64, pageCount)
+	objectCounts[0] = int64(len(p.firstPage))
+	pageOffsets[0] = a.offsets[first]
+	pageLengths[0] = a.endOfFirstPage - pageOffsets[0]
+	next := uint32(1)
+	for i:=1; i<pageCount; i++ {
+		objectCounts[i] = int64(p.private[i-1])
+		pageOffsets[i] = a.offsets[next]
+		for j:=0; j<p.private[i-1]; j++ {
+			pageLengths[i] += a.lengths[next]
+			next += 1
+		}
+		for _,n := range l.pages[i] {
+			if id,ok := identifiers[n]; ok {
+				references[i] = append(references[i], id)
+			}
+		}
+	}
+
+	// Page offset hint table
+	w := new(bitWriter)
+	leastObjects := minimum(objectCounts)
+	leastLength := minimum(pageLengths)
+	w.write(leastObjects, 32)
+	w.write(a.adjusted(pageOffsets[0]), 32)
+	w.write(hintBits, 16)
+	w.write(leastLength, 32)
+	w.write(hintBits, 16)
+	// Content stream offsets aren't recorded; content stream
+	// lengths are taken to be the page lengths.
+	w.write(0, 32)
+	w.write(0, 16)
+	w.write(leastLength, 32)
+	w.write(hintBits, 16)
+	w.write(hintBits, 16)
+	w.write(hintBits, 16)
+	// Numerators of the fractional positions are omitted.
+	w.write(0, 16)
+	w.write(1, 16)
+
+	for _,count := range objectCounts {
+		w.write(count-leastObjects, hintBits)
+	}
+	w.flush()
+	for _,length := range pageLengths {
+		w.write(length-leastLength, hintBits)
+	}
+	w.flush()
+	for _,r := range references {
+		w.write(int64(len(r)), hintBits)
+	}
+	w.flush()
+	for _,r := range references {
+		for _,id := range r {
+			w.write(id, hintBits)
+		}
+	}
+	w.flush()
+	for _,length := range pageLengths {
+		w.write(length-leastLength, hintBits)
+	}
+	w.flush()
+	sharedTableOffset := w.buffer.Len()
+
+	// Shared object hint table
+	var firstShared, firstSharedOffset int64
+	if len(p.shared) > 0 {
+		firstShared = int64(l.numbers[p.shared[0]].number)
+		firstSharedOffset = a.adjusted(a.offsets[firstShared])
+	}
+	leastGroup := minimum(groupLengths)
+	w.write(firstShared, 32)
+	w.write(firstSharedOffset, 32)
+	w.write(int64(len(p.firstPage)), 32)
+	w.write(int64(len(groupLengths)), 32)
+	// Each group contains a single object.
+	w.write(0, 16)
+	w.write(leastGroup, 32)
+	w.write(hintBits, 16)
+	for _,length := range groupLengths {
+		w.write(length-leastGroup, hintBits)
+	}
+	w.flush()
+	// No group has an MD5 signature.
+	for i:=0; i<len(groupLengths); i++ {
+		w.write(0, 1)
+	}
+	w.flush()
+
+	s := NewStream()
+	s.Add("S", NewIntNumeric(sharedTableOffset))
+	s.Write(w.buffer.Bytes())
+	serialization,_ := l.serialize(ObjectNumber{p.first+2, 0}, s)
+	return serialization
+}
+
+// renumberedFile is a File used only to serialize objects read from a
+// linearizer's source file.  References are rendered with the object
+// numbers assigned by the linearizer.
+type renumberedFile struct {
+	l *linearizer
+}
+
+func (r *renumberedFile) ReserveObjectNumber(i Indirect) ObjectNumber {
+	n,ok := r.l.numbers[i.ObjectNumber(r.l.source)]
+	if !ok {
+		panic(fmt.Errorf(`Object %v isn't part of the linearized file`, i.ObjectNumber(r.l.source)))
+	}
+	return n
+}
+
+// WriteObjectAt() does nothing.  The linearizer writes the objects.
+func (r *renumberedFile) WriteObjectAt(ObjectNumber, Object) error {
+	return nil
+}
+
+func (r *renumberedFile) Object(o ObjectNumber) (Object, error) {
+	return nil, errors.New(`Objects can't be read from a renumbered file`)
+}
+
+func (r *renumberedFile) WriteObject(Object) (Indirect, error) {
+	panic(errors.New(`Objects can't be added to a renumbered file`))
+}
+
+func (r *renumberedFile) Indirect(o ObjectNumber) Indirect {
+	return newIndirectWithNumber(o, r)
+}
+
+func (r *renumberedFile) DeleteObject(Indirect) {
+	panic(errors.New(`Objects can't be deleted from a renumbered file`))
+}
+
+func (r *renumberedFile) Info() Dictionary {
+	return nil
+}
+
+func (r *renumberedFile) Catalog() ProtectedDictionary {
+	return nil
+}
+
+func (r *renumberedFile) SetCatalog(Dictionary) {
+}
+
+func (r *renumberedFile) SetInfo(DocumentInfo) {
+}
+
+func (r *renumberedFile) Trailer() ProtectedDictionary {
+	return NewDictionary().Protect().(ProtectedDictionary)
+}
+
+func (r *renumberedFile) Close() error {
+	return nil
+}
+
+func (r *renumberedFile) Closed() bool {
+	return false
+}
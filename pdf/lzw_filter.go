@@ -1,74 +1,282 @@
 package pdf
 
-import ( //"errors"
-	"compress/lzw"
-//	"fmt"
+import (
+	"bufio"
+	"errors"
 	"io")
 
+// LZWFilter implements the PDF variant of LZW, which uses 8-bit
+// literals, a clear-table code of 256, an end-of-data code of 257,
+// and codes of 9 to 12 bits, most significant bit first.  The Go LZW
+// library can't be used because with the PDF default of EarlyChange
+// 1, code widths increase one code earlier than in other variants.
+// NewLZWFilter() returns a filter using that default; the zero value
+// (for example, new(LZWFilter)) uses EarlyChange 0.
 type LZWFilter struct {
+	predictor predictor
+	earlyChange int
 }
 
 const ( lzwDecoderName = "LZWDecode" )
 
+const (
+	lzwClear = 256
+	lzwEOD = 257
+	lzwFirstCode = 258
+	lzwMaxWidth = 12
+	lzwTableSize = 1 << lzwMaxWidth )
+
 func init () {
 	RegisterFilterFactoryFactory(lzwDecoderName,
 		func(d ProtectedDictionary) StreamFilterFactory {
+			filter := &LZWFilter{newPredictor(d), 1}
 			if d != nil {
 				if v,ok := d.GetInt("EarlyChange"); ok && v == 0 {
-					return new(LZWFilter) }
+					filter.earlyChange = 0
+				}
 			}
-			return nil
+			return filter
 		})
 }
 
-func (filter LZWFilter) Name() string {
+// NewLZWFilter() returns an LZW filter with the PDF default
+// EarlyChange of 1 and no predictor.
+func NewLZWFilter() *LZWFilter {
+	return &LZWFilter{newPredictor(nil), 1}
+}
+
+func (filter *LZWFilter) Name() string {
 	return lzwDecoderName
 }
 
-func (filter LZWFilter) NewEncoder(writer io.WriteCloser) io.WriteCloser {
-	lzwWriter := lzw.NewWriter(writer,lzw.MSB, 8)
-	return &LZWWriter{lzwWriter,writer}
+// SetPredictor() causes the encoder to apply a predictor.  See
+// FlateFilter.SetPredictor().
+func (filter *LZWFilter) SetPredictor(predictor, colors, bitsPerComponent, columns int) {
+	filter.predictor = newPredictorWithParameters(predictor, colors, bitsPerComponent, columns)
+}
+
+// SetEarlyChange() sets the EarlyChange parameter.  It is 1 (the PDF
+// default) for a filter returned by NewLZWFilter() or by
+// FilterFactory() for DecodeParms without an EarlyChange entry, and 0
+// for the zero value, new(LZWFilter).
+func (filter *LZWFilter) SetEarlyChange(earlyChange int) {
+	if earlyChange != 0 {
+		earlyChange = 1
+	}
+	filter.earlyChange = earlyChange
+}
+
+func (filter *LZWFilter) NewEncoder(writer io.WriteCloser) io.WriteCloser {
+	return newPredictorWriter(newLZWWriter(writer, filter.earlyChange), filter.predictor)
 }
 
-func (filter LZWFilter) NewDecoder(reader io.Reader) io.Reader {
-	lzwReader := lzw.NewReader(reader,lzw.MSB, 8)
-	return &LZWReader{lzwReader}
+func (filter *LZWFilter) NewDecoder(reader io.Reader) io.Reader {
+	return newPredictorReader(newLZWReader(reader, filter.earlyChange), filter.predictor)
 }
 
-func (filter LZWFilter) DecodeParms(file ...File) Object {
+func (filter *LZWFilter) DecodeParms(file ...File) Object {
+	if filter.earlyChange == 1 && !filter.predictor.enabled() {
+		return NewNull()
+	}
 	d := NewDictionary()
-	// This parameter is necessary due to an incompability between
-	// the Go LZW library and the default value in the PDF spec.
-	// Unfortunately, this means we cannot decode PDF created with
-	// the default value.
-	d.Add ("EarlyChange", NewIntNumeric(0))
+	if filter.earlyChange == 0 {
+		d.Add ("EarlyChange", NewIntNumeric(0))
+	}
+	if filter.predictor.enabled() {
+		filter.predictor.addDecodeParms(d)
+	}
 	return d
 }
 
+// lzwWidth() returns the width of the code read after the decoder's
+// table has grown to nextCode entries.
+func lzwWidth(nextCode, earlyChange int) uint {
+	width := uint(9)
+	for width < lzwMaxWidth && nextCode + earlyChange >= 1<<width {
+		width += 1
+	}
+	return width
+}
+
 type LZWWriter struct {
-	io.WriteCloser
-	output io.WriteCloser
+	writer io.WriteCloser
+	earlyChange int
+	table map[int]int
+	nextCode int
+	// current is the code for the input that hasn't been
+	// written, or -1 if there is none.
+	current int
+	// emitted is the number of codes written since the table
+	// was cleared, which determines the decoder's table size.
+	emitted int
+	bits uint32
+	nBits uint
+	err error
+}
+
+func newLZWWriter(writer io.WriteCloser, earlyChange int) *LZWWriter {
+	w := &LZWWriter{writer: writer, earlyChange: earlyChange, current: -1}
+	w.writeCode(lzwClear)
+	return w
 }
 
 func (w *LZWWriter) Write(buffer []byte) (n int, err error) {
-	// LZW Write() appears to have an off-by-one error.  It
-	// reports one less than the number of bytes actually written.
-	n,err = w.WriteCloser.Write(buffer)
-	if err == nil {
-		n = len(buffer)
+	for _,b := range buffer {
+		if w.err != nil {
+			return n,w.err
+		}
+		n += 1
+		if w.current < 0 {
+			w.current = int(b)
+			continue
+		}
+		key := w.current<<8 | int(b)
+		if code,ok := w.table[key]; ok {
+			w.current = code
+			continue
+		}
+		w.writeCode(w.current)
+		w.table[key] = w.nextCode
+		w.nextCode += 1
+		w.current = int(b)
+		// Start over before the decoder's codes get too wide.
+		if w.nextCode >= lzwTableSize - 2 {
+			w.writeCode(lzwClear)
+		}
+	}
+	return n,w.err
+}
+
+// writeCode() writes a code using the width the decoder will expect.
+func (w *LZWWriter) writeCode(code int) {
+	decoderNextCode := lzwFirstCode
+	if w.emitted > 1 {
+		decoderNextCode += w.emitted - 1
+	}
+	width := lzwWidth(decoderNextCode, w.earlyChange)
+	w.bits |= uint32(code) << (32 - width - w.nBits)
+	w.nBits += width
+	w.emitted += 1
+	w.flush(false)
+
+	if code == lzwClear {
+		w.table = make(map[int]int)
+		w.nextCode = lzwFirstCode
+		w.emitted = 0
+	}
+}
+
+// flush() writes whole bytes (and with final, a partial byte) of
+// pending bits.
+func (w *LZWWriter) flush(final bool) {
+	var buffer [4]byte
+	n := 0
+	for w.nBits >= 8 || (final && w.nBits > 0) {
+		buffer[n] = byte(w.bits >> 24)
+		n += 1
+		w.bits <<= 8
+		if w.nBits >= 8 {
+			w.nBits -= 8
+		} else {
+			w.nBits = 0
+		}
+	}
+	if n > 0 && w.err == nil {
+		_,w.err = w.writer.Write(buffer[:n])
 	}
-	return n,err
 }
 
 func (w *LZWWriter) Close() error {
-	if err := w.WriteCloser.Close(); err != nil {
-		return err
+	if w.current >= 0 {
+		w.writeCode(w.current)
+		w.current = -1
+	}
+	w.writeCode(lzwEOD)
+	w.flush(true)
+	if w.err != nil {
+		return w.err
 	}
-	return w.output.Close()
+	return w.writer.Close()
 }
 
 type LZWReader struct {
-	io.Reader
+	reader io.ByteReader
+	earlyChange int
+	// table holds the string for each code above 257.
+	table [][]byte
+	previous []byte
+	unread []byte
+	bits uint32
+	nBits uint
+	err error
+}
+
+func newLZWReader(reader io.Reader, earlyChange int) *LZWReader {
+	byteReader,ok := reader.(io.ByteReader)
+	if !ok {
+		byteReader = bufio.NewReader(reader)
+	}
+	return &LZWReader{
+		reader: byteReader,
+		earlyChange: earlyChange,
+		table: make([][]byte, lzwFirstCode, lzwTableSize)}
 }
 
+func (r *LZWReader) Read(buffer []byte) (n int, err error) {
+	for n < len(buffer) {
+		if len(r.unread) == 0 {
+			if r.err != nil {
+				return n,r.err
+			}
+			r.readCode()
+			continue
+		}
+		m := copy(buffer[n:], r.unread)
+		r.unread = r.unread[m:]
+		n += m
+	}
+	return n,nil
+}
 
+// readCode() reads the next code and sets unread to its string.  The
+// end of the input is accepted in place of an end-of-data code.
+func (r *LZWReader) readCode() {
+	width := lzwWidth(len(r.table), r.earlyChange)
+	for r.nBits < width {
+		b,err := r.reader.ReadByte()
+		if err != nil {
+			r.err = err
+			return
+		}
+		r.bits |= uint32(b) << (24 - r.nBits)
+		r.nBits += 8
+	}
+	code := int(r.bits >> (32 - width))
+	r.bits <<= width
+	r.nBits -= width
+
+	var entry []byte
+	switch {
+	case code == lzwClear:
+		r.table = r.table[:lzwFirstCode]
+		r.previous = nil
+		return
+	case code == lzwEOD:
+		r.err = io.EOF
+		return
+	case code < lzwClear:
+		entry = []byte{byte(code)}
+	case code < len(r.table):
+		entry = r.table[code]
+	case code == len(r.table) && r.previous != nil:
+		entry = append(append([]byte(nil), r.previous...), r.previous[0])
+	default:
+		r.err = errors.New(`Invalid LZW code`)
+		return
+	}
+	if r.previous != nil && len(r.table) < lzwTableSize {
+		r.table = append(r.table, append(append(make([]byte, 0, len(r.previous)+1), r.previous...), entry[0]))
+	}
+	r.previous = entry
+	r.unread = entry
+}
@@ -0,0 +1,248 @@
+package pdf
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// memoryStorage is a storage held entirely in memory.  ReadAt() may
+// be called while another goroutine writes.
+type memoryStorage struct {
+	data []byte
+	position int64
+	lock sync.RWMutex
+}
+
+func (s *memoryStorage) Read(b []byte) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.position >= int64(len(s.data)) {
+		return 0, io.EOF
+	}
+	n := copy(b, s.data[s.position:])
+	s.position += int64(n)
+	return n, nil
+}
+
+func (s *memoryStorage) ReadAt(b []byte, offset int64) (int, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if offset < 0 || offset >= int64(len(s.data)) {
+		return 0, io.EOF
+	}
+	n := copy(b, s.data[offset:])
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (s *memoryStorage) Write(b []byte) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if end := s.position + int64(len(b)); end > int64(len(s.data)) {
+		if end > int64(cap(s.data)) {
+			data := make([]byte, len(s.data), 2*end)
+			copy(data, s.data)
+			s.data = data
+		}
+		s.data = s.data[:end]
+	}
+	n := copy(s.data[s.position:], b)
+	s.position += int64(n)
+	return n, nil
+}
+
+func (s *memoryStorage) Seek(offset int64, whence int) (int64, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	switch whence {
+	case os.SEEK_CUR:
+		offset += s.position
+	case os.SEEK_END:
+		offset += int64(len(s.data))
+	}
+	if offset < 0 {
+		return s.position, errors.New(`Seek to a negative position`)
+	}
+	s.position = offset
+	return offset, nil
+}
+
+// Truncate() discards the data beyond size.
+func (s *memoryStorage) Truncate(size int64) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if size < int64(len(s.data)) {
+		s.data = s.data[:size]
+	}
+	return nil
+}
+
+func (s *memoryStorage) Close() error {
+	return nil
+}
+
+// streamStorage is a write-only storage over an io.Writer such as a
+// pipe, a socket, or an http.ResponseWriter.  It never seeks.  It
+// counts the bytes written so that the offsets of objects are known,
+// and Seek() supports only requests for the current position.
+type streamStorage struct {
+	w io.Writer
+	written int64
+}
+
+func (s *streamStorage) Write(b []byte) (int, error) {
+	n,err := s.w.Write(b)
+	s.written += int64(n)
+	return n, err
+}
+
+func (s *streamStorage) Seek(offset int64, whence int) (int64, error) {
+	if offset != 0 || whence == os.SEEK_SET {
+		return s.written, errors.New(`Can't seek in a write-only file`)
+	}
+	return s.written, nil
+}
+
+func (s *streamStorage) Read(b []byte) (int, error) {
+	return 0, errors.New(`Can't read from a write-only file`)
+}
+
+func (s *streamStorage) ReadAt(b []byte, offset int64) (int, error) {
+	return 0, errors.New(`Can't read from a write-only file`)
+}
+
+// Close() does nothing.  The io.Writer belongs to the caller.
+func (s *streamStorage) Close() error {
+	return nil
+}
+
+// seekerStorage adapts an io.ReadWriteSeeker to a storage.  ReadAt()
+// is implemented with Seek() and Read() unless the io.ReadWriteSeeker
+// also implements io.ReaderAt.  Close() closes it if it implements
+// io.Closer.  Every method holds lock because the io.ReadWriteSeeker
+// needn't be safe for concurrent use and ReadAt() may be called while
+// the writer is writing.
+type seekerStorage struct {
+	rws io.ReadWriteSeeker
+	lock sync.Mutex
+}
+
+func (s *seekerStorage) Read(b []byte) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.rws.Read(b)
+}
+
+func (s *seekerStorage) Write(b []byte) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.rws.Write(b)
+}
+
+func (s *seekerStorage) Seek(offset int64, whence int) (int64, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.rws.Seek(offset, whence)
+}
+
+func (s *seekerStorage) ReadAt(b []byte, offset int64) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if r,ok := s.rws.(io.ReaderAt); ok {
+		return r.ReadAt(b, offset)
+	}
+	position,err := s.rws.Seek(0, os.SEEK_CUR)
+	if err != nil {
+		return 0, err
+	}
+	defer s.rws.Seek(position, os.SEEK_SET)
+	if _,err = s.rws.Seek(offset, os.SEEK_SET); err != nil {
+		return 0, err
+	}
+	n,err := io.ReadFull(s.rws, b)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// Truncate() truncates the io.ReadWriteSeeker if it has a Truncate()
+// method (as does *os.File).
+func (s *seekerStorage) Truncate(size int64) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if t,ok := s.rws.(interface{ Truncate(int64) error }); ok {
+		return t.Truncate(size)
+	}
+	return errors.New(`Storage can't be truncated`)
+}
+
+func (s *seekerStorage) Close() error {
+	if c,ok := s.rws.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// NewFile() constructs a File over rws, which need not be an
+// *os.File.  If rws is empty, a new PDF file is written to it.
+// Otherwise its contents are read as an existing PDF file and changes
+// are appended as an incremental update.  The file begins at offset 0
+// of rws.  Close() closes rws if it implements io.Closer.
+func NewFile(rws io.ReadWriteSeeker) (result *file,exists bool,err error) {
+	defer func() {
+		if x := recover(); x != nil {
+			if err,_ = x.(error); err == nil {
+				err = fmt.Errorf("%v", x)
+			}
+			result = nil
+		}
+	} ()
+	result,exists = newFile(&seekerStorage{rws: rws}, os.O_RDWR, 0, false)
+	return result, exists, nil
+}
+
+// NewFileWriter() constructs a new, write-only File that streams its
+// contents to w, which needn't support seeking.  Each object is
+// written to w as soon as the File's writer reaches it and is then
+// discarded, so memory use doesn't grow with the size of the
+// document's contents.  Objects that have been written can't be read
+// back, so Object() returns an error for them.  Close() writes the
+// xref and trailer but doesn't close w.
+func NewFileWriter(w io.Writer) *file {
+	result,_ := newFile(&streamStorage{w: w}, os.O_WRONLY, 0, false)
+	result.writeOnly = true
+	return result
+}
+
+// OpenBytes() constructs a read-only File from the contents of a PDF
+// file held in memory.  See OpenReaderAt().
+func OpenBytes(b []byte) (*file, error) {
+	return OpenReaderAt(&memoryStorage{data: b}, int64(len(b)))
+}
+
+// NewDocument() constructs a Document over rws.  See NewFile().
+func NewDocument(rws io.ReadWriteSeeker) (*Document, error) {
+	f,exists,err := NewFile(rws)
+	if err != nil {
+		return nil, err
+	}
+	return newDocument(f, exists), nil
+}
+
+// NewDocumentWriter() constructs a new, write-only Document that
+// streams its contents to w.  See NewFileWriter().
+func NewDocumentWriter(w io.Writer) *Document {
+	return newDocument(NewFileWriter(w), false)
+}
+
+// OpenDocumentBytes() constructs a read-only Document from the contents
+// of a PDF file held in memory.  See OpenReaderAt().
+func OpenDocumentBytes(b []byte) (*Document, error) {
+	return OpenDocumentReaderAt(&memoryStorage{data: b}, int64(len(b)))
+}
@@ -15,8 +15,9 @@ func NewMockFile(obj uint32, gen uint16) File {
 // Public methods
 
 // Implements Close() in File interface
-func (f *mockFile) Close() {
+func (f *mockFile) Close() error {
 	f.closed = true
+	return nil
 }
 
 func (f *mockFile) Closed() bool {
@@ -24,11 +25,13 @@ func (f *mockFile) Closed() bool {
 }
 
 // Implements WriteObject() in File interface
-func (f *mockFile) WriteObject(object Object) (reference Indirect) {
+func (f *mockFile) WriteObject(object Object) (reference Indirect, err error) {
 	return NewIndirect(f).Write(object)
 }
 // Implements WriteObjectAt() in File interface
-func (f *mockFile) WriteObjectAt(ObjectNumber, Object) {}
+func (f *mockFile) WriteObjectAt(ObjectNumber, Object) error {
+	return nil
+}
 
 // Indirect() is required to implement File interface
 func (f *mockFile) Indirect(o ObjectNumber) Indirect {
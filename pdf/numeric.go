@@ -131,3 +131,19 @@ func NewNumeric(v float64) (result Object) {
 
 	return result
 }
+
+// floatValue() returns the value of an IntNumeric or RealNumeric
+// (dereferencing as necessary) as a float64.  The boolean return
+// value indicates whether the object was numeric.
+func floatValue(o Object) (float64,bool) {
+	if o == nil {
+		return 0, false
+	}
+	switch n := o.Dereference().(type) {
+	case *IntNumeric:
+		return float64(n.Value()),true
+	case *RealNumeric:
+		return float64(n.Value()),true
+	}
+	return 0, false
+}
@@ -1,7 +1,8 @@
 package pdf
 
 import ("errors"
-	"strconv")
+	"strconv"
+	"sync")
 
 type Page struct {
 	fileList []File
@@ -12,23 +13,45 @@ type Page struct {
 	resources, fontResources Dictionary
 
 	fontMap map[Font] string
+
+	// reference is nil until Finish() is called unless the page
+	// was created with Document.NewConcurrentPage(), in which
+	// case it is the reference already placed in the page tree.
+	reference Indirect
+	// lock makes Finish() safe to call more than once from
+	// different goroutines.
+	lock sync.Mutex
 }
 
 // There is no constructor here.  Pages are created by a PageFactory.New().
 
+// Finish() writes the page and returns a reference to its page
+// dictionary.  Calls after the first return the same reference.
 func (p *Page) Finish() Indirect {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.dictionary == nil {
+		return p.reference
+	}
+	if p.reference == nil {
+		p.reference = NewIndirect(p.fileList...)
+	}
+
 	if (p.fontResources != nil) {
 		p.resources.Add("Font", p.fontResources)
 		p.fontResources = nil
 	}
 
-	p.dictionary.SetResources(NewIndirect(p.fileList...).Write(p.resources))
+	// Write errors are reported by the files' Close().
+	resources,_ := NewIndirect(p.fileList...).Write(p.resources)
+	p.dictionary.SetResources(resources)
 	p.resources = nil
 
-	p.dictionary.SetContents(NewIndirect(p.fileList...).Write(p.contents))
+	contents,_ := NewIndirect(p.fileList...).Write(p.contents)
+	p.dictionary.SetContents(contents)
 	p.contents = nil
 
-	indirect := p.dictionary.Write(NewIndirect(p.fileList...))
+	indirect := p.dictionary.Write(p.reference)
 	p.dictionary = nil
 
 	return indirect
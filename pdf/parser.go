@@ -1,9 +1,12 @@
 package pdf
 
 import (
+	"bufio"
+	"bytes"
 	"fmt"
 	"io"
 	"errors"
+	"math"
 	"github.com/mawicks/PDFiG/readers"
 	"strconv" )
 
@@ -16,13 +19,72 @@ type Scanner interface {
 type Parser struct {
 	scanner *readers.HistoryReader
 	queuedObject Object
+	// base is the offset of the scanner's first byte in the
+	// input, which is added to the offsets in a ParseError.
+	base int64
+	// source, if not nil, is the input the scanner reads.  Large
+	// streams are left in source rather than being read.
+	source io.ReaderAt
 }
 
 // NewParser constructs a new parser from the passed Scanner.
 // Typically Scanner will be the pdf.File's underlying os.File, but
 // this is not strictly necessary.
 func NewParser(scanner Scanner) *Parser {
-	return &Parser{readers.NewHistoryReader(scanner,64),nil}
+	return NewParserAt(scanner, 0)
+}
+
+// NewParserAt is like NewParser but the Scanner's first byte is at
+// offset in a larger input, such as a file, so that errors report
+// offsets in that input.
+func NewParserAt(scanner Scanner, offset int64) *Parser {
+	return &Parser{readers.NewHistoryReader(scanner,64),nil,offset,nil}
+}
+
+// newFileParser() constructs a Parser that reads source starting at
+// offset.  Streams longer than lazyStreamThreshold are returned with
+// their contents left in source.
+func newFileParser(source io.ReaderAt, offset int64) *Parser {
+	p := NewParserAt(sourceScanner(source, offset), offset)
+	p.source = source
+	return p
+}
+
+func sourceScanner(source io.ReaderAt, offset int64) Scanner {
+	return bufio.NewReader(io.NewSectionReader(source, offset, math.MaxInt64-offset))
+}
+
+// ParseError describes a syntax error detected by a Parser.  Err is
+// one of the parser's generic errors; the other fields locate the
+// error in the input.
+type ParseError struct {
+	// Offset is the byte offset of the unexpected input.
+	Offset int64
+	// Line is the line number of the unexpected input counting
+	// from the first line the Parser read, or from the end of the
+	// last stream it skipped without reading.
+	Line int
+	// Expected describes the input the Parser expected.  It may
+	// be empty.
+	Expected string
+	// Found is the unexpected token or "end of input".
+	Found string
+	// Context contains the input leading up to and including
+	// Found.
+	Context []byte
+	Err error
+}
+
+func (e *ParseError) Error() string {
+	message := fmt.Sprintf("%v at offset %d (line %d)", e.Err, e.Offset, e.Line)
+	if e.Expected != "" {
+		message += fmt.Sprintf(": expected %s but found %q", e.Expected, e.Found)
+	}
+	return message
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
 }
 
 var (
@@ -35,7 +97,21 @@ var (
 	unexpectedInput = errors.New(`Unexpected character or end of input`)
 	expectedGreaterThan = errors.New(`Expected ">"`)
 	expectingHexDigit = errors.New(`Expecting hex digit`)
-	expectingOctalDigit = errors.New(`Expecting octal digit`) )
+	expectingOctalDigit = errors.New(`Expecting octal digit`)
+	unexpectedHeader = errors.New(`Invalid object header`)
+	missingEndobj = errors.New(`Missing "endobj"`) )
+
+// expectedInput describes the input that was expected when one of the
+// parser's errors occurs.
+var expectedInput = map[error]string {
+	invalidKeyword: `"true", "false", or "null"`,
+	expectingDigit: `digit`,
+	expectingName: `name`,
+	unexpectedEnd: `more input`,
+	unexpectedInput: `object`,
+	expectedGreaterThan: `">"`,
+	expectingHexDigit: `hex digit`,
+	expectingOctalDigit: `octal digit` }
 
 // Skip white space and return the byte following the white space or error.
 // If err is non-nil, the value of b is undefined.
@@ -330,39 +406,156 @@ func (p *Parser) scanDictionary(file... File) Dictionary {
 }
 
 func (p *Parser) scanDictionaryOrStream (file... File) Object {
-	var err error
-
 	dictionary := p.scanDictionary(file...)
 
-	var b byte
-	b,err = nextNonWhiteByte(p.scanner)
-	p.scanner.UnreadByte()
+	// Could be a "stream" keyword.
+	b,err := nextNonWhiteByte(p.scanner)
+	if err != nil {
+		return dictionary
+	}
+	if b != 's' {
+		p.scanner.UnreadByte()
+		return dictionary
+	}
+	keyword,_ := scanKeyword(p.scanner, b)
+	if keyword != "stream" {
+		p.scanner.PushBack([]byte(keyword))
+		return dictionary
+	}
+	skipStreamEOL(p.scanner)
 
-	var s string
-	// Could be a "stream" line.
-	if b=='s' {
-		s,err = ReadLine (p.scanner)
-	}
-
-	var stream Object
-	if err == nil && s == "stream" {
-		v,ok := dictionary.Get("Length").(*IntNumeric)
-		if ok {
-			length := v.Value()
-			contents := make([]byte, length)
-			p.scanner.Read(contents)
-			nextNonWhiteByte(p.scanner)
-			p.scanner.UnreadByte()
-			s,err = ReadLine(p.scanner)
-			if err == nil && s == "endstream" {
-				stream = NewStreamFromContents (dictionary,contents,nil)
-			}
+	length := streamLength(dictionary, file...)
+	if start,ok := p.skipStreamContents(length); ok {
+		dictionary.Add("Length", NewIntNumeric(length))
+		return newLazyStream(dictionary, &fileRange{p.source, start, int64(length)})
+	}
+	contents := p.scanStreamContents(length)
+	// Replace an indirect or incorrect /Length.
+	dictionary.Add("Length", NewIntNumeric(len(contents)))
+	return NewStreamFromContents(dictionary, contents, nil)
+}
+
+// skipStreamEOL() skips the end-of-line marker following the "stream"
+// keyword.  The PDF spec requires CRLF or LF but CR alone and
+// trailing blanks are accepted too.
+func skipStreamEOL(scanner Scanner) {
+	b,err := scanner.ReadByte()
+	for ; err == nil && (b == ' ' || b == '\t'); b,err = scanner.ReadByte() {
+	}
+	switch {
+	case err != nil:
+	case b == '\r':
+		if b,err = scanner.ReadByte(); err == nil && b != '\n' {
+			scanner.UnreadByte()
+		}
+	case b != '\n':
+		scanner.UnreadByte()
+	}
+}
+
+// streamLength() returns the value of the /Length entry of a stream
+// dictionary, which may be an indirect reference resolved through
+// file, or -1 if the length is missing or can't be resolved.
+func streamLength(dictionary Dictionary, file... File) int {
+	var length Object = dictionary.Get("Length")
+	if indirect,ok := length.(Indirect); ok && len(file) > 0 {
+		length,_ = file[0].Object(indirect.ObjectNumber(file[0]))
+	}
+	if v,ok := length.(*IntNumeric); ok && v.Value() >= 0 {
+		return v.Value()
+	}
+	return -1
+}
+
+var endstream = []byte("endstream")
+
+// scanStreamContents() reads stream data and the "endstream" keyword
+// that follows it.  length is trusted if "endstream" follows that
+// many bytes.  If not, or if length is -1, the data ends at the first
+// "endstream" (less the preceding end-of-line marker).
+func (p *Parser) scanStreamContents(length int) []byte {
+	var buffer bytes.Buffer
+	if length >= 0 {
+		// Copy rather than allocating length bytes up front
+		// because a corrupt length can be enormous.
+		n,err := io.CopyN(&buffer, p.scanner, int64(length))
+		if err == nil && p.scanEndstream(&buffer) {
+			return buffer.Bytes()[:n]
 		}
 	}
-	if stream != nil {
-		return stream
+
+	data := buffer.Bytes()
+	index := bytes.Index(data, endstream)
+	for index < 0 {
+		b,err := p.scanner.ReadByte()
+		if err != nil {
+			panic(unexpectedEnd)
+		}
+		data = append(data, b)
+		if bytes.HasSuffix(data, endstream) {
+			index = len(data) - len(endstream)
+		}
+	}
+	p.scanner.PushBack(data[index+len(endstream):])
+
+	contents := data[:index]
+	switch {
+	case bytes.HasSuffix(contents, []byte("\r\n")):
+		contents = contents[:len(contents)-2]
+	case bytes.HasSuffix(contents, []byte("\n")), bytes.HasSuffix(contents, []byte("\r")):
+		contents = contents[:len(contents)-1]
 	}
-	return dictionary
+	return contents
+}
+
+// skipStreamContents() skips the contents of a stream at least
+// lazyStreamThreshold bytes long when reading from a source by
+// restarting the scanner after them.  It returns the offset of the
+// contents and true if "endstream" follows them.  Otherwise the
+// scanner is left alone.
+func (p *Parser) skipStreamContents(length int) (start int64, ok bool) {
+	if p.source == nil || length < lazyStreamThreshold {
+		return 0, false
+	}
+	start = p.base + p.scanner.Offset()
+	end := start + int64(length)
+	scanner,base := p.scanner,p.base
+	p.scanner,p.base = readers.NewHistoryReader(sourceScanner(p.source, end),64),end
+	if !p.scanEndstream(new(bytes.Buffer)) {
+		p.scanner,p.base = scanner,base
+		return 0, false
+	}
+	return start, true
+}
+
+// scanEndstream() reads white space and the "endstream" keyword
+// following the stream data and returns true if they were found.  The
+// bytes read are appended to buffer so that they can be scanned again
+// if the keyword wasn't found.
+func (p *Parser) scanEndstream(buffer *bytes.Buffer) bool {
+	b,err := p.scanner.ReadByte()
+	for ; err == nil && IsWhiteSpace(b); b,err = p.scanner.ReadByte() {
+		buffer.WriteByte(b)
+	}
+	for i:=0; i < len(endstream); i++ {
+		if err != nil {
+			return false
+		}
+		buffer.WriteByte(b)
+		if b != endstream[i] {
+			return false
+		}
+		b,err = p.scanner.ReadByte()
+	}
+	if err == nil {
+		// "endstream" must not be the prefix of a longer token.
+		if IsRegular(b) {
+			buffer.WriteByte(b)
+			return false
+		}
+		p.scanner.UnreadByte()
+	}
+	return true
 }
 
 func (p *Parser) scanObject(file ...File) Object {
@@ -403,18 +596,14 @@ func (p *Parser) scanObject(file ...File) Object {
 }
 
 // Scan() parses an arbitrary object.  If successful, the object is
-// returned.  If not, err is set and context contains the input bytes
-// that preceeded the error.  The optional File argument, of which
+// returned.  If not, err is a *ParseError locating the error, and
+// GetContext() returns the input bytes that preceeded it.  The optional File argument, of which
 // there should be no more than one, indicates the pdf.File to use to
 // resolve indirect object references (e.g., "25 0 R").  If no File is
 // supplied, the input stream may not contain any indirect object
 // references.
 func (p *Parser) Scan(file... File) (o Object,err error) {
-	defer func() {
-		if x := recover(); x!= nil {
-			err,_ = x.(error)
-		}
-	} ()
+	defer p.recoverParseError(&err)
 
 	o = p.scanObject(file...)
 
@@ -427,39 +616,88 @@ func (p *Parser) Scan(file... File) (o Object,err error) {
 // match the passed ObjectNumber.  The optional File argument is as
 // described in Parser.Scan().
 func (p *Parser) ScanIndirect(objectNumber ObjectNumber, file... File) (object Object,err error) {
-	defer func() {
-		if x := recover(); x!= nil {
-			err,_ = x.(error)
-		}
-	} ()
+	defer p.recoverParseError(&err)
 
+	start,line := p.scanner.Offset(),p.scanner.Line()
 	header,_ := ReadLine(p.scanner)
 	var (
 		index uint32
 		generation uint16
 		obj string )
 
+	expected := fmt.Sprintf(`"%d %d obj"`, objectNumber.number, objectNumber.generation)
 	n,err := fmt.Sscanf (header, "%d %d %s", &index, &generation, &obj)
-	if err != nil || n != 3 {
-		panic(errors.New(fmt.Sprintf(`Object header expected but not found at position %p`, p)))
-	}
-	if (objectNumber.number != index || objectNumber.generation != generation) {
-		panic(errors.New(fmt.Sprintf(`Expected "%d %d obj" at location %d but found "%d %d %s"`,
-			objectNumber.number, objectNumber.generation,
-			index, generation, obj)))
+	if err != nil || n != 3 || obj != "obj" ||
+		objectNumber.number != index || objectNumber.generation != generation {
+		panic(p.newParseError(start, line, expected, header, unexpectedHeader))
 	}
 	object = p.scanObject(file...)
 	nextNonWhiteByte(p.scanner)
 	p.scanner.UnreadByte()
 
+	start,line = p.scanner.Offset(),p.scanner.Line()
 	trailer,_ := ReadLine(p.scanner)
 	if trailer != "endobj" {
-		panic(errors.New(fmt.Sprintf(`No "endobj" following object "%d %d obj"`,
-			objectNumber.number, objectNumber.generation)))
+		panic(p.newParseError(start, line, `"endobj"`, trailer, missingEndobj))
 	}
-	return object,err
+	return object,nil
 }
 
+// newParseError() constructs a ParseError for input found at the
+// passed offset (relative to the start of the scanner) and line.
+func (p *Parser) newParseError(offset int64, line int, expected, found string, err error) *ParseError {
+	return &ParseError{
+		Offset: p.base + offset,
+		Line: line,
+		Expected: expected,
+		Found: found,
+		Context: p.GetContext(),
+		Err: err}
+}
+
+// recoverParseError() recovers from a panic in the parser and sets
+// *err to a ParseError describing it.  The scanning functions panic
+// with one of the generic errors above, which are located here using
+// the input that was read last.
+func (p *Parser) recoverParseError(err *error) {
+	x := recover()
+	if x == nil {
+		return
+	}
+	if parseError,ok := x.(*ParseError); ok {
+		*err = parseError
+		return
+	}
+	cause,ok := x.(error)
+	if !ok {
+		cause = fmt.Errorf("%v", x)
+	}
+	found := "end of input"
+	if cause != unexpectedEnd {
+		found = lastToken(p.GetContext())
+	}
+	offset := p.scanner.Offset()
+	if found != "end of input" {
+		offset -= int64(len(found))
+	}
+	*err = p.newParseError(offset, p.scanner.Line(), expectedInput[cause], found, cause)
+}
+
+// lastToken() returns the token at the end of history, which is the
+// trailing run of regular characters or else the last byte.
+func lastToken(history []byte) string {
+	if len(history) == 0 {
+		return "end of input"
+	}
+	i := len(history)
+	for i > 0 && IsRegular(history[i-1]) {
+		i -= 1
+	}
+	if i == len(history) {
+		i -= 1
+	}
+	return string(history[i:])
+}
 
 func (p *Parser) GetContext() []byte {
 	return p.scanner.GetHistory()
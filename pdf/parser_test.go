@@ -60,6 +60,15 @@ func TestParser (t *testing.T) {
 	testParse ("-54321", "-54321")
 	testParse ("<</Length 5>>\nstream\nabcde\nendstream", "<</Length 5>>\nstream\nabcde\nendstream")
 
+	// Streams with end-of-line variants and missing or incorrect lengths.
+	testParse ("<</Length 5>>stream\r\nabcde\r\nendstream", "<</Length 5>>\nstream\nabcde\nendstream")
+	testParse ("<</Length 5>> stream\rabcde\rendstream", "<</Length 5>>\nstream\nabcde\nendstream")
+	testParse ("<</Length 5>>\nstream\nabcdeendstream", "<</Length 5>>\nstream\nabcde\nendstream")
+	testParse ("<</Length 3>>\nstream\nabcde\nendstream", "<</Length 5>>\nstream\nabcde\nendstream")
+	testParse ("<</Length 50>>\nstream\nabcde\nendstream\n", "<</Length 5>>\nstream\nabcde\nendstream")
+	testParse ("<</Length 9 0 R>>\nstream\nabcde\nendstream", "<</Length 5>>\nstream\nabcde\nendstream")
+	testParseIndirect(pdf.NewObjectNumber(4,0), "4 0 obj\n<</Length 99>>\nstream\nabcde\nendstream\nendobj", "<</Length 5>>\nstream\nabcde\nendstream")
+
 	// White space tests.
 	testParse ("[ 1 % Ignore me \n 2 ]", "[1 2]")
 	testParse ("[ 1 % Ignore me \r 2 ]", "[1 2]")
@@ -97,7 +106,42 @@ func TestParser (t *testing.T) {
 	testParseFail("  /a#", "  /a#")
 	testParseFail("  /a#(123)", "  /a#(")
 	testParseFail("falxe  ", "falxe")
+	testParseFail("<</Length 2>>\nstream\nabcde\n", "<</Length 2>>\nstream\nabcde\n")
 
 
 }
 
+
+func TestParseError (t *testing.T) {
+	testError := func(parser *pdf.Parser, err error, offset int64, line int, expected, found string) {
+		parseError,ok := err.(*pdf.ParseError)
+		if !ok {
+			t.Fatalf(`Expected a *ParseError; got %T: %v`, err, err)
+		}
+		if parseError.Offset != offset || parseError.Line != line ||
+			parseError.Expected != expected || parseError.Found != found {
+			t.Errorf(`Got offset %d, line %d, expected %s, found %q; expected offset %d, line %d, expected %s, found %q`,
+				parseError.Offset, parseError.Line, parseError.Expected, parseError.Found,
+				offset, line, expected, found)
+		}
+		if !bytes.Equal(parseError.Context, parser.GetContext()) {
+			t.Errorf(`ParseError context is "%s"; expected "%s"`, parseError.Context, parser.GetContext())
+		}
+	}
+
+	parser := pdf.NewParser(strings.NewReader("[1 2\n  falxe]"))
+	_,err := parser.Scan(mockFile)
+	testError(parser, err, 7, 2, `"true", "false", or "null"`, "falxe")
+
+	parser = pdf.NewParser(strings.NewReader("<</a 1"))
+	_,err = parser.Scan(mockFile)
+	testError(parser, err, 6, 1, "more input", "end of input")
+
+	parser = pdf.NewParserAt(strings.NewReader("5 0 obj\n100\nendobj"), 1000)
+	_,err = parser.ScanIndirect(pdf.NewObjectNumber(4,0), mockFile)
+	testError(parser, err, 1000, 1, `"4 0 obj"`, "5 0 obj")
+
+	parser = pdf.NewParserAt(strings.NewReader("4 0 obj\n100\r\nendobjx"), 1000)
+	_,err = parser.ScanIndirect(pdf.NewObjectNumber(4,0), mockFile)
+	testError(parser, err, 1013, 3, `"endobj"`, "endobjx")
+}
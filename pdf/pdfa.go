@@ -0,0 +1,473 @@
+package pdf
+
+import (
+	"crypto/md5"
+	"fmt"
+	"strings"
+	"sync"
+	"time")
+
+// Conformance is a PDF/A conformance level for the output of a
+// Document.
+type Conformance int
+
+const (
+	NoConformance Conformance = iota
+	// PDFA2B is PDF/A-2b (ISO 19005-2, basic conformance).
+	PDFA2B
+	// PDFA3B is PDF/A-3b (ISO 19005-3, basic conformance), which
+	// also allows arbitrary embedded files.
+	PDFA3B )
+
+// PDFAIdentificationNamespace holds the pdfaid:part and
+// pdfaid:conformance XMP properties.
+const PDFAIdentificationNamespace = "http://www.aiim.org/pdfa/ns/id/"
+
+func (c Conformance) String() string {
+	switch c {
+	case PDFA2B:
+		return "PDF/A-2b"
+	case PDFA3B:
+		return "PDF/A-3b"
+	}
+	return "none"
+}
+
+// part() returns the value of the pdfaid:part property.
+func (c Conformance) part() string {
+	if c == PDFA3B {
+		return "3"
+	}
+	return "2"
+}
+
+// ConformanceError is returned by Document.Close() when the document
+// can't conform to the requested level.  The file isn't written.
+type ConformanceError struct {
+	Conformance Conformance
+	Violations []string
+}
+
+func (e *ConformanceError) Error() string {
+	return fmt.Sprintf(`Document doesn't conform to %v: %s`, e.Conformance, strings.Join(e.Violations, "; "))
+}
+
+// SetConformance() requests output conforming to PDF/A.  Close() adds
+// what the standard requires: an output intent with an sRGB ICC
+// profile, XMP metadata identifying the conformance level, and a
+// trailer /ID.  It then checks the objects reachable from the catalog
+// for what PDF/A forbids, such as fonts that aren't embedded (which
+// includes the standard fonts), LZW compression, encryption,
+// transfer functions, non-standard blend modes, and JavaScript.  If
+// there are violations, Close() returns a *ConformanceError listing
+// them and the output is removed.  The objects of a write-only
+// document (see NewDocumentWriter()) can't be read back, so they are
+// checked as they are written instead, and SetConformance() must be
+// called before anything is written.
+func (d *Document) SetConformance(c Conformance) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.conformance = c
+	d.checker = nil
+	if f,ok := d.file.(*file); ok && f.writeOnly {
+		d.checker = newConformanceChecker(c, f)
+		d.checker.writing = true
+		if !f.setInspector(d.checker.checkWritten) {
+			d.checker.report("document", "SetConformance() was called after objects were written")
+		}
+	}
+}
+
+// finishOutputIntents() adds an sRGB output intent to the catalog if
+// it doesn't have one.
+func (d *Document) finishOutputIntents() {
+	if d.catalog.GetArray("OutputIntents") != nil {
+		return
+	}
+	profile := defaultStreamFactory.New()
+	profile.Add("N", NewIntNumeric(3))
+	profile.Write(sRGBProfile())
+
+	intent := NewDictionary()
+	intent.Add("Type", NewName("OutputIntent"))
+	intent.Add("S", NewName("GTS_PDFA1"))
+	intent.Add("OutputConditionIdentifier", NewTextString(srgbDescription))
+	intent.Add("RegistryName", NewTextString("http://www.color.org"))
+	intent.Add("Info", NewTextString(srgbDescription))
+	profileReference,_ := d.file.WriteObject(profile)
+	intent.Add("DestOutputProfile", profileReference)
+
+	intents := NewArray()
+	intents.Add(intent)
+	d.catalog.Add("OutputIntents", intents)
+}
+
+// finishID() sets the trailer /ID.  An update of an existing
+// document keeps the first (permanent) identifier.
+func (d *Document) finishID() {
+	f,ok := d.file.(*file)
+	if !ok {
+		return
+	}
+	h := md5.New()
+	fmt.Fprintf(h, "%s %d %d", f.filename, f.originalSize, time.Now().UnixNano())
+	if title,ok := d.Title(); ok {
+		fmt.Fprint(h, title)
+	}
+	changing := NewBinaryString(h.Sum(nil))
+	changing.SetSerializer(HexStringSerializer)
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	permanent := changing
+	if id,ok := f.trailerDictionary.Get("ID").(Array); ok && id.Size() == 2 {
+		if s,ok := id.At(0).(String); ok {
+			permanent = s
+		}
+	}
+	id := NewArray()
+	id.Add(permanent)
+	id.Add(changing)
+	f.trailerDictionary.Add("ID", id)
+}
+
+// checkConformance() records a *ConformanceError as the file's error
+// if the document violates its conformance level, so that Close()
+// fails.
+func (d *Document) checkConformance() {
+	c := d.checker
+	if c == nil {
+		c = newConformanceChecker(d.conformance, d.file)
+		c.check(d.catalog.Protect(), "", "catalog")
+	}
+	violations := c.finish()
+	if d.file.Trailer().Get("Encrypt") != nil {
+		violations = append(violations, "trailer: the document is encrypted")
+	}
+	if d.metadata != nil {
+		for _,p := range d.metadata.Properties {
+			if !predefinedSchemas[p.Namespace] && !d.metadata.Declares(p.Namespace, p.Name) {
+				violations = append(violations, fmt.Sprintf("metadata: XMP property %s in namespace %s has no extension schema", p.Name, p.Namespace))
+			}
+		}
+	}
+
+	if len(violations) > 0 {
+		err := &ConformanceError{d.conformance, violations}
+		if f,ok := d.file.(*file); ok {
+			f.setErr(err)
+		}
+	}
+}
+
+// predefinedSchemas are the namespaces of the XMP schemas that PDF/A
+// allows without an extension schema.
+var predefinedSchemas = map[string]bool{
+	DublinCoreNamespace: true,
+	XMPBasicNamespace: true,
+	"http://ns.adobe.com/xap/1.0/rights/": true,
+	"http://ns.adobe.com/xap/1.0/mm/": true,
+	"http://ns.adobe.com/xap/1.0/bj/": true,
+	"http://ns.adobe.com/xap/1.0/t/pg/": true,
+	"http://ns.adobe.com/xmp/1.0/DynamicMedia/": true,
+	AdobePDFNamespace: true,
+	"http://ns.adobe.com/photoshop/1.0/": true,
+	"http://ns.adobe.com/camera-raw-settings/1.0/": true,
+	"http://ns.adobe.com/exif/1.0/": true,
+	"http://ns.adobe.com/exif/1.0/aux/": true,
+	"http://ns.adobe.com/tiff/1.0/": true,
+	PDFAIdentificationNamespace: true,
+	extensionNamespace: true}
+
+// standardBlendModes are the blend modes allowed by PDF/A.
+var standardBlendModes = map[string]bool{
+	"Normal": true, "Compatible": true, "Multiply": true, "Screen": true,
+	"Overlay": true, "Darken": true, "Lighten": true, "ColorDodge": true,
+	"ColorBurn": true, "HardLight": true, "SoftLight": true, "Difference": true,
+	"Exclusion": true, "Hue": true, "Saturation": true, "Color": true,
+	"Luminosity": true}
+
+// forbiddenActions are the action types PDF/A doesn't allow.
+var forbiddenActions = map[string]bool{
+	"Launch": true, "Sound": true, "Movie": true, "ResetForm": true,
+	"ImportData": true, "Hide": true, "SetOCGState": true, "Rendition": true,
+	"Trans": true, "GoTo3DView": true, "JavaScript": true}
+
+// forbiddenAnnotations are the annotation types PDF/A doesn't allow.
+var forbiddenAnnotations = map[string]bool{
+	"Sound": true, "Movie": true, "Screen": true, "3D": true}
+
+// conformanceChecker collects the PDF/A violations of the objects
+// reachable from the catalog, which it walks, or of the objects
+// written to a write-only file, which it checks one at a time.
+type conformanceChecker struct {
+	conformance Conformance
+	file File
+	// writing is true if objects are checked as they are written.
+	// Their indirect references can't be followed.
+	writing bool
+	// visited holds the indirect objects already walked.
+	visited map[Object]bool
+	// descriptors holds the number of each font descriptor checked
+	// while writing and whether it has an embedded font file.
+	// fonts holds the fonts whose descriptors are checked by
+	// finish().
+	descriptors map[ObjectNumber]bool
+	fonts []pendingFont
+	violations []string
+	// lock serializes checkWritten() for pages written in
+	// parallel.
+	lock sync.Mutex
+}
+
+// pendingFont is a font whose indirect font descriptor hadn't
+// necessarily been written when the font was.
+type pendingFont struct {
+	location, name string
+	descriptor ObjectNumber
+}
+
+func newConformanceChecker(conformance Conformance, f File) *conformanceChecker {
+	return &conformanceChecker{
+		conformance: conformance,
+		file: f,
+		visited: make(map[Object]bool),
+		descriptors: make(map[ObjectNumber]bool)}
+}
+
+func (c *conformanceChecker) report(location, format string, args... interface{}) {
+	c.violations = append(c.violations, location + ": " + fmt.Sprintf(format, args...))
+}
+
+// checkWritten() checks an object about to be written to a write-only
+// file.
+func (c *conformanceChecker) checkWritten(n ObjectNumber, o Object) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	location := objectLocation(n)
+	if d,ok := o.Protect().(ProtectedDictionary); ok && d.CheckNameValue("Type", "FontDescriptor") {
+		c.descriptors[n] = hasFontFile(d)
+	}
+	c.check(o.Protect(), "", location)
+}
+
+// finish() returns the violations.
+func (c *conformanceChecker) finish() []string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _,font := range c.fonts {
+		if !c.descriptors[font.descriptor] {
+			c.report(font.location, "font %s isn't embedded", font.name)
+		}
+	}
+	c.fonts = nil
+	return c.violations
+}
+
+func objectLocation(n ObjectNumber) string {
+	return fmt.Sprintf("object %d %d", n.number, n.generation)
+}
+
+// check() checks o, which was found under key.  Objects that aren't
+// indirect are described by the location of the indirect object
+// containing them.
+func (c *conformanceChecker) check(o Object, key, location string) {
+	switch t := o.(type) {
+	case ProtectedIndirect:
+		if c.writing {
+			// The object is checked when it's written.
+			return
+		}
+		// Both an Indirect and its protected view refer to
+		// the same object.
+		var identity Object = t
+		if p,ok := t.(protectedIndirect); ok {
+			identity = p.i
+		}
+		if c.visited[identity] {
+			return
+		}
+		c.visited[identity] = true
+		if t.BoundToFile(c.file) {
+			location = objectLocation(t.ObjectNumber(c.file))
+		}
+		if target := c.dereference(t, location); target != nil {
+			c.check(target, key, location)
+		}
+	case ProtectedStream:
+		d := t.Dictionary()
+		c.checkFilters(d, location)
+		c.checkDictionary(d, key, location)
+	case ProtectedDictionary:
+		c.checkDictionary(t, key, location)
+	case ProtectedArray:
+		for i:=0; i<t.Size(); i++ {
+			c.check(t.At(i), key, location)
+		}
+	}
+}
+
+// dereference() returns nil after reporting an object that can't be
+// read.
+func (c *conformanceChecker) dereference(i ProtectedIndirect, location string) (result Object) {
+	defer func() {
+		if r := recover(); r != nil {
+			c.report(location, "the object can't be read")
+			result = nil
+		}
+	}()
+	return i.Dereference().Protect()
+}
+
+func (c *conformanceChecker) checkFilters(d ProtectedDictionary, location string) {
+	var names []string
+	if filters := d.GetArray("Filter"); filters != nil {
+		for i:=0; i<filters.Size(); i++ {
+			if name,ok := filters.At(i).(Name); ok {
+				names = append(names, name.String())
+			}
+		}
+	} else if name,ok := d.GetName("Filter"); ok {
+		names = append(names, name)
+	}
+	for _,name := range names {
+		if name == "LZWDecode" {
+			c.report(location, "a stream uses LZWDecode")
+		}
+	}
+}
+
+func (c *conformanceChecker) checkDictionary(d ProtectedDictionary, key, location string) {
+	typ,_ := d.GetName("Type")
+	subtype,_ := d.GetName("Subtype")
+
+	// Objects checked while writing aren't found under a key, so
+	// most checks don't depend on it.  The entries of graphics
+	// state parameter dictionaries, which often have no /Type,
+	// appear in no other dictionary.
+	c.checkGraphicsState(d, location)
+	switch {
+	case typ == "Font":
+		c.checkFont(d, subtype, location)
+	case typ == "Action" || typ == "":
+		if s,ok := d.GetName("S"); ok && forbiddenActions[s] {
+			c.report(location, "%s actions aren't allowed", s)
+		}
+	}
+	if typ == "Annot" || key == "Annots" || (typ == "" && subtype != "" && d.Get("Rect") != nil) {
+		c.checkAnnotation(d, subtype, location)
+	}
+	if typ == "EmbeddedFile" && c.conformance == PDFA2B {
+		if mime,_ := d.GetName("Subtype"); mime != "application/pdf" {
+			c.report(location, "embedded files other than PDF/A documents aren't allowed in %v", c.conformance)
+		}
+	}
+	if d.Get("EF") != nil && c.conformance == PDFA3B {
+		if _,ok := d.GetName("AFRelationship"); !ok {
+			c.report(location, "embedded file has no /AFRelationship")
+		}
+	}
+	if d.Get("JavaScript") != nil {
+		c.report(location, "the name dictionary contains JavaScript")
+	}
+
+	switch subtype {
+	case "PS":
+		c.report(location, "PostScript XObjects aren't allowed")
+	case "Form":
+		if s,_ := d.GetName("Subtype2"); s == "PS" {
+			c.report(location, "PostScript XObjects aren't allowed")
+		}
+		if d.Get("Ref") != nil {
+			c.report(location, "reference XObjects aren't allowed")
+		}
+	case "Image":
+		if d.Get("Alternates") != nil {
+			c.report(location, "alternate images aren't allowed")
+		}
+		if interpolate,_ := d.GetBoolean("Interpolate"); interpolate {
+			c.report(location, "image interpolation isn't allowed")
+		}
+	}
+	if d.Get("OPI") != nil {
+		c.report(location, "OPI isn't allowed")
+	}
+	if d.Get("AA") != nil {
+		c.report(location, "additional actions aren't allowed")
+	}
+
+	for _,k := range sortedKeys(d) {
+		// /Parent leads back up the page tree, which is
+		// walked from the top.
+		if k != "Parent" {
+			c.check(d.Get(k), k, location)
+		}
+	}
+}
+
+func (c *conformanceChecker) checkFont(d ProtectedDictionary, subtype, location string) {
+	switch subtype {
+	case "Type1", "MMType1", "TrueType", "CIDFontType0", "CIDFontType2":
+	default:
+		// Type 0 fonts are checked through their descendants
+		// and Type 3 fonts are defined in the document.
+		return
+	}
+	name,_ := d.GetName("BaseFont")
+	if i := d.GetIndirect("FontDescriptor"); i != nil && c.writing {
+		c.fonts = append(c.fonts, pendingFont{location, name, i.ObjectNumber(c.file)})
+		return
+	}
+	if !hasFontFile(d.GetDictionary("FontDescriptor")) {
+		c.report(location, "font %s isn't embedded", name)
+	}
+}
+
+// hasFontFile() returns true if a font descriptor, which may be nil,
+// has an embedded font program.
+func hasFontFile(descriptor ProtectedDictionary) bool {
+	return descriptor != nil && (descriptor.Get("FontFile") != nil ||
+		descriptor.Get("FontFile2") != nil || descriptor.Get("FontFile3") != nil)
+}
+
+func (c *conformanceChecker) checkGraphicsState(d ProtectedDictionary, location string) {
+	if d.Get("TR") != nil {
+		c.report(location, "transfer functions aren't allowed")
+	}
+	if tr2,ok := d.GetName("TR2"); d.Get("TR2") != nil && (!ok || tr2 != "Default") {
+		c.report(location, "transfer functions aren't allowed")
+	}
+	if d.Get("HTO") != nil {
+		c.report(location, "halftone origins aren't allowed")
+	}
+	var modes []string
+	if bm,ok := d.GetName("BM"); ok {
+		modes = append(modes, bm)
+	} else if bm := d.GetArray("BM"); bm != nil {
+		for i:=0; i<bm.Size(); i++ {
+			if name,ok := bm.At(i).(Name); ok {
+				modes = append(modes, name.String())
+			}
+		}
+	}
+	for _,mode := range modes {
+		if !standardBlendModes[mode] {
+			c.report(location, "blend mode %s isn't allowed", mode)
+		}
+	}
+}
+
+func (c *conformanceChecker) checkAnnotation(d ProtectedDictionary, subtype, location string) {
+	if forbiddenAnnotations[subtype] {
+		c.report(location, "%s annotations aren't allowed", subtype)
+		return
+	}
+	if subtype == "Popup" {
+		return
+	}
+	// The Print flag must be set and the Hidden, Invisible,
+	// NoView, and ToggleNoView flags must be clear.
+	if flags,_ := d.GetInt("F"); flags & 4 == 0 || flags & (1|2|32|256) != 0 {
+		c.report(location, "%s annotation isn't printable or is hidden", subtype)
+	}
+}
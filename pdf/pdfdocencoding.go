@@ -1,9 +1,14 @@
 package pdf
 
-import "fmt"
+import (
+	"fmt"
+	"unicode")
 
 var unicodeToPDFDoc map[rune]byte
 
+// pdfDocToUnicode maps the PDFDocEncoding bytes that aren't Latin-1.
+var pdfDocToUnicode map[byte]rune
+
 func init() {
 	var mappings []struct { rune; byte } =  []struct {rune; byte}  {
 		{'\u0000', 0x00}, {'\u0001', 0x00}, {'\u0002', 0x00}, {'\u0003', 0x00},
@@ -24,6 +29,7 @@ func init() {
 		{'\u20ac', 0xa0}, {'\u00ad', 0x00} }
 
 	unicodeToPDFDoc = make(map[rune]byte,82)
+	pdfDocToUnicode = make(map[byte]rune,82)
 	for _,v := range mappings {
 		_,exists := unicodeToPDFDoc[v.rune]
 		if (exists) {
@@ -32,6 +38,7 @@ func init() {
 		unicodeToPDFDoc[v.rune] = v.byte
 
 		if (v.byte != 0x00) {
+			pdfDocToUnicode[v.byte] = v.rune
 			_,exists = unicodeToPDFDoc[rune(v.byte)]
 			if (exists) {
 				panic (fmt.Sprintf("Duplicate value (%x) in PDFDocEncoding mappings", v.byte))
@@ -61,4 +68,19 @@ func PDFDocEncoding (s []rune) ([]byte,bool) {
 		}
 	}
 	return result,ok
-}
\ No newline at end of file
+}
+// PDFDocDecoding() is the inverse of PDFDocEncoding().  Undefined
+// bytes are decoded as U+FFFD.
+func PDFDocDecoding (b []byte) []rune {
+	result := make([]rune, 0, len(b))
+	for _,c := range b {
+		if r,exists := pdfDocToUnicode[c]; exists {
+			result = append(result, r)
+		} else if subst,exists := unicodeToPDFDoc[rune(c)]; exists && subst == 0x00 {
+			result = append(result, unicode.ReplacementChar)
+		} else {
+			result = append(result, rune(c))
+		}
+	}
+	return result
+}
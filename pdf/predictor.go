@@ -0,0 +1,388 @@
+package pdf
+
+import (
+	"errors"
+	"io")
+
+// Predictor values from the DecodeParms of FlateDecode and LZWDecode.
+const (
+	NoPredictor = 1
+	TIFFPredictor = 2
+	PNGNonePredictor = 10
+	PNGSubPredictor = 11
+	PNGUpPredictor = 12
+	PNGAveragePredictor = 13
+	PNGPaethPredictor = 14
+	PNGOptimumPredictor = 15 )
+
+// PNG filter types, which prefix each row of PNG predicted data.
+const (
+	pngNone = iota
+	pngSub
+	pngUp
+	pngAverage
+	pngPaeth )
+
+// predictor holds the DecodeParms entries that control prediction.
+type predictor struct {
+	predictor int
+	colors int
+	bitsPerComponent int
+	columns int
+}
+
+// newPredictor() reads the predictor parameters from a DecodeParms
+// dictionary, which may be nil.
+func newPredictor(d ProtectedDictionary) predictor {
+	p := predictor{NoPredictor, 1, 8, 1}
+	if d != nil {
+		if v,ok := d.GetInt("Predictor"); ok {
+			p.predictor = v
+		}
+		if v,ok := d.GetInt("Colors"); ok && v > 0 {
+			p.colors = v
+		}
+		if v,ok := d.GetInt("BitsPerComponent"); ok && v > 0 {
+			p.bitsPerComponent = v
+		}
+		if v,ok := d.GetInt("Columns"); ok && v > 0 {
+			p.columns = v
+		}
+	}
+	return p
+}
+
+// newPredictorWithParameters() constructs a predictor for an encoder.
+// Parameters that aren't positive get their default values.
+func newPredictorWithParameters(predictorValue, colors, bitsPerComponent, columns int) predictor {
+	p := predictor{predictorValue, colors, bitsPerComponent, columns}
+	if p.predictor > PNGOptimumPredictor || (p.predictor > TIFFPredictor && p.predictor < PNGNonePredictor) {
+		p.predictor = NoPredictor
+	}
+	if p.colors <= 0 {
+		p.colors = 1
+	}
+	if p.bitsPerComponent <= 0 {
+		p.bitsPerComponent = 8
+	}
+	if p.columns <= 0 {
+		p.columns = 1
+	}
+	return p
+}
+
+func (p predictor) enabled() bool {
+	return p.predictor == TIFFPredictor || p.predictor >= PNGNonePredictor
+}
+
+func (p predictor) png() bool {
+	return p.predictor >= PNGNonePredictor
+}
+
+// rowLength() returns the number of bytes in a row of samples.
+func (p predictor) rowLength() int {
+	return (p.colors*p.bitsPerComponent*p.columns + 7) / 8
+}
+
+// pixelLength() returns the number of bytes in a pixel, rounded up
+// to 1, which is the distance to the "left" byte in PNG prediction.
+func (p predictor) pixelLength() int {
+	if n := p.colors*p.bitsPerComponent / 8; n > 1 {
+		return n
+	}
+	return 1
+}
+
+// addDecodeParms() adds the predictor parameters to a DecodeParms
+// dictionary.
+func (p predictor) addDecodeParms(d Dictionary) {
+	d.Add("Predictor", NewIntNumeric(p.predictor))
+	if p.colors != 1 {
+		d.Add("Colors", NewIntNumeric(p.colors))
+	}
+	if p.bitsPerComponent != 8 {
+		d.Add("BitsPerComponent", NewIntNumeric(p.bitsPerComponent))
+	}
+	if p.columns != 1 {
+		d.Add("Columns", NewIntNumeric(p.columns))
+	}
+}
+
+// predictorReader undoes prediction one row at a time.
+type predictorReader struct {
+	reader io.Reader
+	p predictor
+	// row holds the PNG filter type (if any) and the encoded row.
+	row []byte
+	previous, current []byte
+	// unread is the part of current that hasn't been returned.
+	unread []byte
+	err error
+}
+
+func newPredictorReader(reader io.Reader, p predictor) io.Reader {
+	if !p.enabled() {
+		return reader
+	}
+	n := p.rowLength()
+	prefix := 0
+	if p.png() {
+		prefix = 1
+	}
+	return &predictorReader{
+		reader: reader,
+		p: p,
+		row: make([]byte, prefix+n),
+		previous: make([]byte, n),
+		current: make([]byte, n)}
+}
+
+func (pr *predictorReader) Read(buffer []byte) (n int, err error) {
+	for n < len(buffer) {
+		if len(pr.unread) == 0 {
+			if pr.err != nil {
+				return n,pr.err
+			}
+			pr.readRow()
+			continue
+		}
+		m := copy(buffer[n:], pr.unread)
+		pr.unread = pr.unread[m:]
+		n += m
+	}
+	return n,nil
+}
+
+// readRow() reads and decodes the next row.  A final partial row is
+// decoded as far as it goes.
+func (pr *predictorReader) readRow() {
+	m,err := io.ReadFull(pr.reader, pr.row)
+	switch err {
+	case nil:
+	case io.ErrUnexpectedEOF:
+		pr.err = io.EOF
+	default:
+		pr.err = err
+	}
+	if m == 0 {
+		return
+	}
+
+	pr.previous,pr.current = pr.current,pr.previous
+	if pr.p.png() {
+		m -= 1
+		copy(pr.current, pr.row[1:1+m])
+		if err := pngDecode(pr.row[0], pr.current[:m], pr.previous, pr.p.pixelLength()); err != nil {
+			pr.err = err
+			return
+		}
+	} else {
+		copy(pr.current, pr.row[:m])
+		tiffDecode(pr.current[:m], pr.p)
+	}
+	pr.unread = pr.current[:m]
+}
+
+// pngDecode() undoes the PNG filter of the passed type in row, given
+// the previous decoded row.
+func pngDecode(filter byte, row, previous []byte, bpp int) error {
+	switch filter {
+	case pngNone:
+	case pngSub:
+		for i:=bpp; i<len(row); i++ {
+			row[i] += row[i-bpp]
+		}
+	case pngUp:
+		for i:=range row {
+			row[i] += previous[i]
+		}
+	case pngAverage:
+		for i:=range row {
+			left := 0
+			if i >= bpp {
+				left = int(row[i-bpp])
+			}
+			row[i] += byte((left + int(previous[i])) / 2)
+		}
+	case pngPaeth:
+		for i:=range row {
+			var left, upperLeft byte
+			if i >= bpp {
+				left,upperLeft = row[i-bpp],previous[i-bpp]
+			}
+			row[i] += paeth(left, previous[i], upperLeft)
+		}
+	default:
+		return errors.New(`Invalid PNG predictor filter type`)
+	}
+	return nil
+}
+
+func paeth(a, b, c byte) byte {
+	p := int(a) + int(b) - int(c)
+	pa,pb,pc := abs(p-int(a)),abs(p-int(b)),abs(p-int(c))
+	switch {
+	case pa <= pb && pa <= pc:
+		return a
+	case pb <= pc:
+		return b
+	}
+	return c
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+// tiffDecode() undoes TIFF horizontal differencing in a row.
+func tiffDecode(row []byte, p predictor) {
+	samples := len(row)*8 / p.bitsPerComponent
+	for i:=p.colors; i<samples; i++ {
+		setSample(row, i, p.bitsPerComponent, sample(row, i, p.bitsPerComponent) + sample(row, i-p.colors, p.bitsPerComponent))
+	}
+}
+
+// tiffEncode() applies TIFF horizontal differencing to a row.
+func tiffEncode(row []byte, p predictor) {
+	samples := len(row)*8 / p.bitsPerComponent
+	for i:=samples-1; i>=p.colors; i-- {
+		setSample(row, i, p.bitsPerComponent, sample(row, i, p.bitsPerComponent) - sample(row, i-p.colors, p.bitsPerComponent))
+	}
+}
+
+// sample() returns the i'th sample of a row with bpc bits per sample.
+func sample(row []byte, i, bpc int) uint {
+	switch {
+	case bpc == 8:
+		return uint(row[i])
+	case bpc == 16:
+		return uint(row[2*i])<<8 | uint(row[2*i+1])
+	case bpc < 8:
+		shift := 8 - bpc - (i*bpc)%8
+		return uint(row[i*bpc/8]) >> uint(shift) & (1<<uint(bpc) - 1)
+	}
+	return 0
+}
+
+// setSample() sets the i'th sample of a row, modulo 2^bpc.
+func setSample(row []byte, i, bpc int, v uint) {
+	switch {
+	case bpc == 8:
+		row[i] = byte(v)
+	case bpc == 16:
+		row[2*i],row[2*i+1] = byte(v>>8),byte(v)
+	case bpc < 8:
+		shift := uint(8 - bpc - (i*bpc)%8)
+		mask := byte(1<<uint(bpc) - 1) << shift
+		row[i*bpc/8] = row[i*bpc/8] &^ mask | byte(v)<<shift & mask
+	}
+}
+
+// predictorWriter applies prediction one row at a time.
+type predictorWriter struct {
+	writer io.WriteCloser
+	p predictor
+	previous, current []byte
+	// n is the number of bytes in current.
+	n int
+}
+
+func newPredictorWriter(writer io.WriteCloser, p predictor) io.WriteCloser {
+	if !p.enabled() {
+		return writer
+	}
+	return &predictorWriter{
+		writer: writer,
+		p: p,
+		previous: make([]byte, p.rowLength()),
+		current: make([]byte, p.rowLength())}
+}
+
+func (pw *predictorWriter) Write(buffer []byte) (n int, err error) {
+	for n < len(buffer) {
+		m := copy(pw.current[pw.n:], buffer[n:])
+		pw.n += m
+		n += m
+		if pw.n == len(pw.current) {
+			if err = pw.writeRow(); err != nil {
+				return n,err
+			}
+		}
+	}
+	return n,nil
+}
+
+// writeRow() encodes and writes the (possibly partial) row in current.
+func (pw *predictorWriter) writeRow() error {
+	row := pw.current[:pw.n]
+	var encoded []byte
+	if pw.p.png() {
+		encoded = pngEncode(pw.p.predictor, row, pw.previous, pw.p.pixelLength())
+	} else {
+		encoded = append([]byte(nil), row...)
+		tiffEncode(encoded, pw.p)
+	}
+	pw.previous,pw.current = pw.current,pw.previous
+	pw.n = 0
+	_,err := pw.writer.Write(encoded)
+	return err
+}
+
+func (pw *predictorWriter) Close() error {
+	if pw.n > 0 {
+		if err := pw.writeRow(); err != nil {
+			return err
+		}
+	}
+	return pw.writer.Close()
+}
+
+// pngEncode() returns a row prefixed by its filter type and filtered
+// according to the predictor.  PNGOptimumPredictor chooses the filter
+// with the smallest sum of absolute differences for each row.
+func pngEncode(predictor int, row, previous []byte, bpp int) []byte {
+	if predictor != PNGOptimumPredictor {
+		return pngFilter(byte(predictor-PNGNonePredictor), row, previous, bpp)
+	}
+	var best []byte
+	bestSum := -1
+	for filter:=byte(pngNone); filter<=pngPaeth; filter++ {
+		encoded := pngFilter(filter, row, previous, bpp)
+		sum := 0
+		for _,b := range encoded[1:] {
+			sum += abs(int(int8(b)))
+		}
+		if bestSum < 0 || sum < bestSum {
+			best,bestSum = encoded,sum
+		}
+	}
+	return best
+}
+
+// pngFilter() applies one PNG filter type to a row.
+func pngFilter(filter byte, row, previous []byte, bpp int) []byte {
+	encoded := make([]byte, len(row)+1)
+	encoded[0] = filter
+	for i,b := range row {
+		var left, upperLeft byte
+		if i >= bpp {
+			left,upperLeft = row[i-bpp],previous[i-bpp]
+		}
+		switch filter {
+		case pngNone:
+			encoded[i+1] = b
+		case pngSub:
+			encoded[i+1] = b - left
+		case pngUp:
+			encoded[i+1] = b - previous[i]
+		case pngAverage:
+			encoded[i+1] = b - byte((int(left) + int(previous[i])) / 2)
+		case pngPaeth:
+			encoded[i+1] = b - paeth(left, previous[i], upperLeft)
+		}
+	}
+	return encoded
+}
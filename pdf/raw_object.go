@@ -0,0 +1,35 @@
+package pdf
+
+// rawObject is an Object whose serialization is a fixed sequence of
+// bytes supplied by the caller.  It is used to reserve space in a file
+// for a value that can only be computed after the file has been
+// closed (e.g., the /ByteRange of a signature).  It is not produced
+// by the parser.
+type rawObject struct {
+	serialization []byte
+}
+
+func newRawObject(b []byte) Object {
+	return &rawObject{b}
+}
+
+// Raw objects are immutable, so Clone() returns the same instance.
+func (r *rawObject) Clone() Object {
+	return r
+}
+
+func (r *rawObject) Dereference() Object {
+	return r
+}
+
+func (r *rawObject) Protect() Object {
+	return r
+}
+
+func (r *rawObject) Unprotect() Object {
+	return r
+}
+
+func (r *rawObject) Serialize(w Writer, file ...File) {
+	w.Write(r.serialization)
+}
@@ -12,3 +12,25 @@ func NewRectangle(llx, lly, urx, ury float64) *Rectangle {
 	result.Add(NewNumeric(ury))
 	return &Rectangle{result}
 }
+
+// rectangleValues() returns the four coordinates of a PDF rectangle
+// array normalized so that the first point is the lower-left corner.
+// The boolean return value is false if the array doesn't contain four
+// numbers.
+func rectangleValues(a ProtectedArray) (r [4]float64, ok bool) {
+	if a == nil || a.Size() != 4 {
+		return r, false
+	}
+	for i:=0; i<4; i++ {
+		if r[i],ok = floatValue(a.At(i)); !ok {
+			return r, false
+		}
+	}
+	if r[0] > r[2] {
+		r[0],r[2] = r[2],r[0]
+	}
+	if r[1] > r[3] {
+		r[1],r[3] = r[3],r[1]
+	}
+	return r, true
+}
@@ -0,0 +1,185 @@
+package pdf
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Revision describes one revision of a pre-existing PDF file: the
+// original file or one of the incremental updates appended to it.
+// Each revision has its own xref section and trailer.
+type Revision struct {
+	// XrefOffset is the location of the revision's xref section.
+	XrefOffset int64
+
+	// End is the size the file would have if it were truncated
+	// to this revision.
+	End int64
+
+	// Trailer is the revision's trailer dictionary.
+	Trailer ProtectedDictionary
+
+	// Objects lists the objects that the revision wrote or freed.
+	Objects []ObjectNumber
+}
+
+// revision describes one xref section of a pre-existing file, i.e.,
+// the original file or one of its incremental updates.
+type revision struct {
+	// xrefOffset is the location of the "xref" keyword.
+	xrefOffset int64
+
+	// end is the offset just past the "%%EOF" marker (and the
+	// end-of-line that follows it, if any) that terminates the
+	// revision.  For files that don't have a marker, it is the size
+	// of the file.
+	end int64
+
+	// trailer is a copy of the revision's trailer dictionary.
+	trailer Dictionary
+
+	// objects lists the xref entries (in use or free) that the
+	// revision defines.
+	objects []ObjectNumber
+}
+
+// findRevisionEnd() returns the offset just past the first "%%EOF"
+// marker following the xref section at xrefOffset, including any
+// end-of-line characters that follow the marker.  The file position
+// is not preserved.
+func findRevisionEnd(f io.ReadSeeker, xrefOffset int64) int64 {
+	marker := []byte("%%EOF")
+	if _,err := f.Seek(xrefOffset, os.SEEK_SET); err != nil {
+		return xrefOffset
+	}
+	r := bufio.NewReader(f)
+	position := xrefOffset
+	// The last len(marker) bytes read.  The marker may follow any
+	// byte, including '%' as in "%%%EOF".
+	window := make([]byte, 0, len(marker))
+	for !bytes.Equal(window, marker) {
+		b,err := r.ReadByte()
+		if err != nil {
+			return position
+		}
+		position += 1
+		if len(window) == len(marker) {
+			window = append(window[:0], window[1:]...)
+		}
+		window = append(window, b)
+	}
+	// Include the end-of-line following the marker.
+	eol,_ := r.Peek(2)
+	switch {
+	case bytes.HasPrefix(eol, []byte("\r\n")):
+		position += 2
+	case len(eol) > 0 && (eol[0] == '\r' || eol[0] == '\n'):
+		position += 1
+	}
+	return position
+}
+
+// revisionEndingAt() returns the index of the revision whose end
+// is at offset, allowing for the end-of-line following "%%EOF" to be
+// excluded.  It returns -1 if offset doesn't end a revision.
+func (f *file) revisionEndingAt(offset int64) int {
+	f.loadAllPendingXref()
+	for i,r := range f.revisions {
+		if offset == r.end || (offset < r.end && offset >= r.end-2 && offset > r.xrefOffset && endsWithMarker(f, offset)) {
+			return i
+		}
+	}
+	return -1
+}
+
+func endsWithMarker(f *file, offset int64) bool {
+	b := make([]byte, 5)
+	if offset < 5 {
+		return false
+	}
+	if _,err := f.file.ReadAt(b, offset-5); err != nil && err != io.EOF {
+		return false
+	}
+	return string(b) == "%%EOF"
+}
+
+// Revisions() returns the revisions of a pre-existing file, oldest
+// first.  Revisions made since the file was opened are not included.
+// A new file has no revisions.
+func (f *file) Revisions() []Revision {
+	f.loadAllPendingXref()
+	result := make([]Revision, len(f.revisions))
+	for i,r := range f.revisions {
+		objects := make([]ObjectNumber, len(r.objects))
+		copy(objects, r.objects)
+		result[i] = Revision{
+			XrefOffset: r.xrefOffset,
+			End: r.end,
+			Trailer: r.trailer.Protect().(ProtectedDictionary),
+			Objects: objects}
+	}
+	return result
+}
+
+// ReadRevisions() returns the revisions of the named file, oldest
+// first.
+func ReadRevisions(filename string) ([]Revision, error) {
+	f,_,err := OpenFile(filename, os.O_RDONLY)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.Revisions(), nil
+}
+
+// OpenRevision() opens a read-only view of the named file as it was
+// at the end of revision n (numbered from 0, oldest first).  Objects
+// written or freed by later revisions are invisible in the view.
+// Attempts to modify the view panic.
+func OpenRevision(filename string, n int) (*file, error) {
+	revisions,err := ReadRevisions(filename)
+	if err != nil {
+		return nil, err
+	}
+	if n < 0 || n >= len(revisions) {
+		return nil, fmt.Errorf(`File has %d revisions; revision %d requested`, len(revisions), n)
+	}
+	f,_,err := openFile(filename, os.O_RDONLY, revisions[n].XrefOffset)
+	if err != nil {
+		return nil, err
+	}
+	f.readOnly = true
+	return f, nil
+}
+
+// OpenDocumentRevision() opens a read-only Document view of the named
+// file as it was at the end of revision n.  See OpenRevision().
+func OpenDocumentRevision(filename string, n int) (*Document, error) {
+	f,err := OpenRevision(filename, n)
+	if err != nil {
+		return nil, err
+	}
+	return newDocument(f, true), nil
+}
+
+// TruncateToRevision() rolls the named file back to the end of
+// revision n (numbered from 0, oldest first) by discarding every
+// incremental update appended after it.  The discarded updates cannot
+// be recovered.
+func TruncateToRevision(filename string, n int) error {
+	revisions,err := ReadRevisions(filename)
+	if err != nil {
+		return err
+	}
+	if n < 0 || n >= len(revisions) {
+		return fmt.Errorf(`File has %d revisions; revision %d requested`, len(revisions), n)
+	}
+	if revisions[n].End <= revisions[n].XrefOffset {
+		return errors.New(`Revision has no end-of-file marker`)
+	}
+	return os.Truncate(filename, revisions[n].End)
+}
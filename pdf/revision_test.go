@@ -0,0 +1,19 @@
+package pdf
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFindRevisionEnd(t *testing.T) {
+	for _,test := range []struct{ trailer string; end int64 }{
+		{"startxref\n0\n%%EOF\n", 18},
+		{"startxref\n0\n%%EOF\r\n", 19},
+		{"startxref\n0\n%%%EOF\n1 0 obj", 19},
+		{"startxref\n0\n%%EO%%EOF\n1 0 obj", 22},
+		{"startxref\n0\n%EOF\n", 17}} {
+		if end := findRevisionEnd(strings.NewReader(test.trailer), 0); end != test.end {
+			t.Errorf(`findRevisionEnd() of %q returned %d; expected %d`, test.trailer, end, test.end)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package pdf
+
+import (
+	"bufio"
+	"errors"
+	"io")
+
+
+type RunLengthFilter struct {
+}
+
+const ( runLengthDecoderName = "RunLengthDecode" )
+
+// runLengthEOD is the length byte that marks the end of the data.
+const runLengthEOD = 128
+
+func init () {
+	RegisterFilterFactoryFactory(runLengthDecoderName,
+		func(ProtectedDictionary) StreamFilterFactory { return new(RunLengthFilter) })
+}
+
+func (filter *RunLengthFilter) Name() string {
+	return runLengthDecoderName
+}
+
+func (filter *RunLengthFilter) NewEncoder(writer io.WriteCloser) io.WriteCloser {
+	return &RunLengthWriter{writer,nil}
+}
+
+func (filter *RunLengthFilter) NewDecoder(reader io.Reader) io.Reader {
+	byteReader,ok := reader.(io.ByteReader)
+	if !ok {
+		byteReader = bufio.NewReader(reader)
+	}
+	return &RunLengthReader{reader: byteReader}
+}
+
+func (filter *RunLengthFilter) DecodeParms(file... File) Object {
+	return NewNull()
+}
+
+// RunLengthWriter encodes runs of up to 128 identical bytes as a
+// length byte of 257-n followed by the byte, and other data as a
+// length byte of n-1 followed by n (at most 128) literal bytes.
+type RunLengthWriter struct {
+	writer io.WriteCloser
+	// pending holds data that hasn't been encoded because the
+	// packet it belongs to may not be complete.
+	pending []byte
+}
+
+func (rlw *RunLengthWriter) Write(buffer []byte) (n int, err error) {
+	rlw.pending = append(rlw.pending, buffer...)
+	// A packet is known to be complete when at least one byte
+	// past the longest possible packet is available.
+	for len(rlw.pending) > 129 && err == nil {
+		err = rlw.writePacket()
+	}
+	if err != nil {
+		return 0, err
+	}
+	return len(buffer), nil
+}
+
+// writePacket() encodes the packet at the start of pending.
+func (rlw *RunLengthWriter) writePacket() (err error) {
+	data := rlw.pending
+	run := 1
+	for run < len(data) && run < 128 && data[run] == data[0] {
+		run += 1
+	}
+	if run > 1 {
+		_,err = rlw.writer.Write([]byte{byte(257-run), data[0]})
+		rlw.pending = data[run:]
+		return err
+	}
+
+	// Extend the literal up to the start of the next run.
+	literal := 1
+	for literal < len(data) && literal < 128 &&
+		(literal+1 >= len(data) || data[literal] != data[literal+1]) {
+		literal += 1
+	}
+	if _,err = rlw.writer.Write([]byte{byte(literal-1)}); err == nil {
+		_,err = rlw.writer.Write(data[:literal])
+	}
+	rlw.pending = data[literal:]
+	return err
+}
+
+func (rlw *RunLengthWriter) Close() error {
+	for len(rlw.pending) > 0 {
+		if err := rlw.writePacket(); err != nil {
+			return err
+		}
+	}
+	if _,err := rlw.writer.Write([]byte{runLengthEOD}); err != nil {
+		return err
+	}
+	return rlw.writer.Close()
+}
+
+type RunLengthReader struct {
+	reader io.ByteReader
+	// literal is the number of literal bytes remaining in the
+	// current packet and repeat is the number of copies of
+	// repeated remaining.
+	literal, repeat int
+	repeated byte
+	err error
+}
+
+func (rlr *RunLengthReader) Read(buffer []byte) (n int, err error) {
+	for n < len(buffer) && rlr.err == nil {
+		switch {
+		case rlr.repeat > 0:
+			buffer[n] = rlr.repeated
+			rlr.repeat -= 1
+			n += 1
+		case rlr.literal > 0:
+			var b byte
+			if b,err = rlr.reader.ReadByte(); err != nil {
+				rlr.err = unexpectedEndOfRunLength(err)
+				break
+			}
+			buffer[n] = b
+			rlr.literal -= 1
+			n += 1
+		default:
+			rlr.startPacket()
+		}
+	}
+	return n,rlr.err
+}
+
+// startPacket() reads the length byte (and repeated byte) starting
+// the next packet.  The end of the input is accepted in place of the
+// end-of-data marker.
+func (rlr *RunLengthReader) startPacket() {
+	length,err := rlr.reader.ReadByte()
+	switch {
+	case err != nil:
+		rlr.err = err
+	case length == runLengthEOD:
+		rlr.err = io.EOF
+	case length < runLengthEOD:
+		rlr.literal = int(length) + 1
+	default:
+		if rlr.repeated,err = rlr.reader.ReadByte(); err != nil {
+			rlr.err = unexpectedEndOfRunLength(err)
+		} else {
+			rlr.repeat = 257 - int(length)
+		}
+	}
+}
+
+func unexpectedEndOfRunLength(err error) error {
+	if err == io.EOF {
+		return errors.New(`Unexpected end of RunLengthDecode stream`)
+	}
+	return err
+}
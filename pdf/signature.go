@@ -0,0 +1,242 @@
+package pdf
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/sha256"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SignatureOptions contains the optional information recorded in the
+// signature dictionary of a new signature.
+type SignatureOptions struct {
+	Name        string
+	Reason      string
+	Location    string
+	ContactInfo string
+
+	// Time is recorded as the signing time (/M).  If it is zero,
+	// the current time is used.
+	Time time.Time
+
+	// ContentsSize is the number of bytes reserved in the file for
+	// the CMS SignedData.  If it is zero, defaultSignatureSize is
+	// used.  Signing fails if the SignedData doesn't fit.
+	ContentsSize int
+}
+
+const defaultSignatureSize = 16384
+
+// byteRangePlaceholder is written as the value of /ByteRange and is
+// overwritten (padded with spaces) once the final layout of the file
+// is known.
+var byteRangePlaceholder = []byte("[0 ********** ********** **********]")
+
+// SignFile() adds a PAdES-B (ETSI.CAdES.detached) signature to the
+// existing PDF file named by filename.  The signature field and
+// signature dictionary are appended to the file as an incremental
+// update, so signatures that are already in the file remain valid.
+// A fixed-size /Contents placeholder is reserved.  After the xref and
+// trailer have been written, the /ByteRange is computed over the
+// final bytes of the file, and a CMS SignedData produced by signer
+// is embedded in the placeholder.  The first certificate of chain
+// must be the signer's certificate; the rest of the chain is
+// included in the SignedData for the benefit of verifiers.  If
+// writing the update or signing fails, the file is truncated to its
+// original size.
+func SignFile(filename string, signer crypto.Signer, chain []*x509.Certificate, options SignatureOptions) error {
+	if len(chain) == 0 {
+		return errors.New(`A signing certificate is required`)
+	}
+	info,err := os.Stat(filename)
+	if err != nil {
+		return err
+	}
+	originalSize := info.Size()
+
+	size := options.ContentsSize
+	if size <= 0 {
+		size = defaultSignatureSize
+	}
+
+	d,err := openDocument(filename, os.O_RDWR)
+	if err != nil {
+		return err
+	}
+	if d.pageCount == 0 {
+		d.Close()
+		os.Truncate(filename, originalSize)
+		return errors.New(`Document has no pages to hold a signature field`)
+	}
+	d.addSignatureField(newSignatureDictionary(options, size))
+	if err = d.Close(); err == nil {
+		err = fillSignature(filename, originalSize, size, signer, chain)
+	}
+	if err != nil {
+		os.Truncate(filename, originalSize)
+	}
+	return err
+}
+
+func newSignatureDictionary(options SignatureOptions, size int) Dictionary {
+	signature := NewDictionary()
+	signature.Add("Type", NewName("Sig"))
+	signature.Add("Filter", NewName("Adobe.PPKLite"))
+	signature.Add("SubFilter", NewName("ETSI.CAdES.detached"))
+	signature.Add("ByteRange", newRawObject(byteRangePlaceholder))
+
+	contents := NewBinaryString(make([]byte, size))
+	contents.SetSerializer(HexStringSerializer)
+	signature.Add("Contents", contents)
+
+	signingTime := options.Time
+	if signingTime.IsZero() {
+		signingTime = time.Now()
+	}
+	signature.Add("M", NewTextString(formatDate(signingTime)))
+
+	for key,value := range map[string]string{
+		"Name": options.Name,
+		"Reason": options.Reason,
+		"Location": options.Location,
+		"ContactInfo": options.ContactInfo} {
+		if value != "" {
+			signature.Add(key, NewTextString(value))
+		}
+	}
+	return signature
+}
+
+// addSignatureField() adds an invisible signature field whose value
+// is the passed signature dictionary.  The field's widget is placed
+// on the first page and the field is added to the interactive form,
+// which is created if necessary.
+func (d *Document) addSignatureField(signature Dictionary) {
+	page := pageFromTree(d.pageTreeRoot, 0)
+
+	acroForm := NewDictionary()
+	if a := d.catalog.GetDictionary("AcroForm"); a != nil {
+		acroForm = a.Unprotect().(Dictionary)
+	}
+	fields := NewArray()
+	if f := acroForm.GetArray("Fields"); f != nil {
+		fields = f.Unprotect().(Array)
+	}
+
+	field := NewDictionary()
+	field.Add("FT", NewName("Sig"))
+	field.Add("T", NewTextString(uniqueFieldName(fields, "Signature")))
+	signatureReference,_ := d.WriteObject(signature)
+	field.Add("V", signatureReference)
+	// The field is merged with an invisible, locked, printable widget.
+	field.Add("Type", NewName("Annot"))
+	field.Add("Subtype", NewName("Widget"))
+	field.Add("Rect", NewRectangle(0, 0, 0, 0))
+	field.Add("F", NewIntNumeric(132))
+	field.Add("P", page.reference)
+	fieldReference,_ := d.WriteObject(field)
+
+	fields.Add(fieldReference)
+	acroForm.Add("Fields", fields)
+	// SignaturesExist | AppendOnly
+	acroForm.Add("SigFlags", NewIntNumeric(3))
+	d.catalog.Add("AcroForm", acroForm)
+
+	annots := NewArray()
+	if a := page.dictionary.GetArray("Annots"); a != nil {
+		annots = a.Unprotect().(Array)
+	}
+	annots.Add(fieldReference)
+	page.dictionary.Add("Annots", annots)
+	page.Rewrite()
+}
+
+// uniqueFieldName() returns a name beginning with prefix that isn't
+// the partial name (/T) of any of the fields.
+func uniqueFieldName(fields ProtectedArray, prefix string) string {
+	used := make(map[string]bool, fields.Size())
+	for i:=0; i<fields.Size(); i++ {
+		if field,ok := fields.At(i).Dereference().(ProtectedDictionary); ok {
+			if t,ok := field.GetString("T"); ok {
+				used[string(t)] = true
+			}
+		}
+	}
+	for i:=1; ; i++ {
+		name := prefix + strconv.Itoa(i)
+		if !used[name] {
+			return name
+		}
+	}
+}
+
+// fillSignature() locates the /ByteRange and /Contents placeholders
+// in the portion of the file written after start, fills in the byte
+// range, and embeds the CMS signature over that range.
+func fillSignature(filename string, start int64, size int, signer crypto.Signer, chain []*x509.Certificate) error {
+	f,err := os.OpenFile(filename, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	length,err := f.Seek(0, os.SEEK_END)
+	if err != nil {
+		return err
+	}
+	appended := make([]byte, length-start)
+	if _,err = f.ReadAt(appended, start); err != nil {
+		return err
+	}
+
+	byteRangeIndex := bytes.Index(appended, byteRangePlaceholder)
+	contentsPlaceholder := []byte("/Contents <" + strings.Repeat("0", 2*size) + ">")
+	contentsIndex := bytes.Index(appended, contentsPlaceholder)
+	if byteRangeIndex < 0 || contentsIndex < 0 {
+		return errors.New(`Signature placeholders not found in appended data`)
+	}
+
+	// The range excludes the hex string including its delimiters.
+	contentsStart := start + int64(contentsIndex) + int64(len("/Contents "))
+	contentsEnd := contentsStart + int64(2*size+2)
+	byteRange := []byte(fmt.Sprintf("[0 %d %d %d", contentsStart, contentsEnd, length-contentsEnd))
+	if len(byteRange) >= len(byteRangePlaceholder) {
+		return errors.New(`File is too large for /ByteRange placeholder`)
+	}
+	byteRange = append(byteRange, bytes.Repeat([]byte{' '}, len(byteRangePlaceholder)-len(byteRange)-1)...)
+	byteRange = append(byteRange, ']')
+	if _,err = f.WriteAt(byteRange, start+int64(byteRangeIndex)); err != nil {
+		return err
+	}
+
+	hash := sha256.New()
+	if _,err = io.Copy(hash, io.NewSectionReader(f, 0, contentsStart)); err != nil {
+		return err
+	}
+	if _,err = io.Copy(hash, io.NewSectionReader(f, contentsEnd, length-contentsEnd)); err != nil {
+		return err
+	}
+
+	cms,err := newCMSSignature(hash.Sum(nil), signer, chain)
+	if err != nil {
+		return err
+	}
+	if len(cms) > size {
+		return fmt.Errorf(`Signature requires %d bytes but only %d were reserved`, len(cms), size)
+	}
+
+	encoded := make([]byte, 2*len(cms))
+	for i,b := range cms {
+		encoded[2*i] = HexDigit(b/16)
+		encoded[2*i+1] = HexDigit(b%16)
+	}
+	_,err = f.WriteAt(encoded, contentsStart+1)
+	return err
+}
@@ -0,0 +1,197 @@
+package pdf_test
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"testing"
+	"time"
+	"github.com/mawicks/PDFiG/pdf" )
+
+func newTestCertificate(t *testing.T) (*ecdsa.PrivateKey, *x509.Certificate) {
+	key,err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject: pkix.Name{CommonName: "PDFiG Test Signer"},
+		NotBefore: time.Now().Add(-time.Hour),
+		NotAfter: time.Now().Add(time.Hour),
+		KeyUsage: x509.KeyUsageDigitalSignature}
+	der,err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate,err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key,certificate
+}
+
+// signatureDictionaries() returns the signature dictionaries of all
+// signature fields in the named file.
+func signatureDictionaries(filename string) []pdf.ProtectedDictionary {
+	f,_,_ := pdf.OpenFile(filename, os.O_RDONLY)
+	defer f.Close()
+
+	var result []pdf.ProtectedDictionary
+	fields := f.Catalog().GetDictionary("AcroForm").GetArray("Fields")
+	for i:=0; i<fields.Size(); i++ {
+		field := fields.At(i).Dereference().(pdf.ProtectedDictionary)
+		if field.CheckNameValue("FT", "Sig") {
+			result = append(result, field.GetDictionary("V"))
+		}
+	}
+	return result
+}
+
+func TestSignFile(t *testing.T) {
+	filename := "/tmp/test-signed.pdf"
+	makeFormFile(filename)
+	key,certificate := newTestCertificate(t)
+
+	if err := pdf.SignFile(filename, key, []*x509.Certificate{certificate}, pdf.SignatureOptions{Reason: "Testing"}); err != nil {
+		t.Fatalf("SignFile() returned error: %v", err)
+	}
+	firstRevision,_ := ioutil.ReadFile(filename)
+
+	if err := pdf.SignFile(filename, key, []*x509.Certificate{certificate}, pdf.SignatureOptions{}); err != nil {
+		t.Fatalf("Second SignFile() returned error: %v", err)
+	}
+	secondRevision,_ := ioutil.ReadFile(filename)
+
+	if !bytes.HasPrefix(secondRevision, firstRevision) {
+		t.Errorf("Second signature modified the first revision")
+	}
+
+	signatures := signatureDictionaries(filename)
+	if len(signatures) != 2 {
+		t.Fatalf("Found %d signatures; expected 2", len(signatures))
+	}
+
+	for i,length := range []int{len(firstRevision), len(secondRevision)} {
+		byteRange := signatures[i].GetArray("ByteRange")
+		var r [4]int
+		for j:=0; j<4; j++ {
+			r[j] = byteRange.At(j).(*pdf.IntNumeric).Value()
+		}
+		if r[0] != 0 || r[2]+r[3] != length {
+			t.Errorf("Signature %d /ByteRange %v doesn't cover its revision of %d bytes", i, r, length)
+		}
+		contents,_ := signatures[i].GetString("Contents")
+		if len(contents) == 0 || contents[0] != 0x30 {
+			t.Errorf("Signature %d /Contents is not a DER sequence", i)
+		}
+	}
+}
+
+// failingSigner is a crypto.Signer whose signatures always fail.
+type failingSigner struct {
+	crypto.Signer
+}
+
+func (failingSigner) Sign(io.Reader, []byte, crypto.SignerOpts) ([]byte, error) {
+	return nil, errors.New("signing device unavailable")
+}
+
+func TestSignFileFailure(t *testing.T) {
+	filename := "/tmp/test-signed-failure.pdf"
+	makeFormFile(filename)
+	original,_ := ioutil.ReadFile(filename)
+	key,certificate := newTestCertificate(t)
+
+	if err := pdf.SignFile(filename, failingSigner{key}, []*x509.Certificate{certificate}, pdf.SignatureOptions{}); err == nil {
+		t.Errorf("SignFile() with a failing signer didn't fail")
+	}
+	if unsigned,_ := ioutil.ReadFile(filename); !bytes.Equal(unsigned, original) {
+		t.Errorf("Failed SignFile() left %d bytes appended", len(unsigned)-len(original))
+	}
+
+	if err := pdf.SignFile(os.TempDir(), key, []*x509.Certificate{certificate}, pdf.SignatureOptions{}); err == nil {
+		t.Errorf("SignFile() of a directory didn't fail")
+	}
+}
+
+func TestVerifyFile(t *testing.T) {
+	filename := "/tmp/test-verify.pdf"
+	makeFormFile(filename)
+	key,certificate := newTestCertificate(t)
+
+	pdf.SignFile(filename, key, []*x509.Certificate{certificate}, pdf.SignatureOptions{Reason: "First"})
+	pdf.SignFile(filename, key, []*x509.Certificate{certificate}, pdf.SignatureOptions{Reason: "Second"})
+
+	results,err := pdf.VerifyFile(filename)
+	if err != nil {
+		t.Fatalf("VerifyFile() returned error: %v", err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("VerifyFile() found %d signatures; expected 2", len(results))
+	}
+	for i,v := range results {
+		if !v.Valid() {
+			t.Errorf("Signature %d is not valid: %+v", i, v)
+		}
+		if v.Signer == nil || !v.Signer.Equal(certificate) {
+			t.Errorf("Signature %d signer doesn't match the signing certificate", i)
+		}
+	}
+	if results[0].Reason != "First" || len(results[0].LaterRevisions) != 1 {
+		t.Errorf("First signature should be followed by exactly one revision")
+	}
+	if len(results[1].LaterRevisions) != 0 || results[1].ModifiedAfterSigning() {
+		t.Errorf("Second signature should cover the final revision")
+	}
+
+	// Tamper with a byte covered by the first signature.
+	data,_ := ioutil.ReadFile(filename)
+	index := bytes.Index(data, []byte("612 792 l s"))
+	data[index] = '7'
+	ioutil.WriteFile(filename, data, 0666)
+
+	results,_ = pdf.VerifyFile(filename)
+	for i,v := range results {
+		if v.DigestValid {
+			t.Errorf("Signature %d digest still valid after modification", i)
+		}
+	}
+}
+
+func TestVerifyWidenedByteRange(t *testing.T) {
+	filename := "/tmp/test-verify-range.pdf"
+	makeFormFile(filename)
+	key,certificate := newTestCertificate(t)
+	pdf.SignFile(filename, key, []*x509.Certificate{certificate}, pdf.SignatureOptions{})
+
+	// Move the start of the gap back to an earlier '<' so that
+	// the gap still looks like a hex string but hides other bytes.
+	data,_ := ioutil.ReadFile(filename)
+	index := bytes.Index(data, []byte("/ByteRange [")) + len("/ByteRange ")
+	end := index + bytes.IndexByte(data[index:], ']') + 1
+	var r [4]int64
+	fmt.Sscanf(string(data[index:end]), "[%d %d %d %d]", &r[0], &r[1], &r[2], &r[3])
+	earlier := int64(bytes.LastIndex(data[:r[1]], []byte("<")))
+	widened := []byte(fmt.Sprintf("[0 %d %d %d", earlier, r[2], r[3]))
+	widened = append(widened, bytes.Repeat([]byte{' '}, end-index-len(widened)-1)...)
+	copy(data[index:end], append(widened, ']'))
+	ioutil.WriteFile(filename, data, 0666)
+
+	results,err := pdf.VerifyFile(filename)
+	if err != nil || len(results) != 1 {
+		t.Fatalf("VerifyFile() returned %v, %v", results, err)
+	}
+	if results[0].CoversRevision || results[0].Valid() {
+		t.Errorf("Widened /ByteRange %v reported as covering the revision", results[0].ByteRange)
+	}
+}
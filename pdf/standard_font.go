@@ -1,5 +1,7 @@
 package pdf
 
+import "sync"
+
 type Font interface {
 	Indirect(f File) Indirect
 }
@@ -42,6 +44,8 @@ func StandardFontToName (font StandardFont)  (result string) {
 type standardFont struct {
 	fileBindings map[File] Indirect
 	dictionary Dictionary
+	// lock allows a font to be shared by pages built in parallel.
+	lock sync.Mutex
 }
 
 func NewStandardFont(font StandardFont) Font {
@@ -59,9 +63,11 @@ func NewStandardFont(font StandardFont) Font {
 }
 
 func (font *standardFont) Indirect(file File) Indirect {
+	font.lock.Lock()
+	defer font.lock.Unlock()
 	i,exists := font.fileBindings[file]
 	if (!exists) {
-		i = file.WriteObject(font.dictionary)
+		i,_ = file.WriteObject(font.dictionary)
 		font.fileBindings[file] = i
 	}
 	return i
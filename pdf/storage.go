@@ -0,0 +1,210 @@
+package pdf
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+)
+
+// storage is the medium holding the bytes of a file.  *os.File
+// implements it.
+type storage interface {
+	io.Reader
+	io.Writer
+	io.Seeker
+	io.ReaderAt
+	io.Closer
+}
+
+// readerAtStorage is a read-only storage over an io.ReaderAt.  Every
+// read is a ReadAt() of the requested range, so only the parts of the
+// file that are actually needed are fetched.
+type readerAtStorage struct {
+	r io.ReaderAt
+	size, position int64
+}
+
+func (s *readerAtStorage) Read(b []byte) (int, error) {
+	if s.position >= s.size {
+		return 0, io.EOF
+	}
+	if remaining := s.size - s.position; int64(len(b)) > remaining {
+		b = b[:remaining]
+	}
+	n,err := s.r.ReadAt(b, s.position)
+	s.position += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (s *readerAtStorage) ReadAt(b []byte, offset int64) (int, error) {
+	return s.r.ReadAt(b, offset)
+}
+
+func (s *readerAtStorage) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case os.SEEK_CUR:
+		offset += s.position
+	case os.SEEK_END:
+		offset += s.size
+	}
+	if offset < 0 {
+		return s.position, errors.New(`Seek to a negative position`)
+	}
+	s.position = offset
+	return offset, nil
+}
+
+func (s *readerAtStorage) Write(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	return 0, errors.New(`File is read-only`)
+}
+
+// Close() does nothing.  The io.ReaderAt belongs to the caller.
+func (s *readerAtStorage) Close() error {
+	return nil
+}
+
+// OpenReaderAt() constructs a read-only File from the size bytes of a
+// PDF file available from r, which may be backed by range requests to
+// remote storage.  Objects are read only when they are requested.
+// Only the most recent xref section is read initially.  Earlier
+// sections (those of earlier incremental updates) are read one at a
+// time when an object that isn't in the sections read so far is
+// requested, and all of them are read by Revisions().  If the file is
+// linearized, only the linearization dictionary and the first-page
+// xref section are read initially, so the first page (see FirstPage())
+// can be read after fetching only the beginning of the file.  A file
+// that isn't linearized ends with its xref, which must be read before
+// any object can be found.
+func OpenReaderAt(r io.ReaderAt, size int64) (result *file, err error) {
+	if size <= 0 {
+		return nil, errors.New(`File is empty`)
+	}
+	defer func() {
+		if x := recover(); x != nil {
+			if err,_ = x.(error); err == nil {
+				err = fmt.Errorf("%v", x)
+			}
+			result = nil
+		}
+	} ()
+	result,_ = newFile(&readerAtStorage{r: r, size: size}, os.O_RDONLY, 0, true)
+	result.readOnly = true
+	return result, nil
+}
+
+// OpenDocumentReaderAt() constructs a read-only Document from the size
+// bytes of a PDF file available from r.  See OpenReaderAt().
+func OpenDocumentReaderAt(r io.ReaderAt, size int64) (result *Document, err error) {
+	f,err := OpenReaderAt(r, size)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if x := recover(); x != nil {
+			if err,_ = x.(error); err == nil {
+				err = fmt.Errorf("%v", x)
+			}
+			f.Close()
+			result = nil
+		}
+	} ()
+	return newDocument(f, true), nil
+}
+
+// linearizationWindow is the number of bytes at the start of a file
+// searched for the linearization dictionary and first-page xref.
+const linearizationWindow = 4096
+
+var firstObjectPattern = regexp.MustCompile(`^%PDF-[^\r\n]*[\r\n]+(?:%[^\r\n]*[\r\n]+)*\s*\d+\s+\d+\s+obj\s*`)
+
+// findLinearization() returns the linearization parameter dictionary
+// and the location of the first-page xref section if f is a
+// linearized file of the passed size.  Otherwise it returns nil.  A
+// file that was updated incrementally after it was linearized isn't
+// treated as linearized because its /L no longer matches its size.
+func findLinearization(f io.ReaderAt, size int64) (Dictionary, int64) {
+	window := make([]byte, linearizationWindow)
+	n,_ := f.ReadAt(window, 0)
+	window = window[:n]
+
+	match := firstObjectPattern.Find(window)
+	if match == nil {
+		return nil, 0
+	}
+	parser := NewParser(bytes.NewReader(window[len(match):]))
+	object,err := parser.Scan()
+	if err != nil {
+		return nil, 0
+	}
+	d,ok := object.(Dictionary)
+	if !ok || d.Get("Linearized") == nil {
+		return nil, 0
+	}
+	if length,ok := d.GetInt("L"); !ok || int64(length) != size {
+		return nil, 0
+	}
+
+	end := bytes.Index(window[len(match):], []byte("endobj"))
+	if end < 0 {
+		return nil, 0
+	}
+	end += len(match) + len("endobj")
+	xref := bytes.Index(window[end:], []byte("xref"))
+	if xref < 0 {
+		return nil, 0
+	}
+	return d, int64(end + xref)
+}
+
+// Linearization() returns the linearization parameter dictionary of a
+// linearized file opened with OpenReaderAt(), or nil.
+func (f *file) Linearization() ProtectedDictionary {
+	if f.linearization == nil {
+		return nil
+	}
+	return f.linearization.Protect().(ProtectedDictionary)
+}
+
+// FirstPage() returns the page dictionary of the first page.  For a
+// linearized file opened with OpenReaderAt(), the page object is
+// located using the linearization dictionary so that the main xref
+// section needn't be read.
+func (f *file) FirstPage() (ProtectedDictionary, error) {
+	if f.linearization != nil {
+		if n,ok := f.linearization.GetInt("O"); ok {
+			object,err := f.Object(ObjectNumber{uint32(n), 0})
+			if err != nil {
+				return nil, err
+			}
+			if page,ok := object.(Dictionary); ok {
+				return page.Protect().(ProtectedDictionary), nil
+			}
+		}
+	}
+
+	catalog := f.Catalog()
+	if catalog == nil {
+		return nil, errors.New(`Document has no catalog`)
+	}
+	node := catalog.GetDictionary("Pages")
+	for node != nil && node.CheckNameValue("Type", "Pages") {
+		kids := node.GetArray("Kids")
+		if kids == nil || kids.Size() == 0 {
+			break
+		}
+		node,_ = kids.At(0).Dereference().(ProtectedDictionary)
+	}
+	if node == nil || !node.CheckNameValue("Type", "Page") {
+		return nil, errors.New(`Document has no pages`)
+	}
+	return node, nil
+}
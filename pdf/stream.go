@@ -3,14 +3,28 @@ package pdf
 import (
 	"bytes"
 	"container/list"
-	"io")
+	"fmt"
+	"io"
+	"io/ioutil")
 
 // Implements:
 // 	pdf.Object
 
 type ProtectedStream interface {
 	Object
+	// Reader() returns a reader for the fully decoded stream
+	// contents or nil if a filter can't be decoded.
 	Reader() (result io.Reader)
+	// RawReader() applies the stream's leading filters up to the
+	// first image filter (see IsImageFilter()) or filter that
+	// can't be decoded.  It returns a reader for the partially
+	// decoded contents and the names of the remaining filters,
+	// so that, for example, a /DCTDecode image can be exported as
+	// a JPEG file.
+	RawReader() (result io.Reader, remainingFilters []string)
+	// Dictionary() returns a protected copy of the stream
+	// dictionary.
+	Dictionary() ProtectedDictionary
 }
 
 // Implements:
@@ -20,28 +34,67 @@ type Stream interface {
 	ProtectedStream
 	io.Writer
 	AddFilter(filter StreamFilterFactory)
+	// Recompress() decodes the contents through any leading
+	// filters that precede an image filter and replaces those
+	// filters with the ones of factory.  Image filters are kept
+	// so that images aren't re-encoded.
+	Recompress(factory *StreamFactory) error
+	// Add() stores an object under the specified key in the
+	// stream dictionary.
+	Add(key string, object Object)
 	Remove(key string)
 }
 
 type stream struct {
 	dictionary Dictionary
 	buffer     bytes.Buffer
-	// filterList is only used for writing.  Streams are fully
-	// decoded when read and the in-memory stream contents are no
-	// encoded in any way.  However, if a client writes an object
-	// that was previously read, the client may want to use the
-	// same filters.  Therefore, filters encountered while reading
-	// are added to the filter list.
+	// filterList is only used for writing.  The contents are
+	// encoded by these filters when the stream is serialized.
+	// Streams read from a file keep their contents encoded by the
+	// filters named in the dictionary's /Filter, which are written
+	// unchanged unless the client writes to the stream.  Then the
+	// contents are decoded and those filters are moved to the
+	// filter list (see decodeForWriting()).
 	filterList *list.List
+	// encoded is true if the contents were read from a file
+	// encoded by the filters in /Filter and haven't been
+	// modified.  Contents a client writes are never treated as
+	// encoded by /Filter, so a client may set /Filter itself and
+	// write encoded data.
+	encoded bool
+	// source, if not nil, holds the contents in place of buffer.
+	// The contents are loaded into buffer if the client writes
+	// to the stream.
+	source streamSource
 }
 
 // Constructor for standard implementation of Stream.
 func NewStream() Stream {
-	return &stream{NewDictionary(), bytes.Buffer{}, nil}
+	return &stream{NewDictionary(), bytes.Buffer{}, nil, false, nil}
 }
 
+// NewStreamFromContents() constructs a Stream from contents encoded
+// by the filters named in the dictionary, as read from a file.  The
+// contents are decoded if the client writes to the stream.
 func NewStreamFromContents(dictionary Dictionary,b []byte, filterList *list.List) Stream {
-	return &stream{dictionary, *bytes.NewBuffer(b), filterList}
+	return &stream{dictionary, *bytes.NewBuffer(b), filterList, true, nil}
+}
+
+// NewStreamFromReader() constructs a Stream whose contents are read
+// from r when the stream is written rather than being held in memory.
+// The contents must be length bytes, already encoded by any filters
+// the client has added to /Filter in the stream dictionary.  If
+// length is -1 or filters are added with AddFilter(), the contents are
+// read into memory when the stream is written.  r is read only once,
+// so the stream (or a clone) can be written or read only once.
+func NewStreamFromReader(r io.Reader, length int64) Stream {
+	return &stream{NewDictionary(), bytes.Buffer{}, nil, false, &readerSource{r, length}}
+}
+
+// newLazyStream() constructs a Stream whose encoded contents remain in
+// a file until they're used.
+func newLazyStream(dictionary Dictionary, source streamSource) Stream {
+	return &stream{dictionary, bytes.Buffer{}, nil, true, source}
 }
 
 func (s *stream) AddFilter(filter StreamFilterFactory) {
@@ -59,7 +112,8 @@ func (s *stream) Clone() Object {
 			newFilterList.PushBack(item.Value)
 		}
 	}
-	return NewStreamFromContents(s.dictionary,s.buffer.Bytes(), newFilterList)
+	contents := append([]byte(nil), s.buffer.Bytes()...)
+	return &stream{s.dictionary.Clone().(Dictionary), *bytes.NewBuffer(contents), newFilterList, s.encoded, s.source}
 }
 
 func (s *stream) Dereference() Object {
@@ -77,42 +131,211 @@ func (s *stream) Unprotect() Object {
 }
 
 func (s *stream) Reader() (result io.Reader) {
-	result = bytes.NewReader(s.buffer.Bytes())
+	result,remaining := s.decode(false)
+	if len(remaining) > 0 {
+		return nil
+	}
+	return result
+}
+
+func (s *stream) RawReader() (result io.Reader, remainingFilters []string) {
+	return s.decode(true)
+}
+
+// decode() applies the stream's filters in order until it finds one
+// that can't be decoded or, if stopAtImage is true, an image filter.
+// It returns the decoded reader and the names of the filters that
+// weren't applied.
+func (s *stream) decode(stopAtImage bool) (result io.Reader, remainingFilters []string) {
+	result = s.contents()
+	names,parms := s.filters()
+	for i,name := range names {
+		if stopAtImage && IsImageFilter(name) {
+			return result, names[i:]
+		}
+		sff := FilterFactory(name, parms[i])
+		if sff == nil {
+			return result, names[i:]
+		}
+		decoder := sff.NewDecoder(result)
+		if decoder == nil {
+			return result, names[i:]
+		}
+		result = decoder
+	}
+	return result, nil
+}
+
+// filters() returns the names of the filters in the dictionary's
+// /Filter entry and their DecodeParms, which may be nil.
+func (s *stream) filters() (names []string, parms []ProtectedDictionary) {
 	if filters := s.dictionary.GetArray("Filter"); filters != nil {
-		parms := s.dictionary.GetArray("DecodeParms")
+		decodeParms := s.dictionary.GetArray("DecodeParms")
 		for i:=0; i<filters.Size(); i++ {
-			if n,ok := filters.At(i).(Name); ok {
-				var d Dictionary
-				if parms != nil && i < parms.Size() {
-					d,_ = parms.At(i).(Dictionary)
-				}
-				if sff := FilterFactory(n.String(),d); sff != nil {
-					result = sff.NewDecoder(result)
-				} else {
-					return nil
+			if n,ok := filters.At(i).Dereference().(Name); ok {
+				var d ProtectedDictionary
+				if decodeParms != nil && i < decodeParms.Size() {
+					d,_ = decodeParms.At(i).Dereference().(ProtectedDictionary)
 				}
+				names = append(names, n.String())
+				parms = append(parms, d)
 			}
 		}
 	} else if n,ok := s.dictionary.GetName("Filter"); ok {
-		d := s.dictionary.GetDictionary("DecodeParms")
-		if sff := FilterFactory(n,d); sff != nil {
-			result = sff.NewDecoder(result)
+		names = append(names, n)
+		parms = append(parms, s.dictionary.GetDictionary("DecodeParms"))
+	}
+	return names, parms
+}
+
+// setFilters() replaces the dictionary's /Filter and /DecodeParms
+// entries.
+func (s *stream) setFilters(names []string, parms []ProtectedDictionary) {
+	s.dictionary.Remove("Filter")
+	s.dictionary.Remove("DecodeParms")
+	if len(names) == 0 {
+		return
+	}
+	filters := NewArray()
+	decodeParms := NewArray()
+	needDecodeParms := false
+	for i,name := range names {
+		filters.Add(NewName(name))
+		if parms[i] != nil {
+			decodeParms.Add(parms[i].Unprotect())
+			needDecodeParms = true
 		} else {
-			return nil
+			decodeParms.Add(NewNull())
 		}
 	}
-	return result
+	if len(names) == 1 {
+		s.dictionary.Add("Filter", filters.At(0))
+		if needDecodeParms {
+			s.dictionary.Add("DecodeParms", decodeParms.At(0))
+		}
+		return
+	}
+	s.dictionary.Add("Filter", filters)
+	if needDecodeParms {
+		s.dictionary.Add("DecodeParms", decodeParms)
+	}
+}
+
+// decodeForWriting() prepares a stream whose contents are encoded by
+// the filters named in /Filter to be modified.  The contents are
+// decoded and the filters are moved to the filter list so the
+// modified contents are encoded the same way when they're written.
+// Contents encoded by an image filter or a filter that can't be
+// decoded can't be modified.
+func (s *stream) decodeForWriting() error {
+	names,parms := s.filters()
+	if !s.encoded || len(names) == 0 {
+		s.encoded = false
+		return s.load()
+	}
+	factories := make([]StreamFilterFactory, len(names))
+	for i,name := range names {
+		if IsImageFilter(name) {
+			return fmt.Errorf(`Can't modify a stream encoded by %s`, name)
+		}
+		if factories[i] = FilterFactory(name, parms[i]); factories[i] == nil {
+			return fmt.Errorf(`Can't modify a stream encoded by unknown filter %s`, name)
+		}
+	}
+	reader := s.Reader()
+	if reader == nil {
+		return fmt.Errorf(`Can't decode stream filters %v`, names)
+	}
+	contents,err := ioutil.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+	s.buffer = *bytes.NewBuffer(contents)
+	s.source = nil
+	s.encoded = false
+	s.setFilters(nil, nil)
+	for _,factory := range factories {
+		s.AddFilter(factory)
+	}
+	return nil
+}
+
+func (s *stream) Recompress(factory *StreamFactory) error {
+	reader,remaining := s.RawReader()
+	if len(remaining) > 0 && !IsImageFilter(remaining[0]) {
+		return fmt.Errorf(`Can't decode stream filter %s`, remaining[0])
+	}
+	contents,err := ioutil.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+	names,parms := s.filters()
+	decoded := len(names) - len(remaining)
+	s.setFilters(names[decoded:], parms[decoded:])
+	s.buffer = *bytes.NewBuffer(contents)
+	s.source = nil
+	// Contents still encoded by an image filter can't be modified.
+	s.encoded = len(remaining) > 0
+	s.filterList = nil
+	if factory != nil && factory.filterList != nil {
+		for item:=factory.filterList.Front(); item != nil; item = item.Next() {
+			s.AddFilter(item.Value.(StreamFilterFactory))
+		}
+	}
+	return nil
+}
+
+// contents() returns a reader for the stream contents wherever they
+// are held.
+func (s *stream) contents() io.Reader {
+	if s.source != nil {
+		return s.source.open()
+	}
+	return bytes.NewReader(s.buffer.Bytes())
+}
+
+// load() reads contents held by a source into the buffer.
+func (s *stream) load() error {
+	if s.source == nil {
+		return nil
+	}
+	var err error
+	if s.source.size() < 0 {
+		_,err = s.buffer.ReadFrom(s.source.open())
+	} else {
+		err = copySource(&s.buffer, s.source)
+	}
+	s.source = nil
+	return err
+}
+
+func (s *stream) Dictionary() ProtectedDictionary {
+	return s.dictionary.Protect().(ProtectedDictionary)
+}
+
+func (s *stream) Add(key string, object Object) {
+	s.dictionary.Add(key, object)
 }
 
 func (s *stream) Remove(key string) {
 	s.dictionary.Remove(key)
 }
 
+// Write() appends to the decoded contents.  If the stream was read
+// from a file, its contents are first decoded (see decodeForWriting()).
 func (s *stream) Write(bytes []byte) (int, error) {
+	if err := s.decodeForWriting(); err != nil {
+		return 0, err
+	}
 	return s.buffer.Write(bytes)
 }
 
 func (s *stream) Serialize(w Writer, file ...File) {
+	if s.source != nil && s.source.size() >= 0 && (s.filterList == nil || s.filterList.Front() == nil) {
+		s.serializeSource(w, file...)
+		return
+	}
+
 	streamBuffer := NewBufferCloser()
 	dictionary := s.dictionary.Clone().(Dictionary)
 
@@ -168,7 +391,7 @@ func (s *stream) Serialize(w Writer, file ...File) {
 		}
 	}
 
-	streamWriter.Write(s.buffer.Bytes())
+	io.Copy(streamWriter, s.contents())
 	streamWriter.Close()
 
 	dictionary.Add("Length", NewIntNumeric(streamBuffer.Len()))
@@ -179,6 +402,23 @@ func (s *stream) Serialize(w Writer, file ...File) {
 	w.WriteString("\nendstream")
 }
 
+// serializeSource() writes a stream whose contents are held by a
+// source without reading them into memory.  If w is a deferringWriter
+// the contents are copied when w is written to the file.
+func (s *stream) serializeSource(w Writer, file ...File) {
+	dictionary := s.dictionary.Clone().(Dictionary)
+	dictionary.Add("Length", NewIntNumeric(int(s.source.size())))
+	dictionary.Serialize(w, file...)
+
+	w.WriteString("\nstream\n")
+	if dw,ok := w.(deferringWriter); ok {
+		dw.deferBody(s.source)
+	} else {
+		copySource(w, s.source)
+	}
+	w.WriteString("\nendstream")
+}
+
 type protectedStream struct {
 	s Stream
 }
@@ -208,6 +448,14 @@ func (ps protectedStream) Reader() io.Reader {
 	return ps.s.Reader()
 }
 
+func (ps protectedStream) RawReader() (io.Reader, []string) {
+	return ps.s.RawReader()
+}
+
+func (ps protectedStream) Dictionary() ProtectedDictionary {
+	return ps.s.Dictionary()
+}
+
 func (ps protectedStream) Serialize(w Writer, file ...File) {
 	ps.s.Serialize(w, file...)
 }
@@ -0,0 +1,104 @@
+package pdf
+
+import (
+	"bytes"
+	"fmt"
+	"io")
+
+// lazyStreamThreshold is the length above which a stream read from a
+// file is left in the file until its contents are used.
+const lazyStreamThreshold = 64*1024
+
+// streamSource supplies stream contents that aren't held in memory.
+type streamSource interface {
+	// open() returns a reader for the contents.
+	open() io.Reader
+	// size() returns the length of the contents or -1 if it isn't
+	// known.
+	size() int64
+}
+
+// fileRange is the encoded contents of a stream that were left in the
+// file the stream was read from.  The file must remain open while the
+// stream (or a copy written to another file) is in use.
+type fileRange struct {
+	file io.ReaderAt
+	offset, length int64
+}
+
+func (fr *fileRange) open() io.Reader {
+	return io.NewSectionReader(fr.file, fr.offset, fr.length)
+}
+
+func (fr *fileRange) size() int64 {
+	return fr.length
+}
+
+// readerSource is the contents of a stream constructed by
+// NewStreamFromReader().  The reader can be read only once.
+type readerSource struct {
+	reader io.Reader
+	length int64
+}
+
+func (rs *readerSource) open() io.Reader {
+	return rs.reader
+}
+
+func (rs *readerSource) size() int64 {
+	return rs.length
+}
+
+// copySource() copies exactly the size of source to w.
+func copySource(w io.Writer, source streamSource) error {
+	n,err := io.CopyN(w, source.open(), source.size())
+	if err == io.EOF {
+		err = fmt.Errorf(`Stream contents ended after %d of %d bytes`, n, source.size())
+	}
+	return err
+}
+
+// deferringWriter is a Writer that can copy the body of a stream after
+// the object containing it has been serialized, so that the body never
+// has to be held in memory.
+type deferringWriter interface {
+	Writer
+	// deferBody() marks the current position as the place where
+	// the contents of source are to be written.
+	deferBody(source streamSource)
+}
+
+// deferredBody is a stream body to be inserted at position in a
+// serialization.
+type deferredBody struct {
+	position int
+	source streamSource
+}
+
+// serializationBuffer is the Writer file.serialize() passes to
+// Object.Serialize().
+type serializationBuffer struct {
+	bytes.Buffer
+	bodies []deferredBody
+}
+
+func (sb *serializationBuffer) deferBody(source streamSource) {
+	sb.bodies = append(sb.bodies, deferredBody{sb.Len(), source})
+}
+
+// writeWithBodies() writes a serialization to w with its deferred
+// bodies inserted.
+func writeWithBodies(w io.Writer, serialization []byte, bodies []deferredBody) error {
+	written := 0
+	for _,body := range bodies {
+		if _,err := w.Write(serialization[written:body.position]); err != nil {
+			return err
+		}
+		written = body.position
+		if err := copySource(w, body.source); err != nil {
+			return err
+		}
+	}
+	_,err := w.Write(serialization[written:])
+	return err
+}
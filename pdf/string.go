@@ -39,6 +39,23 @@ func NewTextString(s string) String {
 	return &stringImpl{result, NormalStringSerializer}
 }
 
+// TextStringValue() decodes the bytes of a text string, which are
+// UTF-16BE or UTF-8 if they begin with the corresponding byte order
+// mark and PDFDocEncoding otherwise.
+func TextStringValue(b []byte) string {
+	switch {
+	case bytes.HasPrefix(b, []byte{0xfe, 0xff}):
+		words := make([]uint16, 0, len(b)/2-1)
+		for i:=2; i+1<len(b); i+=2 {
+			words = append(words, uint16(b[i])<<8 | uint16(b[i+1]))
+		}
+		return string(utf16.Decode(words))
+	case bytes.HasPrefix(b, []byte{0xef, 0xbb, 0xbf}):
+		return string(b[3:])
+	}
+	return string(PDFDocDecoding(b))
+}
+
 func NewBinaryString(s []byte) String {
 	return &stringImpl{s, NormalStringSerializer}
 }
@@ -0,0 +1,370 @@
+package pdf
+
+import (
+	"bytes"
+	"crypto"
+	_ "crypto/sha512"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// SignatureVerification reports the result of verifying one signature
+// field of a PDF file.
+type SignatureVerification struct {
+	// FieldName is the partial name (/T) of the signature field.
+	FieldName string
+
+	// Name, Reason, Location and SigningTime are copied from the
+	// signature dictionary.  They are not authenticated.
+	Name string
+	Reason string
+	Location string
+	SigningTime string
+	SubFilter string
+
+	// ByteRange is the /ByteRange of the signature dictionary.
+	ByteRange []int64
+
+	// Revision is the index (oldest first) of the revision of the
+	// file covered by the signature, or -1 if the byte range
+	// doesn't end at the end of any revision.
+	Revision int
+
+	// CoversRevision is true if the byte range begins at the
+	// start of the file, ends at the end of a revision, and
+	// excludes only the /Contents string of the signature.
+	CoversRevision bool
+
+	// Certificates are the certificates embedded in the CMS
+	// SignedData.  Signer is the one that made the signature.
+	// Neither is validated against any trust anchor.
+	Certificates []*x509.Certificate
+	Signer *x509.Certificate
+
+	// DigestValid is true if the message digest in the CMS
+	// signed attributes matches the digest of the byte range.
+	DigestValid bool
+
+	// SignatureValid is true if the CMS signature verifies with
+	// the signer's public key.
+	SignatureValid bool
+
+	// LaterRevisions lists the incremental updates appended to
+	// the file after the signed revision, oldest first.
+	LaterRevisions []RevisionChanges
+
+	// Err describes why verification could not be completed.
+	Err error
+}
+
+// Valid() returns true if the signature is cryptographically valid
+// and covers a complete revision of the file.
+func (v *SignatureVerification) Valid() bool {
+	return v.Err == nil && v.CoversRevision && v.DigestValid && v.SignatureValid
+}
+
+// ModifiedAfterSigning() returns true if any later revision changed
+// or deleted an object that existed when the signature was made.
+// Adding a signature rewrites the catalog and the page holding the
+// signature widget, so these changes are reported too; callers
+// decide which changes are acceptable.
+func (v *SignatureVerification) ModifiedAfterSigning() bool {
+	for _,r := range v.LaterRevisions {
+		if len(r.Changed) != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// RevisionChanges describes the objects defined by an incremental
+// update.
+type RevisionChanges struct {
+	// Revision is the index of the revision (oldest first).
+	Revision int
+	XrefOffset int64
+
+	// Changed lists objects that existed in the signed revision
+	// and were rewritten or freed.  Added lists new objects.
+	Changed []ObjectNumber
+	Added []ObjectNumber
+}
+
+// VerifyFile() finds the signature fields of the PDF file named by
+// filename and verifies each signature.  An error is returned only if
+// the file cannot be read; problems with individual signatures are
+// reported in SignatureVerification.Err.
+func VerifyFile(filename string) (result []SignatureVerification, err error) {
+	f,_,err := OpenFile(filename, os.O_RDONLY)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	catalog := f.Catalog()
+	if catalog == nil {
+		return nil, errors.New(`Document has no catalog`)
+	}
+	acroForm := catalog.GetDictionary("AcroForm")
+	if acroForm == nil {
+		return nil, nil
+	}
+	if fields := acroForm.GetArray("Fields"); fields != nil {
+		signatureFields(fields, func(name string, signature ProtectedDictionary) {
+			result = append(result, f.verifySignature(name, signature))
+		})
+	}
+	return result, nil
+}
+
+// signatureFields() calls found for each signature field with a value
+// in the field tree.
+func signatureFields(fields ProtectedArray, found func(string, ProtectedDictionary)) {
+	for i:=0; i<fields.Size(); i++ {
+		field,ok := fields.At(i).Dereference().(ProtectedDictionary)
+		if !ok {
+			continue
+		}
+		if kids := field.GetArray("Kids"); kids != nil {
+			signatureFields(kids, found)
+		}
+		if field.CheckNameValue("FT", "Sig") {
+			if signature := field.GetDictionary("V"); signature != nil {
+				name,_ := field.GetString("T")
+				found(string(name), signature)
+			}
+		}
+	}
+}
+
+func (f *file) verifySignature(name string, signature ProtectedDictionary) (v SignatureVerification) {
+	v.FieldName = name
+	v.Revision = -1
+	for key,value := range map[string]*string{"Name": &v.Name, "Reason": &v.Reason, "Location": &v.Location, "M": &v.SigningTime} {
+		if s,ok := signature.GetString(key); ok {
+			*value = string(s)
+		}
+	}
+	v.SubFilter,_ = signature.GetName("SubFilter")
+
+	byteRange := signature.GetArray("ByteRange")
+	contents,ok := signature.GetString("Contents")
+	if byteRange == nil || byteRange.Size() % 2 != 0 || !ok {
+		v.Err = errors.New(`Signature dictionary has no valid /ByteRange or /Contents`)
+		return
+	}
+	for i:=0; i<byteRange.Size(); i++ {
+		n,ok := byteRange.At(i).Dereference().(*IntNumeric)
+		if !ok || n.Value() < 0 {
+			v.Err = errors.New(`/ByteRange contains an invalid value`)
+			return
+		}
+		v.ByteRange = append(v.ByteRange, int64(n.Value()))
+	}
+
+	f.checkCoverage(&v, contents)
+
+	switch v.SubFilter {
+	case "adbe.pkcs7.detached", "ETSI.CAdES.detached":
+	default:
+		v.Err = fmt.Errorf(`Unsupported signature /SubFilter %s`, v.SubFilter)
+		return
+	}
+
+	v.Err = f.verifyCMS(&v, contents)
+	return
+}
+
+// checkCoverage() determines which revision the signature covers and
+// which revisions were appended after it.  contents is the decoded
+// /Contents string of the signature.
+func (f *file) checkCoverage(v *SignatureVerification, contents []byte) {
+	r := v.ByteRange
+	if len(r) != 4 {
+		return
+	}
+	end := r[2] + r[3]
+	v.Revision = f.revisionEndingAt(end)
+	if v.Revision < 0 {
+		return
+	}
+
+	v.CoversRevision = r[0] == 0 && f.gapIsContents(r[1], r[2], contents)
+
+	signedSize,_ := f.revisions[v.Revision].trailer.GetInt("Size")
+	for i:=v.Revision+1; i<len(f.revisions); i++ {
+		changes := RevisionChanges{Revision: i, XrefOffset: f.revisions[i].xrefOffset}
+		for _,o := range f.revisions[i].objects {
+			switch {
+			case o.number == 0:
+			case int(o.number) < signedSize:
+				changes.Changed = append(changes.Changed, o)
+			default:
+				changes.Added = append(changes.Added, o)
+			}
+		}
+		v.LaterRevisions = append(v.LaterRevisions, changes)
+	}
+}
+
+// gapIsContents() returns true if the bytes from start to end are
+// exactly the hex string holding contents, so that nothing else in
+// the file is excluded from the signature.
+func (f *file) gapIsContents(start, end int64, contents []byte) bool {
+	if end-start != int64(2*len(contents)+2) {
+		return false
+	}
+	gap := make([]byte, end-start)
+	if n,err := f.file.ReadAt(gap, start); n != len(gap) || (err != nil && err != io.EOF) {
+		return false
+	}
+	if gap[0] != '<' || gap[len(gap)-1] != '>' {
+		return false
+	}
+	decoded := make([]byte, len(contents))
+	if _,err := hex.Decode(decoded, gap[1:len(gap)-1]); err != nil {
+		return false
+	}
+	return bytes.Equal(decoded, contents)
+}
+
+// verifyCMS() parses the CMS SignedData in contents and verifies it
+// against the data in the signature's byte range.
+func (f *file) verifyCMS(v *SignatureVerification, contents []byte) error {
+	var info cmsContentInfo
+	if _,err := asn1.Unmarshal(contents, &info); err != nil {
+		return err
+	}
+	if !info.ContentType.Equal(oidSignedData) {
+		return errors.New(`Signature is not a CMS SignedData`)
+	}
+	var signedData cmsSignedData
+	if _,err := asn1.Unmarshal(info.Content.Bytes, &signedData); err != nil {
+		return err
+	}
+	if len(signedData.SignerInfos) != 1 {
+		return fmt.Errorf(`SignedData has %d signers; expected 1`, len(signedData.SignerInfos))
+	}
+	certificates,err := x509.ParseCertificates(signedData.Certificates.Bytes)
+	if err != nil {
+		return err
+	}
+	v.Certificates = certificates
+
+	signerInfo := signedData.SignerInfos[0]
+	for _,c := range certificates {
+		if bytes.Equal(c.RawIssuer, signerInfo.SID.Issuer.FullBytes) && c.SerialNumber.Cmp(signerInfo.SID.SerialNumber) == 0 {
+			v.Signer = c
+		}
+	}
+	if v.Signer == nil {
+		return errors.New(`Signer's certificate is not in the SignedData`)
+	}
+
+	hash,algorithm,err := cmsAlgorithms(signerInfo, v.Signer)
+	if err != nil {
+		return err
+	}
+
+	digester := hash.New()
+	signedContent := new(bytes.Buffer)
+	for i:=0; i<len(v.ByteRange); i+=2 {
+		section := io.NewSectionReader(f.file, v.ByteRange[i], v.ByteRange[i+1])
+		var w io.Writer = digester
+		if len(signerInfo.SignedAttributes.Bytes) == 0 {
+			w = io.MultiWriter(digester, signedContent)
+		}
+		if n,err := io.Copy(w, section); err != nil || n != v.ByteRange[i+1] {
+			return errors.New(`/ByteRange extends past the end of the file`)
+		}
+	}
+	digest := digester.Sum(nil)
+
+	if len(signerInfo.SignedAttributes.Bytes) == 0 {
+		// Without signed attributes the signature is made
+		// directly over the content.
+		v.DigestValid = true
+		v.SignatureValid = v.Signer.CheckSignature(algorithm, signedContent.Bytes(), signerInfo.Signature) == nil
+		return nil
+	}
+
+	messageDigest,err := cmsMessageDigest(signerInfo.SignedAttributes.Bytes)
+	if err != nil {
+		return err
+	}
+	v.DigestValid = bytes.Equal(messageDigest, digest)
+
+	attributeSet,err := asn1.Marshal(asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true, Bytes: signerInfo.SignedAttributes.Bytes})
+	if err != nil {
+		return err
+	}
+	v.SignatureValid = v.Signer.CheckSignature(algorithm, attributeSet, signerInfo.Signature) == nil
+	return nil
+}
+
+// ErrSHA1Digest is the error reported for a signature whose digest
+// algorithm is SHA-1.  Such signatures can't be verified because
+// crypto/x509 rejects SHA-1 signatures as insecure.
+var ErrSHA1Digest = errors.New(`SHA-1 signature digests are insecure and not supported`)
+
+var (
+	oidSHA1 = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+	oidSHA384 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 2}
+	oidSHA512 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 3}
+)
+
+// cmsAlgorithms() returns the digest algorithm of the signer and the
+// x509 signature algorithm corresponding to the digest and the
+// signer's key type.  SHA-1 digests are reported as ErrSHA1Digest
+// rather than as invalid signatures.
+func cmsAlgorithms(signerInfo cmsSignerInfo, signer *x509.Certificate) (crypto.Hash, x509.SignatureAlgorithm, error) {
+	type algorithms struct {
+		hash crypto.Hash
+		rsa, ecdsa x509.SignatureAlgorithm
+	}
+	var a algorithms
+	switch digest := signerInfo.DigestAlgorithm.Algorithm; {
+	case digest.Equal(oidSHA1):
+		return 0, 0, ErrSHA1Digest
+	case digest.Equal(oidSHA256):
+		a = algorithms{crypto.SHA256, x509.SHA256WithRSA, x509.ECDSAWithSHA256}
+	case digest.Equal(oidSHA384):
+		a = algorithms{crypto.SHA384, x509.SHA384WithRSA, x509.ECDSAWithSHA384}
+	case digest.Equal(oidSHA512):
+		a = algorithms{crypto.SHA512, x509.SHA512WithRSA, x509.ECDSAWithSHA512}
+	default:
+		return 0, 0, fmt.Errorf(`Unsupported digest algorithm %v`, digest)
+	}
+	switch signer.PublicKeyAlgorithm {
+	case x509.RSA:
+		return a.hash, a.rsa, nil
+	case x509.ECDSA:
+		return a.hash, a.ecdsa, nil
+	}
+	return 0, 0, fmt.Errorf(`Unsupported public key algorithm %v`, signer.PublicKeyAlgorithm)
+}
+
+// cmsMessageDigest() returns the value of the message digest
+// attribute from the encoded signed attributes.
+func cmsMessageDigest(attributes []byte) ([]byte, error) {
+	for rest := attributes; len(rest) > 0; {
+		var attribute cmsAttribute
+		var err error
+		if rest,err = asn1.Unmarshal(rest, &attribute); err != nil {
+			return nil, err
+		}
+		if attribute.Type.Equal(oidMessageDigest) && len(attribute.Values) == 1 {
+			var digest []byte
+			if _,err = asn1.Unmarshal(attribute.Values[0].FullBytes, &digest); err != nil {
+				return nil, err
+			}
+			return digest, nil
+		}
+	}
+	return nil, errors.New(`Signed attributes have no message digest`)
+}
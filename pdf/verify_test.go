@@ -0,0 +1,20 @@
+package pdf
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"testing"
+)
+
+func TestCMSAlgorithms(t *testing.T) {
+	signer := &x509.Certificate{PublicKeyAlgorithm: x509.ECDSA}
+	signerInfo := cmsSignerInfo{DigestAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidSHA1}}
+	if _,_,err := cmsAlgorithms(signerInfo, signer); err != ErrSHA1Digest {
+		t.Errorf(`cmsAlgorithms() of a SHA-1 digest returned error %v`, err)
+	}
+
+	signerInfo.DigestAlgorithm.Algorithm = oidSHA384
+	if hash,algorithm,err := cmsAlgorithms(signerInfo, signer); err != nil || algorithm != x509.ECDSAWithSHA384 || hash.Size() != 48 {
+		t.Errorf(`cmsAlgorithms() of a SHA-384 digest returned %v, %v, %v`, hash, algorithm, err)
+	}
+}
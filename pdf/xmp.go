@@ -0,0 +1,606 @@
+package pdf
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time")
+
+// Namespaces of the XMP properties that correspond to the entries of
+// the document information dictionary.
+const (
+	rdfNamespace = "http://www.w3.org/1999/02/22-rdf-syntax-ns#"
+	xmlNamespace = "http://www.w3.org/XML/1998/namespace"
+	DublinCoreNamespace = "http://purl.org/dc/elements/1.1/"
+	XMPBasicNamespace = "http://ns.adobe.com/xap/1.0/"
+	AdobePDFNamespace = "http://ns.adobe.com/pdf/1.3/"
+	// PDFExtensionNamespace holds the custom entries of the
+	// document information dictionary.
+	PDFExtensionNamespace = "http://ns.adobe.com/pdfx/1.3/"
+	// Namespaces of the PDF/A extension schema container.
+	extensionNamespace = "http://www.aiim.org/pdfa/ns/extension/"
+	extensionSchemaNamespace = "http://www.aiim.org/pdfa/ns/schema#"
+	extensionPropertyNamespace = "http://www.aiim.org/pdfa/ns/property#" )
+
+// standardPrefixes are the prefixes used for namespaces whose
+// properties don't specify one.
+var standardPrefixes = map[string]string{
+	DublinCoreNamespace: "dc",
+	XMPBasicNamespace: "xmp",
+	AdobePDFNamespace: "pdf",
+	PDFExtensionNamespace: "pdfx"}
+
+// XMPProperty is a simple (text valued) XMP property.
+type XMPProperty struct {
+	Namespace string
+	// Prefix is the namespace prefix used when the property is
+	// serialized.  If empty, a standard or generated prefix is used.
+	Prefix string
+	Name string
+	Value string
+}
+
+// XMPMetadata is the XMP metadata of a document (the catalog's
+// /Metadata stream).  The fields hold the properties that correspond
+// to the entries of the document information dictionary.  Zero
+// values are omitted.
+type XMPMetadata struct {
+	// Title is dc:title, corresponding to /Title.
+	Title string
+	// Creators is dc:creator, corresponding to /Author.
+	Creators []string
+	// Description is dc:description, corresponding to /Subject.
+	Description string
+	// Keywords is pdf:Keywords, corresponding to /Keywords.
+	Keywords string
+	// Producer is pdf:Producer, corresponding to /Producer.
+	Producer string
+	// CreatorTool is xmp:CreatorTool, corresponding to /Creator.
+	CreatorTool string
+	// CreateDate and ModifyDate are xmp:CreateDate and
+	// xmp:ModifyDate, corresponding to /CreationDate and
+	// /ModDate.  MetadataDate is xmp:MetadataDate.
+	CreateDate, ModifyDate, MetadataDate time.Time
+	// Properties holds the other simple properties, including
+	// those in custom namespaces.  Structured properties other
+	// than lists aren't preserved.  Lists are joined with "; ".
+	Properties []XMPProperty
+	// ExtensionSchemas holds the pdfaExtension:schemas property,
+	// which PDF/A requires to describe the properties of schemas
+	// it doesn't predefine.
+	ExtensionSchemas []XMPExtensionSchema
+}
+
+// XMPExtensionSchema describes a custom schema in a PDF/A extension
+// schema container.  Custom value types (pdfaSchema:valueType)
+// aren't preserved.
+type XMPExtensionSchema struct {
+	// Schema is a description of the schema.
+	Schema string
+	NamespaceURI string
+	Prefix string
+	Properties []XMPExtensionProperty
+}
+
+// XMPExtensionProperty describes a property of an extension schema.
+type XMPExtensionProperty struct {
+	Name string
+	// ValueType is an XMP value type such as "Text" or "Date".
+	ValueType string
+	// Category is "internal" or "external".
+	Category string
+	Description string
+}
+
+// Declares() returns true if an extension schema describes the named
+// property.
+func (m *XMPMetadata) Declares(namespace, name string) bool {
+	for _,schema := range m.ExtensionSchemas {
+		if schema.NamespaceURI == namespace {
+			for _,p := range schema.Properties {
+				if p.Name == name {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// Property() returns the value of a property in Properties.
+func (m *XMPMetadata) Property(namespace, name string) (string,bool) {
+	for _,p := range m.Properties {
+		if p.Namespace == namespace && p.Name == name {
+			return p.Value, true
+		}
+	}
+	return "", false
+}
+
+// SetProperty() adds a property to Properties or replaces the value
+// of an existing one.
+func (m *XMPMetadata) SetProperty(namespace, prefix, name, value string) {
+	for i,p := range m.Properties {
+		if p.Namespace == namespace && p.Name == name {
+			m.Properties[i].Value = value
+			if prefix != "" {
+				m.Properties[i].Prefix = prefix
+			}
+			return
+		}
+	}
+	m.Properties = append(m.Properties, XMPProperty{namespace, prefix, name, value})
+}
+
+// ParseXMP() parses a serialized XMP packet.
+func ParseXMP(b []byte) (*XMPMetadata, error) {
+	m := new(XMPMetadata)
+	decoder := xml.NewDecoder(bytes.NewReader(b))
+	prefixes := make(map[string]string)
+
+	var (
+		depth, descriptionDepth int
+		property xml.Name
+		values []string
+		text bytes.Buffer
+		structured bool )
+	for {
+		token,err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf(`Invalid XMP metadata: %v`, err)
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			depth += 1
+			for _,a := range t.Attr {
+				if a.Name.Space == "xmlns" {
+					prefixes[a.Value] = a.Name.Local
+				}
+			}
+			switch {
+			case t.Name.Space == rdfNamespace && t.Name.Local == "Description" && property.Local == "":
+				descriptionDepth = depth
+				// Simple properties may be attributes.
+				for _,a := range t.Attr {
+					switch a.Name.Space {
+					case "", "xmlns", rdfNamespace, xmlNamespace:
+					default:
+						m.set(a.Name, []string{a.Value}, prefixes)
+					}
+				}
+			case descriptionDepth > 0 && depth == descriptionDepth+1:
+				property,values,structured = t.Name,nil,false
+				text.Reset()
+			case property.Local != "" && t.Name.Space == rdfNamespace:
+				switch t.Name.Local {
+				case "li":
+					text.Reset()
+				case "Alt", "Seq", "Bag":
+				default:
+					structured = true
+				}
+			case property.Local != "":
+				structured = true
+			}
+		case xml.CharData:
+			text.Write(t)
+		case xml.EndElement:
+			switch {
+			case depth == descriptionDepth:
+				descriptionDepth = 0
+			case property.Local != "" && depth == descriptionDepth+1:
+				if values == nil {
+					values = []string{strings.TrimSpace(text.String())}
+				}
+				if !structured {
+					m.set(property, values, prefixes)
+				}
+				property = xml.Name{}
+			case property.Local != "" && t.Name.Space == rdfNamespace && t.Name.Local == "li":
+				values = append(values, text.String())
+			}
+			depth -= 1
+		}
+	}
+	m.ExtensionSchemas = parseExtensionSchemas(b)
+	return m, nil
+}
+
+// parseExtensionSchemas() returns the schemas described by the
+// pdfaExtension:schemas property of a packet that has already been
+// parsed successfully.  Fields may be elements or attributes, and
+// the items may be written with rdf:parseType="Resource" or as
+// nested rdf:Description elements.
+func parseExtensionSchemas(b []byte) (schemas []XMPExtensionSchema) {
+	decoder := xml.NewDecoder(bytes.NewReader(b))
+	var (
+		schema *XMPExtensionSchema
+		property *XMPExtensionProperty
+		inSchemas, inProperties bool
+		text bytes.Buffer )
+	setField := func(name xml.Name, value string) {
+		switch {
+		case name.Space == extensionSchemaNamespace && schema != nil:
+			switch name.Local {
+			case "schema":
+				schema.Schema = value
+			case "namespaceURI":
+				schema.NamespaceURI = value
+			case "prefix":
+				schema.Prefix = value
+			}
+		case name.Space == extensionPropertyNamespace && property != nil:
+			switch name.Local {
+			case "name":
+				property.Name = value
+			case "valueType":
+				property.ValueType = value
+			case "category":
+				property.Category = value
+			case "description":
+				property.Description = value
+			}
+		}
+	}
+	for {
+		token,err := decoder.Token()
+		if err != nil {
+			return schemas
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			text.Reset()
+			switch {
+			case t.Name.Space == extensionNamespace && t.Name.Local == "schemas":
+				inSchemas = true
+			case !inSchemas:
+			case t.Name.Space == extensionSchemaNamespace && t.Name.Local == "property":
+				inProperties = true
+			case t.Name.Space == rdfNamespace && t.Name.Local == "li":
+				if inProperties {
+					property = new(XMPExtensionProperty)
+				} else {
+					schema = new(XMPExtensionSchema)
+				}
+			}
+			if inSchemas {
+				for _,a := range t.Attr {
+					setField(a.Name, a.Value)
+				}
+			}
+		case xml.CharData:
+			text.Write(t)
+		case xml.EndElement:
+			switch {
+			case !inSchemas:
+			case t.Name.Space == extensionNamespace && t.Name.Local == "schemas":
+				inSchemas = false
+			case t.Name.Space == extensionSchemaNamespace && t.Name.Local == "property":
+				inProperties = false
+			case t.Name.Space == rdfNamespace && t.Name.Local == "li":
+				if inProperties && property != nil && schema != nil {
+					schema.Properties = append(schema.Properties, *property)
+					property = nil
+				} else if !inProperties && schema != nil {
+					schemas = append(schemas, *schema)
+					schema = nil
+				}
+			default:
+				setField(t.Name, strings.TrimSpace(text.String()))
+			}
+		}
+	}
+}
+
+// set() stores a parsed property.
+func (m *XMPMetadata) set(name xml.Name, values []string, prefixes map[string]string) {
+	value := values[0]
+	switch name {
+	case xml.Name{Space: DublinCoreNamespace, Local: "title"}:
+		m.Title = value
+	case xml.Name{Space: DublinCoreNamespace, Local: "creator"}:
+		m.Creators = values
+	case xml.Name{Space: DublinCoreNamespace, Local: "description"}:
+		m.Description = value
+	case xml.Name{Space: AdobePDFNamespace, Local: "Keywords"}:
+		m.Keywords = value
+	case xml.Name{Space: AdobePDFNamespace, Local: "Producer"}:
+		m.Producer = value
+	case xml.Name{Space: XMPBasicNamespace, Local: "CreatorTool"}:
+		m.CreatorTool = value
+	case xml.Name{Space: XMPBasicNamespace, Local: "CreateDate"}:
+		m.CreateDate,_ = parseXMPDate(value)
+	case xml.Name{Space: XMPBasicNamespace, Local: "ModifyDate"}:
+		m.ModifyDate,_ = parseXMPDate(value)
+	case xml.Name{Space: XMPBasicNamespace, Local: "MetadataDate"}:
+		m.MetadataDate,_ = parseXMPDate(value)
+	default:
+		m.SetProperty(name.Space, prefixes[name.Space], name.Local, strings.Join(values, "; "))
+	}
+}
+
+// xmpDateLayouts are the forms of ISO 8601 dates allowed by XMP.
+var xmpDateLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04Z07:00",
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02",
+	"2006-01",
+	"2006" }
+
+func parseXMPDate(s string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	for _,layout := range xmpDateLayouts {
+		if t,err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf(`Invalid XMP date "%s"`, s)
+}
+
+// xmpEntry is a property with its serialized value.
+type xmpEntry struct {
+	namespace, prefix, name, value string
+}
+
+// Bytes() returns the metadata serialized as an XMP packet.
+func (m *XMPMetadata) Bytes() []byte {
+	var entries []xmpEntry
+	add := func(namespace, name, value string) {
+		entries = append(entries, xmpEntry{namespace, standardPrefixes[namespace], name, value})
+	}
+	if m.Title != "" {
+		add(DublinCoreNamespace, "title", xmpAlt(m.Title))
+	}
+	if len(m.Creators) > 0 {
+		var items bytes.Buffer
+		for _,creator := range m.Creators {
+			fmt.Fprintf(&items, "<rdf:li>%s</rdf:li>", xmpText(creator))
+		}
+		add(DublinCoreNamespace, "creator", "<rdf:Seq>" + items.String() + "</rdf:Seq>")
+	}
+	if m.Description != "" {
+		add(DublinCoreNamespace, "description", xmpAlt(m.Description))
+	}
+	for _,date := range []struct{ name string; t time.Time }{
+		{"CreateDate", m.CreateDate},
+		{"ModifyDate", m.ModifyDate},
+		{"MetadataDate", m.MetadataDate}} {
+		if !date.t.IsZero() {
+			add(XMPBasicNamespace, date.name, date.t.Format(time.RFC3339))
+		}
+	}
+	if m.CreatorTool != "" {
+		add(XMPBasicNamespace, "CreatorTool", xmpText(m.CreatorTool))
+	}
+	if m.Producer != "" {
+		add(AdobePDFNamespace, "Producer", xmpText(m.Producer))
+	}
+	if m.Keywords != "" {
+		add(AdobePDFNamespace, "Keywords", xmpText(m.Keywords))
+	}
+	for _,p := range m.Properties {
+		prefix := p.Prefix
+		if prefix == "" {
+			prefix = standardPrefixes[p.Namespace]
+		}
+		entries = append(entries, xmpEntry{p.Namespace, prefix, p.Name, xmpText(p.Value)})
+	}
+
+	// Each namespace gets its own rdf:Description in the order
+	// the namespaces first appear.
+	var namespaces []string
+	byNamespace := make(map[string][]xmpEntry)
+	prefixes := make(map[string]string)
+	for _,e := range entries {
+		if _,ok := byNamespace[e.namespace]; !ok {
+			namespaces = append(namespaces, e.namespace)
+			prefix := e.prefix
+			if prefix == "" {
+				prefix = fmt.Sprintf("ns%d", len(namespaces))
+			}
+			prefixes[e.namespace] = prefix
+		}
+		byNamespace[e.namespace] = append(byNamespace[e.namespace], e)
+	}
+
+	var b bytes.Buffer
+	b.WriteString("<?xpacket begin=\"\ufeff\" id=\"W5M0MpCehiHzreSzNTczkc9d\"?>\n")
+	b.WriteString("<x:xmpmeta xmlns:x=\"adobe:ns:meta/\">\n")
+	b.WriteString(" <rdf:RDF xmlns:rdf=\"" + rdfNamespace + "\">\n")
+	for _,namespace := range namespaces {
+		prefix := prefixes[namespace]
+		fmt.Fprintf(&b, "  <rdf:Description rdf:about=\"\" xmlns:%s=\"%s\">\n", prefix, xmpText(namespace))
+		for _,e := range byNamespace[namespace] {
+			fmt.Fprintf(&b, "   <%s:%s>%s</%s:%s>\n", prefix, e.name, e.value, prefix, e.name)
+		}
+		b.WriteString("  </rdf:Description>\n")
+	}
+	if len(m.ExtensionSchemas) > 0 {
+		writeExtensionSchemas(&b, m.ExtensionSchemas)
+	}
+	b.WriteString(" </rdf:RDF>\n")
+	b.WriteString("</x:xmpmeta>\n")
+	b.WriteString("<?xpacket end=\"w\"?>")
+	return b.Bytes()
+}
+
+func writeExtensionSchemas(b *bytes.Buffer, schemas []XMPExtensionSchema) {
+	fmt.Fprintf(b, "  <rdf:Description rdf:about=\"\" xmlns:pdfaExtension=\"%s\" xmlns:pdfaSchema=\"%s\" xmlns:pdfaProperty=\"%s\">\n",
+		extensionNamespace, extensionSchemaNamespace, extensionPropertyNamespace)
+	b.WriteString("   <pdfaExtension:schemas><rdf:Bag>\n")
+	for _,schema := range schemas {
+		b.WriteString("    <rdf:li rdf:parseType=\"Resource\">\n")
+		fmt.Fprintf(b, "     <pdfaSchema:schema>%s</pdfaSchema:schema>\n", xmpText(schema.Schema))
+		fmt.Fprintf(b, "     <pdfaSchema:namespaceURI>%s</pdfaSchema:namespaceURI>\n", xmpText(schema.NamespaceURI))
+		fmt.Fprintf(b, "     <pdfaSchema:prefix>%s</pdfaSchema:prefix>\n", xmpText(schema.Prefix))
+		if len(schema.Properties) > 0 {
+			b.WriteString("     <pdfaSchema:property><rdf:Seq>\n")
+			for _,p := range schema.Properties {
+				fmt.Fprintf(b, "      <rdf:li rdf:parseType=\"Resource\"><pdfaProperty:name>%s</pdfaProperty:name><pdfaProperty:valueType>%s</pdfaProperty:valueType><pdfaProperty:category>%s</pdfaProperty:category><pdfaProperty:description>%s</pdfaProperty:description></rdf:li>\n",
+					xmpText(p.Name), xmpText(p.ValueType), xmpText(p.Category), xmpText(p.Description))
+			}
+			b.WriteString("     </rdf:Seq></pdfaSchema:property>\n")
+		}
+		b.WriteString("    </rdf:li>\n")
+	}
+	b.WriteString("   </rdf:Bag></pdfaExtension:schemas>\n")
+	b.WriteString("  </rdf:Description>\n")
+}
+
+func xmpText(s string) string {
+	var b bytes.Buffer
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+func xmpAlt(s string) string {
+	return "<rdf:Alt><rdf:li xml:lang=\"x-default\">" + xmpText(s) + "</rdf:li></rdf:Alt>"
+}
+
+// Metadata() returns the document's XMP metadata, which is read from
+// the catalog's /Metadata stream if it hasn't been set with
+// SetMetadata().  It is nil if the document has none.  Changes to the
+// returned metadata are written by Close().
+func (d *Document) Metadata() (*XMPMetadata, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.metadata == nil {
+		m,err := d.readMetadata()
+		if err != nil {
+			return nil, err
+		}
+		d.metadata = m
+		if m != nil {
+			d.originalMetadata = m.Bytes()
+		}
+	}
+	return d.metadata, nil
+}
+
+// SetMetadata() replaces the document's XMP metadata.  When the
+// document is closed, the metadata is reconciled with the document
+// information dictionary (see Close()).
+func (d *Document) SetMetadata(m *XMPMetadata) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.metadata = m
+	d.originalMetadata = nil
+}
+
+// metadataChanged() returns true if metadata was set by SetMetadata()
+// or if the metadata returned by Metadata() was changed.
+func (d *Document) metadataChanged() bool {
+	return d.metadata != nil && (d.originalMetadata == nil || !bytes.Equal(d.metadata.Bytes(), d.originalMetadata))
+}
+
+// readMetadata() parses the catalog's /Metadata stream.  It returns
+// nil if there is none.
+func (d *Document) readMetadata() (*XMPMetadata, error) {
+	stream := d.catalog.GetStream("Metadata")
+	if stream == nil {
+		return nil, nil
+	}
+	reader := stream.Reader()
+	if reader == nil {
+		return nil, fmt.Errorf(`Can't decode the /Metadata stream`)
+	}
+	b,err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	return ParseXMP(b)
+}
+
+// finishMetadata() reconciles the XMP metadata with the document
+// information dictionary and writes it if either has changed.  Entries
+// of the information dictionary replace the corresponding XMP
+// properties.  XMP properties without a corresponding entry are added
+// to the dictionary.  Metadata that can't be parsed is replaced.  The
+// metadata is written over an existing /Metadata object, if any.  A
+// document with a PDF/A conformance level always has metadata, which
+// identifies the level, and custom entries aren't copied to it because
+// PDF/A requires an extension schema for them.
+func (d *Document) finishMetadata() {
+	if !d.DocumentInfo.IsDirty() && !d.metadataChanged() && d.conformance == NoConformance {
+		return
+	}
+	m := d.metadata
+	if m == nil {
+		m,_ = d.readMetadata()
+		if m == nil {
+			m = new(XMPMetadata)
+		}
+	}
+
+	texts := []struct{ key string; value *string }{
+		{"Title", &m.Title},
+		{"Subject", &m.Description},
+		{"Keywords", &m.Keywords},
+		{"Creator", &m.CreatorTool},
+		{"Producer", &m.Producer}}
+	for _,text := range texts {
+		if v,ok := d.text(text.key); ok {
+			*text.value = v
+		} else if *text.value != "" {
+			d.setText(text.key, *text.value)
+		}
+	}
+
+	if author,ok := d.Author(); ok {
+		if strings.Join(m.Creators, "; ") != author {
+			m.Creators = []string{author}
+		}
+	} else if len(m.Creators) > 0 {
+		d.SetAuthor(strings.Join(m.Creators, "; "))
+	}
+
+	if t,ok := d.CreationDate(); ok {
+		m.CreateDate = t
+	} else if !m.CreateDate.IsZero() {
+		d.SetCreationDate(m.CreateDate)
+	}
+	if t,ok := d.ModDate(); ok {
+		m.ModifyDate = t
+	} else if !m.ModifyDate.IsZero() {
+		d.SetModDate(m.ModifyDate)
+	}
+
+	if d.conformance == NoConformance {
+		for _,key := range d.CustomKeys() {
+			if v,ok := d.Custom(key); ok {
+				m.SetProperty(PDFExtensionNamespace, "", key, v)
+			}
+		}
+	} else {
+		m.SetProperty(PDFAIdentificationNamespace, "pdfaid", "part", d.conformance.part())
+		m.SetProperty(PDFAIdentificationNamespace, "pdfaid", "conformance", "B")
+	}
+	for _,p := range m.Properties {
+		if _,ok := d.Custom(p.Name); p.Namespace == PDFExtensionNamespace && !ok {
+			d.SetCustom(p.Name, p.Value)
+		}
+	}
+	m.MetadataDate = time.Now()
+
+	stream := NewStream()
+	stream.Add("Type", NewName("Metadata"))
+	stream.Add("Subtype", NewName("XML"))
+	stream.Write(m.Bytes())
+	// An existing /Metadata object is rewritten rather than
+	// replaced by a new object.
+	if existing,ok := d.catalog.Get("Metadata").(Indirect); ok {
+		existing.Write(stream)
+	} else {
+		reference,_ := d.file.WriteObject(stream)
+		d.catalog.Add("Metadata", reference)
+	}
+	d.metadata = m
+}
@@ -14,12 +14,25 @@ type ByteScannerReader interface {
 // saves the history of the previous "n" reads in a circular buffer.
 // It is useful, for example, with lexical scanners so that when an
 // error occurs, the HistoryReader can provide the last "n" bytes
-// leading up to the error.
+// leading up to the error.  It also tracks the byte offset and line
+// number of the next byte to be read.
 type HistoryReader struct {
 	reader ByteScannerReader
 	buffer []byte
 	end, size uint
 	capacity uint
+
+	// offset and line locate the next byte to be read.  Lines
+	// are counted from 1 and end with LF, CR, or CRLF.
+	offset int64
+	line int
+
+	// pending holds bytes returned to the input by PushBack().
+	// They are read before any more bytes are read from reader.
+	pending []byte
+	// lastFromPending is true if the last byte read came from
+	// pending rather than from reader.
+	lastFromPending bool
 }
 
 // NewHistoryReader() creates a new HistoryReader from a
@@ -30,12 +43,11 @@ func NewHistoryReader (reader ByteScannerReader,capacity uint) *HistoryReader {
 		buffer: make([]byte, capacity),
 		end: 0,
 		size: 0,
-		capacity: capacity}
+		capacity: capacity,
+		line: 1}
 }
 
 // GetHistory() returns the contents of the circular history buffer.
-// It is the only method added to HistoryReader that distinguishes it
-// from ByteScannerReader.
 func (d *HistoryReader) GetHistory() []byte {
 	history := make([]byte,d.size)
 	beginning := d.end + d.capacity - d.size
@@ -45,36 +57,109 @@ func (d *HistoryReader) GetHistory() []byte {
 	return history
 }
 
-func (d *HistoryReader) Read(b []byte) (n int, err error) {
-	n,err = d.reader.Read(b)
-	for i:=0; i<n; i++ {
-		d.buffer[d.end] = b[i]
-		d.end = (d.end+1) % d.capacity
+// Offset() returns the number of bytes that have been read, which is
+// the offset of the next byte to be read.
+func (d *HistoryReader) Offset() int64 {
+	return d.offset
+}
+
+// Line() returns the line number of the next byte to be read.
+func (d *HistoryReader) Line() int {
+	return d.line
+}
+
+// PushBack() returns the most recently read bytes to the input so
+// that they will be read again.  Unlike UnreadByte(), it can return
+// any number of bytes.
+func (d *HistoryReader) PushBack(b []byte) {
+	for i:=len(b)-1; i>=0; i-- {
+		var previous byte
+		if i > 0 {
+			previous = b[i-1]
+		}
+		d.line -= lineBreak(previous, b[i])
+	}
+	d.offset -= int64(len(b))
+	n := uint(len(b))
+	if n > d.size {
+		n = d.size
+	}
+	d.end = (d.end + d.capacity - n) % d.capacity
+	d.size -= n
+	d.pending = append(append([]byte(nil), b...), d.pending...)
+	d.lastFromPending = false
+}
+
+// lineBreak() returns 1 if b ends a line when it follows previous.
+func lineBreak(previous, b byte) int {
+	if b == '\r' || (b == '\n' && previous != '\r') {
+		return 1
 	}
-	d.size += uint(n)
+	return 0
+}
+
+// record() adds b to the history and advances the position.
+func (d *HistoryReader) record(b byte) {
+	var previous byte
+	if d.offset > 0 {
+		previous = d.buffer[(d.end+d.capacity-1) % d.capacity]
+	}
+	d.line += lineBreak(previous, b)
+	d.offset += 1
+	d.buffer[d.end] = b
+	d.end = (d.end+1) % d.capacity
+	d.size += 1
 	if (d.size > d.capacity) {
 		d.size = d.capacity
 	}
+}
+
+func (d *HistoryReader) Read(b []byte) (n int, err error) {
+	if len(d.pending) > 0 {
+		n = copy(b, d.pending)
+		d.pending = d.pending[n:]
+		d.lastFromPending = true
+	} else {
+		n,err = d.reader.Read(b)
+		d.lastFromPending = false
+	}
+	for i:=0; i<n; i++ {
+		d.record(b[i])
+	}
 	return
 }
 
 func (d *HistoryReader) ReadByte() (b byte, err error) {
-	b,err = d.reader.ReadByte()
+	if len(d.pending) > 0 {
+		b = d.pending[0]
+		d.pending = d.pending[1:]
+		d.lastFromPending = true
+	} else {
+		b,err = d.reader.ReadByte()
+		d.lastFromPending = false
+	}
 	if err == nil {
-		d.buffer[d.end] = b
-		d.end = (d.end+1) % d.capacity
-		d.size += 1
-		if (d.size > d.capacity) {
-			d.size = d.capacity
-		}
+		d.record(b)
 	}
 	return
 }
 
 func (d *HistoryReader) UnreadByte() (err error) {
-	err = d.reader.UnreadByte()
+	if d.lastFromPending {
+		d.pending = append([]byte{d.buffer[(d.end+d.capacity-1) % d.capacity]}, d.pending...)
+		d.lastFromPending = false
+	} else {
+		err = d.reader.UnreadByte()
+	}
 	if (err == nil) {
-		d.end = (d.end+d.capacity-1) % d.capacity
+		last := (d.end+d.capacity-1) % d.capacity
+		previous := d.buffer[(d.end+d.capacity-2) % d.capacity]
+		if d.offset < 2 {
+			previous = 0
+		}
+		d.line -= lineBreak(previous, d.buffer[last])
+		d.offset -= 1
+		d.end = last
 		if (d.size > 0) {
 			d.size = d.size - 1
 		}
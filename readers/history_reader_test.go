@@ -35,3 +35,35 @@ func TestHistoryReader (t *testing.T) {
 	b := make([]byte,4); reader.Read(b); check ("efgh")
 }
 
+
+func TestHistoryReaderPosition (t *testing.T) {
+	reader := NewHistoryReader(strings.NewReader("ab\ncd\r\nef\rgh"),4)
+
+	check := func (offset int64, line int) {
+		if reader.Offset() != offset || reader.Line() != line {
+			t.Errorf (`Expected offset %d, line %d; got offset %d, line %d`,
+				offset, line, reader.Offset(), reader.Line())
+		}
+	}
+
+	check (0, 1)
+	b := make([]byte,3); reader.Read(b); check (3, 2)
+	reader.UnreadByte(); check (2, 1)
+	reader.ReadByte(); check (3, 2)
+
+	b = make([]byte,4); reader.Read(b); check (7, 3)
+	reader.PushBack([]byte("d\r\n")); check (4, 2)
+	if h:=string(reader.GetHistory()); h != "c" {
+		t.Errorf (`Expected history "c" after PushBack(); got "%s"`, h)
+	}
+	if c,_ := reader.ReadByte(); c != 'd' {
+		t.Errorf (`Expected "d" after PushBack(); got "%c"`, c)
+	}
+	reader.UnreadByte(); check (4, 2)
+
+	b = make([]byte,8); n,_ := reader.Read(b); check (7, 3)
+	if string(b[:n]) != "d\r\n" {
+		t.Errorf (`Expected "d\r\n" after PushBack(); got "%s"`, b[:n])
+	}
+	b = make([]byte,8); reader.Read(b); check (12, 4)
+}